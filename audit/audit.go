@@ -0,0 +1,209 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package audit writes one record per request, served or denied, to a sink kept apart from the operational logs.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+// Record is what is known about a request once it is served.
+type Record struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	RemoteIP     string    `json:"remote_ip"`
+	ClientID     string    `json:"client_id,omitempty"`
+	Customer     string    `json:"customer,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Object       string    `json:"object,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	Status       int       `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Bytes        int64     `json:"bytes"`
+	DurationMS   float64   `json:"duration_ms"`
+	Completed    bool      `json:"completed"`
+	// Seq and Prev chain records, see Chain.
+	Seq  uint64 `json:"seq,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// Outcomes of requests: denied means the client was not allowed to, failed covers everything else that did not succeed.
+const (
+	Success = "success"
+	Denied  = "denied"
+	Failed  = "failed"
+)
+
+// Outcome tells the outcome of a request from its status code.
+func Outcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return Success
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return Denied
+	default:
+		return Failed
+	}
+}
+
+// Sink takes records as JSON documents, one per line.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Options configure Open.
+type Options struct {
+	// File is the path of the file sink, rotated once it reaches MaxSize bytes or is older than MaxAge.
+	// MaxBackups rotated files are kept.
+	File       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	// SyslogTag tags records of the syslog sink.
+	SyslogTag string
+}
+
+// Open opens the sink of the kind, stdout, file or syslog.
+func Open(kind string, opts Options) (Sink, error) {
+	switch kind {
+	case "stdout":
+		return &writerSink{w: os.Stdout}, nil
+	case "file":
+		return openFile(opts.File, opts.MaxSize, opts.MaxAge, opts.MaxBackups)
+	case "syslog":
+		return openSyslog(opts.SyslogTag)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %s, use stdout, file or syslog", kind)
+	}
+}
+
+// writerSink writes records as JSON lines.
+type writerSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (s *writerSink) Write(line []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// Log audits requests to a sink. A nil Log audits nothing.
+type Log struct {
+	sink        Sink
+	errorHeader string
+	chain       *chain
+}
+
+// New audits to the sink. errorHeader is API_RSP_ERROR_HEADER, its RSP code goes to the error field.
+func New(sink Sink, errorHeader string) *Log {
+	return &Log{sink: sink, errorHeader: errorHeader}
+}
+
+// Audit writes a record of every request the handler serves. The request ID and the object come from
+// the fields of the request, see logging.Requests and logging.Annotate.
+func (l *Log) Audit(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := logging.NewRecorder(w)
+		next(recorder, r)
+		rec := Record{
+			Time:       start.UTC(),
+			RequestID:  logging.Field(r.Context(), "request_id"),
+			Endpoint:   endpoint,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteIP:   RemoteIP(r),
+			Object:     logging.Field(r.Context(), "object"),
+			ETag:       recorder.Header().Get("ETag"),
+			Status:     recorder.Code(),
+			Error:      config.ResponseCode(recorder.Header().Get(l.errorHeader)),
+			Outcome:    Outcome(recorder.Code()),
+			Bytes:      recorder.Written(),
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Completed:  recorder.Err() == nil && r.Context().Err() == nil,
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			rec.ClientID = subject.CommonName
+			if len(subject.Locality) > 0 {
+				rec.Customer = subject.Locality[0]
+			}
+			if len(subject.Organization) > 0 {
+				rec.Organization = subject.Organization[0]
+			}
+		}
+		if err := l.write(rec); err != nil {
+			logging.Error(r.Context(), config.RSL00041, rec.Path, err.Error())
+		}
+	}
+}
+
+func (l *Log) write(rec Record) error {
+	if l.chain != nil {
+		return l.chain.write(rec)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return l.sink.Write(line)
+}
+
+// Close closes the sink. A chained log is sealed with a last checkpoint first.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	if l.chain != nil {
+		l.chain.close()
+	}
+	return l.sink.Close()
+}
+
+// RemoteIP is the address of the client without the port.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/config"
+)
+
+type memorySink struct {
+	lines   [][]byte
+	records []Record
+}
+
+func (s *memorySink) Write(line []byte) error {
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	s.lines = append(s.lines, line)
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	sink := &memorySink{}
+	handler := New(sink, "X-Error").Audit("download", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-resolver-id") != "666" {
+			w.Header().Set("X-Error", fmt.Sprintf(config.RSP00007, 666, 777, "x-resolver-id"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"hash-666"`)
+		w.Write([]byte("resolver cache"))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/sinkit/rest/protostream/resolvercache/", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+		Subject: pkix.Name{CommonName: "666", Locality: []string{"999"}, Organization: []string{"Whalebone"}},
+	}}}}
+	req.Header.Set("x-resolver-id", "666")
+	handler(httptest.NewRecorder(), req)
+	req.Header.Set("x-resolver-id", "777")
+	handler(httptest.NewRecorder(), req)
+
+	assert.Len(t, sink.records, 2)
+	served, denied := sink.records[0], sink.records[1]
+	assert.Equal(t, "download", served.Endpoint)
+	assert.Equal(t, "192.0.2.1", served.RemoteIP)
+	assert.Equal(t, "666", served.ClientID)
+	assert.Equal(t, "999", served.Customer)
+	assert.Equal(t, "Whalebone", served.Organization)
+	assert.Equal(t, `"hash-666"`, served.ETag)
+	assert.Equal(t, http.StatusOK, served.Status)
+	assert.Equal(t, Success, served.Outcome)
+	assert.Equal(t, int64(len("resolver cache")), served.Bytes)
+	assert.True(t, served.Completed)
+	assert.Equal(t, http.StatusForbidden, denied.Status)
+	assert.Equal(t, Denied, denied.Outcome)
+	assert.Equal(t, "RSP00007", denied.Error)
+
+	// A nil Log audits nothing.
+	var none *Log
+	assert.NotNil(t, none.Audit("download", func(w http.ResponseWriter, r *http.Request) {}))
+	assert.NoError(t, none.Close())
+}
+
+func TestOutcome(t *testing.T) {
+	assert.Equal(t, Success, Outcome(http.StatusNotModified))
+	assert.Equal(t, Denied, Outcome(http.StatusUnauthorized))
+	assert.Equal(t, Failed, Outcome(http.StatusNotFound))
+	assert.Equal(t, Failed, Outcome(466))
+	assert.Equal(t, Failed, Outcome(http.StatusInternalServerError))
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := Open("file", Options{File: path, MaxSize: 300, MaxAge: time.Hour, MaxBackups: 2})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		line, err := json.Marshal(Record{Path: "/data", Status: i})
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Write(line))
+	}
+	assert.NoError(t, sink.Close())
+
+	backups, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	var last Record
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		assert.NoError(t, json.Unmarshal(lines.Bytes(), &last))
+	}
+	assert.Equal(t, 9, last.Status)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(300))
+
+	_, err = Open("kafka", Options{})
+	assert.Error(t, err)
+	_, err = Open("file", Options{File: filepath.Join(path, "nowhere")})
+	assert.Error(t, err)
+}
+
+func TestFileRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := Open("file", Options{File: path, MaxSize: 100})
+	assert.NoError(t, err)
+	defer sink.Close()
+	rename = func(string, string) error { return errors.New("read-only") }
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, sink.Write([]byte(`{"path":"/data","status":200}`)))
+	}
+	rename = os.Rename
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, strings.Count(string(content), "\n"))
+
+	// Rotates once it can.
+	assert.NoError(t, sink.Write([]byte(`{"path":"/data","status":200}`)))
+	backups, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
+
+func TestFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, os.WriteFile(path, []byte("{}\n"), 0o600))
+	time.Sleep(100 * time.Millisecond)
+	// Written just now, but created earlier than MaxAge.
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now()))
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	info, err := file.Stat()
+	assert.NoError(t, err)
+	birth := created(file, info)
+	file.Close()
+	if birth.Equal(info.ModTime()) {
+		t.Skip("the file system does not keep the birth time")
+	}
+	sink, err := Open("file", Options{File: path, MaxAge: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer sink.Close()
+	assert.NoError(t, sink.Write([]byte("{}")))
+	backups, err := filepath.Glob(path + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
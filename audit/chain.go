@@ -0,0 +1,373 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/signing"
+)
+
+// A chained log is tamper-evident: every line carries its sequence number and the SHA-256 of the previous line,
+// hex encoded, and checkpoints sign the hash of the line before them, see checkpointDigest. Changing, removing
+// or reordering lines breaks the chain, and the chain up to a checkpoint cannot be rewritten without the signing key.
+// A chain starts with Seq 1 and no Prev.
+
+// CheckpointType is the type of checkpoint lines.
+const CheckpointType = "checkpoint"
+
+// checkpointContext prefixes the signed chain hash, so that a checkpoint signature is never valid for a file
+// signed with the same key, nor the other way round.
+const checkpointContext = "serve-file audit checkpoint v1\n"
+
+// Checkpoint signs the chain up to Prev. Records is the number of records since the previous checkpoint.
+type Checkpoint struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Seq       uint64    `json:"seq"`
+	Prev      string    `json:"prev"`
+	Records   uint64    `json:"records"`
+	Signature string    `json:"signature"`
+}
+
+// Signer signs the SHA-256 digest of the chain at a checkpoint, see signing.Signer.
+type Signer interface {
+	SignDigest(digest []byte) (string, error)
+}
+
+// ChainOptions configure NewChained. Seq and Prev continue an existing chain, see Resume.
+// A checkpoint is written after Every records or Interval, whichever comes first, and on Close.
+type ChainOptions struct {
+	Seq      uint64
+	Prev     string
+	Every    uint64
+	Interval time.Duration
+}
+
+type chain struct {
+	mutex   sync.Mutex
+	sink    Sink
+	signer  Signer
+	every   uint64
+	seq     uint64
+	prev    string
+	records uint64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewChained audits to the sink in a hash chain with checkpoints signed by the signer.
+func NewChained(sink Sink, errorHeader string, signer Signer, opts ChainOptions) *Log {
+	c := &chain{
+		sink:   sink,
+		signer: signer,
+		every:  opts.Every,
+		seq:    opts.Seq,
+		prev:   opts.Prev,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.checkpoints(opts.Interval)
+	return &Log{sink: sink, errorHeader: errorHeader, chain: c}
+}
+
+func (c *chain) checkpoints(interval time.Duration) {
+	defer close(c.done)
+	if interval <= 0 {
+		<-c.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mutex.Lock()
+			err := c.checkpoint()
+			c.mutex.Unlock()
+			if err != nil {
+				logging.Error(context.Background(), config.RSL00042, err.Error())
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *chain) write(rec Record) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	rec.Seq, rec.Prev = c.seq+1, c.prev
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := c.append(line); err != nil {
+		return err
+	}
+	c.records++
+	if c.every > 0 && c.records >= c.every {
+		return c.checkpoint()
+	}
+	return nil
+}
+
+// append writes the line and moves the chain past it. Unless it is written, the chain stays where it was.
+func (c *chain) append(line []byte) error {
+	if err := c.sink.Write(line); err != nil {
+		return err
+	}
+	c.seq++
+	c.prev = hash(line)
+	return nil
+}
+
+// checkpoint signs the chain if there are records since the last checkpoint.
+func (c *chain) checkpoint() error {
+	if c.records == 0 {
+		return nil
+	}
+	digest, err := checkpointDigest(c.prev)
+	if err != nil {
+		return err
+	}
+	signature, err := c.signer.SignDigest(digest)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(Checkpoint{
+		Time:      time.Now().UTC(),
+		Type:      CheckpointType,
+		Seq:       c.seq + 1,
+		Prev:      c.prev,
+		Records:   c.records,
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.append(line); err != nil {
+		return err
+	}
+	c.records = 0
+	return nil
+}
+
+func (c *chain) close() {
+	close(c.stop)
+	<-c.done
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkpoint(); err != nil {
+		logging.Error(context.Background(), config.RSL00042, err.Error())
+	}
+}
+
+// checkpointDigest is what a checkpoint signs: SHA-256 of checkpointContext and the chain hash.
+func checkpointDigest(prev string) ([]byte, error) {
+	head, err := hex.DecodeString(prev)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(append([]byte(checkpointContext), head...))
+	return digest[:], nil
+}
+
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// link is what chains a line, records and checkpoints alike.
+type link struct {
+	Type      string `json:"type"`
+	Seq       uint64 `json:"seq"`
+	Prev      string `json:"prev"`
+	Signature string `json:"signature"`
+}
+
+// Resume finds where the chain of the file sink at path stopped: the last line of the file or,
+// if the file is empty or missing, of its newest rotated file. A new chain starts if there is none.
+func Resume(path string) (uint64, string, error) {
+	backups, _ := filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	files := append([]string{path}, reverse(backups)...)
+	for _, file := range files {
+		last, err := lastLine(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		if len(last) == 0 {
+			continue
+		}
+		var l link
+		if err := json.Unmarshal(last, &l); err != nil {
+			return 0, "", fmt.Errorf("%s: %w", file, err)
+		}
+		return l.Seq, hash(last), nil
+	}
+	return 0, "", nil
+}
+
+func reverse(s []string) []string {
+	r := make([]string, 0, len(s))
+	for i := len(s) - 1; i >= 0; i-- {
+		r = append(r, s[i])
+	}
+	return r
+}
+
+func lastLine(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimRight(content, "\n")
+	return content[bytes.LastIndexByte(content, '\n')+1:], nil
+}
+
+// Report sums up a verified chain. Unsigned records are not followed by a checkpoint of their chain.
+// Starts counts chains started anew, e.g. when a stdout sink was restarted.
+// Seq and Head are the sequence number and hash of the last line, they anchor the verification of later files.
+type Report struct {
+	Records     uint64
+	Checkpoints uint64
+	Unsigned    uint64
+	Starts      uint64
+	Seq         uint64
+	Head        string
+}
+
+// VerifyOptions configure NewVerifier. Seq and Prev anchor the chain: the first line has to follow the line
+// with sequence number Seq and hash Prev, e.g. the last line of files verified and deleted earlier.
+// Without an anchor the first line has to start the chain. Chains starting anew later break the chain,
+// unless AllowRestarts.
+type VerifyOptions struct {
+	Seq           uint64
+	Prev          string
+	AllowRestarts bool
+}
+
+// Verifier checks chained logs line by line. Files of a rotated log are verified in order with one Verifier,
+// so that the chain runs across them.
+type Verifier struct {
+	keys          map[string]crypto.PublicKey
+	allowRestarts bool
+	seq           uint64
+	prev          string
+	pending       uint64
+	report        Report
+}
+
+// NewVerifier checks checkpoints with the public keys.
+func NewVerifier(publicKeys []crypto.PublicKey, opts VerifyOptions) (*Verifier, error) {
+	keys := make(map[string]crypto.PublicKey, len(publicKeys))
+	for _, key := range publicKeys {
+		kid, err := signing.KeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		keys[kid] = key
+	}
+	if (opts.Seq == 0) != (len(opts.Prev) == 0) {
+		return nil, errors.New("the anchor needs both the sequence number and the hash")
+	}
+	return &Verifier{keys: keys, allowRestarts: opts.AllowRestarts, seq: opts.Seq, prev: opts.Prev}, nil
+}
+
+// Verify reads a log and stops at the first line that breaks the chain or has an invalid signature.
+func (v *Verifier) Verify(name string, r io.Reader) error {
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for number := 1; lines.Scan(); number++ {
+		line := lines.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := v.verify(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, number, err)
+		}
+	}
+	return lines.Err()
+}
+
+func (v *Verifier) verify(line []byte) error {
+	var l link
+	if err := json.Unmarshal(line, &l); err != nil {
+		return err
+	}
+	switch {
+	case l.Seq == 1 && len(l.Prev) == 0 && v.seq == 0:
+		v.report.Starts++
+	case l.Seq == 1 && len(l.Prev) == 0:
+		if !v.allowRestarts {
+			return fmt.Errorf("the chain starts anew after sequence %d", v.seq)
+		}
+		v.report.Starts++
+		// Records before the restart stay unsigned.
+		v.pending = 0
+	case v.seq == 0:
+		return fmt.Errorf("sequence %d does not start the chain, anchor it with the line before", l.Seq)
+	case l.Seq != v.seq+1:
+		return fmt.Errorf("sequence %d follows %d", l.Seq, v.seq)
+	case l.Prev != v.prev:
+		return errors.New("previous line hash does not match")
+	}
+	if l.Type == CheckpointType {
+		digest, err := checkpointDigest(l.Prev)
+		if err != nil {
+			return err
+		}
+		if err := signing.Verify(l.Signature, digest, v.keys); err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+		v.report.Checkpoints++
+		v.report.Unsigned -= v.pending
+		v.pending = 0
+	} else {
+		v.report.Records++
+		v.report.Unsigned++
+		v.pending++
+	}
+	v.seq, v.prev = l.Seq, hash(line)
+	v.report.Seq, v.report.Head = v.seq, v.prev
+	return nil
+}
+
+// Report sums up what was verified so far.
+func (v *Verifier) Report() Report {
+	return v.report
+}
@@ -0,0 +1,176 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/signing"
+)
+
+func chainedLog(t *testing.T, path string, key ed25519.PrivateKey, every uint64) *Log {
+	sink, err := Open("file", Options{File: path})
+	assert.NoError(t, err)
+	signer, err := signing.New(key, nil)
+	assert.NoError(t, err)
+	seq, prev, err := Resume(path)
+	assert.NoError(t, err)
+	return NewChained(sink, "X-Error", signer, ChainOptions{Seq: seq, Prev: prev, Every: every})
+}
+
+func verify(t *testing.T, key crypto.PublicKey, content []byte) (Report, error) {
+	return verifyWith(t, key, content, VerifyOptions{})
+}
+
+func verifyWith(t *testing.T, key crypto.PublicKey, content []byte, opts VerifyOptions) (Report, error) {
+	v, err := NewVerifier([]crypto.PublicKey{key}, opts)
+	assert.NoError(t, err)
+	err = v.Verify("audit.log", bytes.NewReader(content))
+	report := v.Report()
+	// Tests compare the counts.
+	report.Seq, report.Head = 0, ""
+	return report, err
+}
+
+func TestChain(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := chainedLog(t, path, key, 3)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, l.write(Record{Path: "/data", Status: 200 + i}))
+	}
+	assert.NoError(t, l.Close())
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	// 3 records, checkpoint, 3 records, checkpoint, a record and the checkpoint on close.
+	assert.Len(t, lines, 10)
+	assert.Contains(t, lines[3], `"type":"checkpoint"`)
+	report, err := verify(t, public, content)
+	assert.NoError(t, err)
+	assert.Equal(t, Report{Records: 7, Checkpoints: 3, Starts: 1}, report)
+
+	// The chain goes on after a restart.
+	l = chainedLog(t, path, key, 3)
+	assert.NoError(t, l.write(Record{Path: "/data", Status: 304}))
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	report, err = verify(t, public, content)
+	assert.NoError(t, err)
+	assert.Equal(t, Report{Records: 8, Checkpoints: 3, Unsigned: 1, Starts: 1}, report)
+	assert.NoError(t, l.Close())
+
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	tampered := bytes.Replace(content, []byte(`"status":203`), []byte(`"status":403`), 1)
+	_, err = verify(t, public, tampered)
+	assert.ErrorContains(t, err, "audit.log:6: previous line hash does not match")
+
+	lines = strings.Split(string(content), "\n")
+	removed := strings.Join(append(append([]string{}, lines[:1]...), lines[2:]...), "\n")
+	_, err = verify(t, public, []byte(removed))
+	assert.ErrorContains(t, err, "audit.log:2: sequence 3 follows 1")
+
+	other, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = verify(t, other, content)
+	assert.ErrorContains(t, err, "audit.log:4: checkpoint: unknown key")
+
+	// A checkpoint does not sign the line before it as a file.
+	var checkpoint Checkpoint
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &checkpoint))
+	head, err := hex.DecodeString(checkpoint.Prev)
+	assert.NoError(t, err)
+	kid, err := signing.KeyID(public)
+	assert.NoError(t, err)
+	keys := map[string]crypto.PublicKey{kid: public}
+	assert.Error(t, signing.Verify(checkpoint.Signature, head, keys))
+	digest, err := checkpointDigest(checkpoint.Prev)
+	assert.NoError(t, err)
+	assert.NoError(t, signing.Verify(checkpoint.Signature, digest, keys))
+}
+
+func TestVerifyStrict(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	l := chainedLog(t, filepath.Join(dir, "first.log"), key, 2)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.write(Record{Path: "/data", Status: 200}))
+	}
+	assert.NoError(t, l.Close())
+	first, err := os.ReadFile(filepath.Join(dir, "first.log"))
+	assert.NoError(t, err)
+	// A chain of a restarted stdout sink starts anew, its record is not signed.
+	l = chainedLog(t, filepath.Join(dir, "second.log"), key, 2)
+	assert.NoError(t, l.write(Record{Path: "/data", Status: 200}))
+	second, err := os.ReadFile(filepath.Join(dir, "second.log"))
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+
+	restarted := append(append([]byte{}, first...), second...)
+	_, err = verify(t, public, restarted)
+	assert.ErrorContains(t, err, "audit.log:6: the chain starts anew after sequence 5")
+	report, err := verifyWith(t, public, restarted, VerifyOptions{AllowRestarts: true})
+	assert.NoError(t, err)
+	assert.Equal(t, Report{Records: 4, Checkpoints: 2, Unsigned: 1, Starts: 2}, report)
+
+	// Lines of a deleted file are not taken on trust.
+	lines := strings.SplitAfter(string(first), "\n")
+	_, err = verify(t, public, []byte(strings.Join(lines[3:], "")))
+	assert.ErrorContains(t, err, "audit.log:1: sequence 4 does not start the chain")
+	v, err := NewVerifier([]crypto.PublicKey{public}, VerifyOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, v.Verify("audit.log", strings.NewReader(strings.Join(lines[:3], ""))))
+	anchor := v.Report()
+	assert.Equal(t, uint64(3), anchor.Seq)
+	report, err = verifyWith(t, public, []byte(strings.Join(lines[3:], "")), VerifyOptions{Seq: anchor.Seq, Prev: anchor.Head})
+	assert.NoError(t, err)
+	assert.Equal(t, Report{Records: 1, Checkpoints: 1}, report)
+	_, err = verifyWith(t, public, []byte(strings.Join(lines[4:], "")), VerifyOptions{Seq: anchor.Seq, Prev: anchor.Head})
+	assert.ErrorContains(t, err, "audit.log:1: sequence 5 follows 3")
+
+	_, err = NewVerifier([]crypto.PublicKey{public}, VerifyOptions{Seq: 3})
+	assert.Error(t, err)
+}
+
+func TestResumeRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	seq, prev, err := Resume(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), seq)
+	assert.Empty(t, prev)
+
+	last := `{"seq":42,"prev":"00"}`
+	assert.NoError(t, os.WriteFile(path+".20240601T000000.000000000", []byte("{\"seq\":41}\n"+last+"\n"), 0o600))
+	assert.NoError(t, os.WriteFile(path, nil, 0o600))
+	seq, prev, err = Resume(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), seq)
+	assert.Equal(t, hash([]byte(last)), prev)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"os"
+	"time"
+)
+
+// created tells when the file was created. The birth time is read on Linux only,
+// elsewhere the modification time stands in for it.
+func created(file *os.File, info os.FileInfo) time.Time {
+	return info.ModTime()
+}
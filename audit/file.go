@@ -0,0 +1,124 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+var rename = os.Rename
+
+// fileSink appends JSON lines to a file. The file is renamed with a timestamp suffix when it would grow
+// over maxSize or is older than maxAge, and only maxBackups of the renamed files are kept.
+// The age counts from the creation of the file where the platform tells it, see created.
+type fileSink struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func openFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size, s.opened = file, info.Size(), created(file, info)
+	if s.size == 0 {
+		s.opened = time.Now()
+	}
+	return nil
+}
+
+func (s *fileSink) Write(line []byte) error {
+	line = append(line, '\n')
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil && s.size > 0 && ((s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize) ||
+		(s.maxAge > 0 && time.Since(s.opened) > s.maxAge)) {
+		if err := s.rotate(); err != nil {
+			logging.Error(context.Background(), config.RSL00054, s.path, err.Error())
+		}
+	}
+	if s.file == nil {
+		// Neither rotated nor reopened the last time.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the file and opens a new one. If the file cannot be renamed, the original is reopened
+// and appended to, so that no records are lost.
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = rename(s.path, s.path+"."+time.Now().UTC().Format("20060102T150405.000000000"))
+	}
+	if err == nil && s.maxBackups > 0 {
+		backups, _ := filepath.Glob(s.path + ".*")
+		// Timestamps sort by time.
+		sort.Strings(backups)
+		for len(backups) > s.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	if openErr := s.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
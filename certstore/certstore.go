@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package certstore keeps the server key pair and the CRL, so that they can be replaced while serving,
+// e.g. once renewed files are reloaded on the admin API.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Store hands out the current server key pair and CRL.
+type Store struct {
+	mutex    sync.RWMutex
+	keyPair  *tls.Certificate
+	crl      *x509.RevocationList
+	loadedAt time.Time
+}
+
+func New(keyPair tls.Certificate, crl *x509.RevocationList) *Store {
+	s := &Store{}
+	s.Replace(keyPair, crl)
+	return s
+}
+
+// Replace swaps the key pair and the CRL. Connections already established keep the previous certificate.
+func (s *Store) Replace(keyPair tls.Certificate, crl *x509.RevocationList) {
+	if keyPair.Leaf == nil && len(keyPair.Certificate) > 0 {
+		keyPair.Leaf, _ = x509.ParseCertificate(keyPair.Certificate[0])
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keyPair, s.crl, s.loadedAt = &keyPair, crl, time.Now()
+}
+
+// GetCertificate is meant for tls.Config.
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keyPair, nil
+}
+
+// Certificate is the parsed server certificate.
+func (s *Store) Certificate() *x509.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keyPair.Leaf
+}
+
+// CRL is nil if the CRL mechanism is not used.
+func (s *Store) CRL() *x509.RevocationList {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.crl
+}
+
+// Certificate describes a certificate on the admin API.
+type Certificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// CRL describes a revocation list on the admin API.
+type CRL struct {
+	Issuer     string    `json:"issuer"`
+	Number     string    `json:"number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	Revoked    int       `json:"revoked"`
+}
+
+// Status describes what the store holds.
+type Status struct {
+	Server   *Certificate `json:"server_certificate,omitempty"`
+	CRL      *CRL         `json:"crl,omitempty"`
+	LoadedAt time.Time    `json:"loaded_at"`
+}
+
+func (s *Store) Status() Status {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := Status{LoadedAt: s.loadedAt.UTC()}
+	if cert := s.keyPair.Leaf; cert != nil {
+		status.Server = &Certificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    cert.SerialNumber.Text(16),
+			NotBefore: cert.NotBefore.UTC(),
+			NotAfter:  cert.NotAfter.UTC(),
+		}
+	}
+	if s.crl != nil {
+		status.CRL = &CRL{
+			Issuer:     s.crl.Issuer.String(),
+			ThisUpdate: s.crl.ThisUpdate.UTC(),
+			NextUpdate: s.crl.NextUpdate.UTC(),
+			Revoked:    len(s.crl.RevokedCertificateEntries),
+		}
+		if s.crl.Number != nil {
+			status.CRL.Number = s.crl.Number.String()
+		}
+	}
+	return status
+}
+
+// Revoked tells when the certificate with the serial number was revoked according to the CRL.
+// It is the zero time if the certificate is not listed or there is no CRL.
+func (s *Store) Revoked(serial *big.Int) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.crl == nil {
+		return time.Time{}
+	}
+	for _, entry := range s.crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(serial) == 0 {
+			return entry.RevocationTime.UTC()
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair("../certs/server/certs/server.cert.pem", "../certs/server/private/server.key.nopass.pem")
+	assert.NoError(t, err)
+	crlPEM, err := os.ReadFile("../certs/crl/certs/intermediate.crl.pem")
+	assert.NoError(t, err)
+	block, _ := pem.Decode(crlPEM)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	assert.NoError(t, err)
+
+	store := New(keyPair, nil)
+	served, err := store.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, keyPair.Certificate, served.Certificate)
+	assert.NotNil(t, store.Certificate())
+	assert.Nil(t, store.CRL())
+	status := store.Status()
+	assert.Equal(t, store.Certificate().NotAfter.UTC(), status.Server.NotAfter)
+	assert.Nil(t, status.CRL)
+	assert.True(t, store.Revoked(big.NewInt(0x109C)).IsZero())
+
+	loadedAt := status.LoadedAt
+	store.Replace(keyPair, crl)
+	assert.Same(t, crl, store.CRL())
+	status = store.Status()
+	assert.Equal(t, "4097", status.CRL.Number)
+	assert.Equal(t, 1, status.CRL.Revoked)
+	assert.False(t, status.LoadedAt.Before(loadedAt))
+	assert.False(t, store.Revoked(big.NewInt(0x109C)).IsZero())
+	assert.True(t, store.Revoked(big.NewInt(0x109D)).IsZero())
+}
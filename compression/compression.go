@@ -0,0 +1,196 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"whalebone.io/serve-file/filecache"
+)
+
+// Extensions of precompressed siblings, e.g. 404_resolver_cache.bin.zst
+var extensions = map[string]string{
+	"zstd": ".zst",
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// ParseEncodings validates a comma separated list of content codings in the order of server preference.
+func ParseEncodings(list string) ([]string, error) {
+	var encodings []string
+	for _, encoding := range strings.Split(list, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if len(encoding) == 0 {
+			continue
+		}
+		if _, ok := extensions[encoding]; !ok {
+			return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+		}
+		encodings = append(encodings, encoding)
+	}
+	return encodings, nil
+}
+
+// Extension of a precompressed sibling for the encoding.
+func Extension(encoding string) string {
+	return extensions[encoding]
+}
+
+// Negotiate picks the offered encoding with the highest quality in Accept-Encoding.
+// Ties are resolved by the order of offered encodings. Empty string stands for identity.
+// https://www.rfc-editor.org/rfc/rfc9110#section-12.5.3
+func Negotiate(acceptEncoding string, offered []string) string {
+	if len(acceptEncoding) == 0 {
+		return ""
+	}
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if qValue, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(qValue, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if coding == "*" {
+			wildcard = q
+		} else {
+			qualities[coding] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// VariantETag derives a distinct strong ETag for the encoded representation, e.g. "abc" -> "abc-gzip".
+func VariantETag(etag, encoding string) string {
+	if len(encoding) == 0 {
+		return etag
+	}
+	if trimmed, quoted := strings.CutSuffix(etag, "\""); quoted {
+		return trimmed + "-" + encoding + "\""
+	}
+	return etag + "-" + encoding
+}
+
+// BaseETag is the inverse of VariantETag.
+func BaseETag(etag string) string {
+	trimmed, quoted := strings.CutSuffix(etag, "\"")
+	for encoding := range extensions {
+		if base, found := strings.CutSuffix(trimmed, "-"+encoding); found {
+			if quoted {
+				return base + "\""
+			}
+			return base
+		}
+	}
+	return etag
+}
+
+// Cache keeps files compressed on the fly, keyed by file name, ETag and encoding.
+type Cache struct {
+	dir        string
+	maxEntries int
+	mutex      sync.Mutex
+}
+
+func NewCache(dir string, maxEntries int) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, maxEntries: maxEntries}, nil
+}
+
+// Get returns a path to the encoded file. The original is opened and compressed only on a cache miss.
+func (c *Cache) Get(name, etag, encoding string, open func() (io.ReadCloser, error)) (string, error) {
+	path := filepath.Join(c.dir, filecache.Sanitize(filepath.Base(name))+"_"+filecache.Sanitize(etag)+extensions[encoding])
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	original, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+	err = filecache.WriteAtomically(path, func(w io.Writer) error {
+		return Compress(w, original, encoding)
+	})
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return path, filecache.Prune(c.dir, c.maxEntries)
+}
+
+// Usage tells how many files the cache holds.
+func (c *Cache) Usage() (filecache.Usage, error) {
+	return filecache.DirUsage(c.dir)
+}
+
+// Purge removes all cached files, they are created again on demand.
+func (c *Cache) Purge() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return filecache.Purge(c.dir)
+}
+
+// Compress copies src to dst in the given encoding.
+func Compress(dst io.Writer, src io.Reader, encoding string) error {
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w, err = gzip.NewWriterLevel(dst, gzip.BestCompression)
+	case "br":
+		w = brotli.NewWriterLevel(dst, 9)
+	case "zstd":
+		w, err = zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	default:
+		err = fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
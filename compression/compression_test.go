@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{"zstd", "br", "gzip"}
+	assert.Equal(t, "", Negotiate("", offered))
+	assert.Equal(t, "", Negotiate("identity", offered))
+	assert.Equal(t, "gzip", Negotiate("gzip, deflate", offered))
+	assert.Equal(t, "zstd", Negotiate("gzip, br, zstd", offered))
+	assert.Equal(t, "br", Negotiate("gzip;q=0.5, br;q=0.8, zstd;q=0", offered))
+	assert.Equal(t, "zstd", Negotiate("*", offered))
+	assert.Equal(t, "br", Negotiate("*;q=0.1, zstd;q=0, br", offered))
+	assert.Equal(t, "", Negotiate("gzip", []string{"zstd"}))
+}
+
+func TestETags(t *testing.T) {
+	assert.Equal(t, "\"abc-gzip\"", VariantETag("\"abc\"", "gzip"))
+	assert.Equal(t, "abc-zstd", VariantETag("abc", "zstd"))
+	assert.Equal(t, "\"abc\"", VariantETag("\"abc\"", ""))
+	assert.Equal(t, "\"abc\"", BaseETag("\"abc-br\""))
+	assert.Equal(t, "abc", BaseETag("abc-zstd"))
+	assert.Equal(t, "\"abc-2\"", BaseETag("\"abc-2\""))
+}
+
+func TestCache(t *testing.T) {
+	_, err := ParseEncodings("gzip, deflate")
+	assert.Error(t, err)
+	cache, err := NewCache(t.TempDir(), 1)
+	assert.NoError(t, err)
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(strings.NewReader(strings.Repeat("resolver cache ", 1000))), nil
+	}
+	path, err := cache.Get("test-data/404_resolver_cache.bin", "\"abc\"", "gzip", open)
+	assert.NoError(t, err)
+	_, err = cache.Get("test-data/404_resolver_cache.bin", "\"abc\"", "gzip", open)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, opened, "cached file was compressed twice")
+
+	compressed, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	plain, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("resolver cache ", 1000), string(plain))
+
+	// Only one entry fits in the cache.
+	_, err = cache.Get("test-data/404_resolver_cache.bin", "\"abc\"", "zstd", open)
+	assert.NoError(t, err)
+	usage, err := cache.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usage.Entries)
+	assert.Positive(t, usage.Bytes)
+
+	assert.NoError(t, cache.Purge())
+	usage, err = cache.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, usage.Entries)
+}
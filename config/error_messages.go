@@ -16,6 +16,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 package config
 
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
 const (
 	MSG00001 string = "SRV_CA_CERT_PEM_BASE64 is not a valid base64."
 	MSG00002 string = "SRV_CA_CERT_PEM_FILE is not a valid file."
@@ -75,6 +81,109 @@ const (
 	MSG00055 string = "SRV_CLOUD_S3_DATA_FILE_TEMPLATE was not set, defaulting to %s."
 	MSG00056 string = "CLOUD_S3_CUSTOMER_ID set, system will use cloud S3 for this customer ID"
 
+	MSG00057 string = "%d is not a valid number of generations, check SRV_API_DELTA_GENERATIONS property."
+	MSG00058 string = "SRV_API_DELTA_DIR was not set, defaulting to %s."
+	MSG00059 string = "SRV_API_DELTA_MEDIA_TYPE was not set, defaulting to %s."
+	MSG00060 string = "SRV_API_DELTA_DIR %s cannot be used for keeping generations: %s"
+	MSG00061 string = "Check SRV_API_CONTENT_ENCODINGS property. Only zstd, br and gzip are supported."
+	MSG00062 string = "SRV_API_COMPRESSION_CACHE_DIR was not set, defaulting to %s."
+	MSG00063 string = "SRV_API_COMPRESSION_CACHE_MAX_ENTRIES was not set, defaulting to %d."
+	MSG00064 string = "SRV_API_CONTENT_ENCODINGS is not set, files will be sent uncompressed."
+	MSG00065 string = "SRV_API_COMPRESSION_CACHE_DIR %s cannot be used for keeping encoded files: %s"
+	MSG00066 string = "SRV_SIGNING_KEY_PEM_BASE64 is not a valid base64."
+	MSG00067 string = "SRV_SIGNING_KEY_PEM_FILE is not a valid file."
+	MSG00068 string = "SRV_SIGNING_KEY_PEM_ does not contain a valid Ed25519 or ECDSA private key."
+	MSG00069 string = "SRV_SIGNING_PUBLIC_KEYS_PEM_BASE64 is not a valid base64."
+	MSG00070 string = "SRV_SIGNING_PUBLIC_KEYS_PEM_FILE is not a valid file."
+	MSG00071 string = "SRV_SIGNING_PUBLIC_KEYS_PEM_ does not contain valid Ed25519 or ECDSA public keys."
+	MSG00072 string = "Neither SRV_SIGNING_KEY_PEM_ nor SRV_SIGNING_PUBLIC_KEYS_PEM_ are set. Files will not be signed."
+	MSG00073 string = "SRV_API_SIGNATURE_HEADER was not set, defaulting to %s."
+	MSG00074 string = "SRV_API_KEYS_URL was not set, defaulting to %s."
+	MSG00075 string = "SRV_API_SIGNATURE_FILE_TEMPLATE was not set, defaulting to %s."
+	MSG00076 string = "SRV_API_ENCRYPT_FILES set to True, files will be encrypted to client certificate keys."
+	MSG00077 string = "SRV_API_ENCRYPTION_CACHE_DIR was not set, defaulting to %s."
+	MSG00078 string = "SRV_API_ENCRYPTION_CACHE_MAX_ENTRIES was not set, defaulting to %d."
+	MSG00079 string = "SRV_API_ENCRYPTION_CACHE_DIR %s cannot be used for keeping encrypted files: %s"
+	MSG00080 string = "SRV_API_DIGEST_FILE_TEMPLATE was not set, defaulting to %s."
+	MSG00081 string = "SRV_API_DIGEST_CACHE_MAX_ENTRIES was not set, defaulting to %d."
+	MSG00082 string = "%s is not a valid resource name in SRV_API_RESOURCES. Use lowercase letters, digits and dashes."
+	MSG00083 string = "Resource %s is listed more than once in SRV_API_RESOURCES."
+	MSG00084 string = "%s was not set, defaulting to %s."
+	MSG00085 string = "SRV_API_MANIFEST_URL was not set, defaulting to %s."
+	MSG00086 string = "SRV_API_VERSIONS_URL was not set, defaulting to %s."
+	MSG00087 string = "SRV_API_VERSIONS_PATTERN is not a valid regular expression."
+	MSG00088 string = "%d is not a valid number of versions, check SRV_API_VERSIONS_MAX property."
+	MSG00089 string = "%s is not a valid fallback level in %s. Use customer, organization or default."
+	MSG00090 string = "SRV_API_RSP_LEVEL_HEADER was not set, defaulting to %s."
+	MSG00091 string = "SRV_PRODUCER_CA_CERT_PEM_BASE64 is not a valid base64 string."
+	MSG00092 string = "SRV_PRODUCER_CA_CERT_PEM_FILE is not a valid file path."
+	MSG00093 string = "Producer CA cert is not a valid PEM certificate."
+	MSG00094 string = "Neither SRV_API_PRODUCER_OU nor SRV_PRODUCER_CA_CERT_PEM_ are set. Publishing is disabled."
+	MSG00095 string = "SRV_API_PUBLISH_URL was not set, defaulting to %s."
+	MSG00096 string = "SRV_API_PUBLISH_MAX_BYTES was not set, defaulting to %d."
+	MSG00097 string = "SRV_API_CUSTOMER_REQ_HEADER was not set, defaulting to %s."
+	MSG00098 string = "%d is not a valid number of seconds, check SRV_API_WAIT_MAX_S property."
+	MSG00099 string = "SRV_API_WAIT_MAX_S %d must be less than SRV_WRITE_TIMEOUT_S %d, held responses would be cut off."
+	MSG00100 string = "SRV_API_WAIT_MAX_CONNECTIONS was not set, defaulting to %d."
+	MSG00101 string = "SRV_API_WAIT_S3_POLL_S was not set, defaulting to %d."
+	MSG00102 string = "SRV_API_FILE_DIR %s cannot be watched for changes: %s"
+	MSG00103 string = "%d is not a valid number of connections, check SRV_API_EVENTS_MAX_CONNECTIONS property."
+	MSG00104 string = "SRV_API_EVENTS_URL was not set, defaulting to %s."
+	MSG00105 string = "SRV_API_EVENTS_HEARTBEAT_S was not set, defaulting to %d."
+	MSG00106 string = "SRV_API_ROLLOUT_RELOAD_S was not set, defaulting to %d."
+	MSG00107 string = "SRV_API_ROLLOUT_FILE %s cannot be loaded: %s"
+	MSG00108 string = "SRV_API_ROLLOUT_FILE %s cannot be reloaded, keeping the previous policy: %s"
+	MSG00109 string = "Rollout policy reloaded from %s."
+	MSG00111 string = "SRV_API_PIN_GENERATIONS was not set, defaulting to %d."
+	MSG00112 string = "SRV_API_PIN_GENERATIONS_DIR was not set, defaulting to %s."
+	MSG00113 string = "SRV_API_PINS_FILE %s cannot be loaded: %s"
+	MSG00114 string = "SRV_API_PIN_GENERATIONS_DIR %s cannot be used for keeping generations: %s"
+	MSG00115 string = "SRV_ADMIN_BIND_PORT is not set, pins cannot be changed, they are managed on the admin API."
+	MSG00116 string = "SRV_API_WINDOW_FILE_TEMPLATE was not set, defaulting to %s."
+	MSG00117 string = "SRV_METRICS_BIND_HOST was not set, defaulting to %s."
+	MSG00118 string = "SRV_METRICS_URL was not set, defaulting to %s."
+	MSG00119 string = "SRV_METRICS_BIND_PORT %d must differ from SRV_BIND_PORT."
+	MSG00120 string = "Internal listener %s stopped: %s"
+	MSG00121 string = "SRV_LOG_FORMAT or SRV_LOG_LEVEL is not valid: %s"
+	MSG00122 string = "SRV_LOG_REQUEST_ID_HEADER was not set, defaulting to %s."
+	MSG00123 string = "SRV_AUDIT_LOG_SINK %s is not valid, use stdout, file or syslog."
+	MSG00124 string = "SRV_AUDIT_LOG_FILE must be set for the file audit sink."
+	MSG00125 string = "SRV_AUDIT_LOG_MAX_SIZE_MB was not set, defaulting to %d."
+	MSG00126 string = "SRV_AUDIT_LOG_MAX_AGE_H was not set, defaulting to %d."
+	MSG00127 string = "SRV_AUDIT_LOG_MAX_BACKUPS was not set, defaulting to %d."
+	MSG00128 string = "SRV_AUDIT_LOG_SYSLOG_TAG was not set, defaulting to %s."
+	MSG00129 string = "Cannot open the audit sink %s, Error: `%s'."
+	MSG00130 string = "SRV_AUDIT_LOG_CHAIN needs SRV_AUDIT_LOG_SINK and a SRV_SIGNING_KEY_ to sign checkpoints."
+	MSG00131 string = "SRV_AUDIT_LOG_CHECKPOINT_RECORDS was not set, defaulting to %d."
+	MSG00132 string = "SRV_AUDIT_LOG_CHECKPOINT_INTERVAL_S was not set, defaulting to %d."
+	MSG00133 string = "Cannot resume the audit chain of %s, Error: `%s'."
+	MSG00134 string = "SRV_TRACING_SAMPLE_RATIO was not set, defaulting to %g."
+	MSG00135 string = "SRV_TRACING_SAMPLE_RATIO %g must not exceed 1."
+	MSG00136 string = "SRV_TRACING_SERVICE_NAME was not set, defaulting to %s."
+	MSG00137 string = "Cannot export traces to %s, Error: `%s'."
+	MSG00138 string = "SRV_HEALTH_BIND_HOST was not set, defaulting to %s."
+	MSG00139 string = "SRV_HEALTH_LIVE_URL was not set, defaulting to %s."
+	MSG00140 string = "SRV_HEALTH_READY_URL was not set, defaulting to %s."
+	MSG00141 string = "SRV_HEALTH_STARTUP_URL was not set, defaulting to %s."
+	MSG00142 string = "SRV_HEALTH_CHECK_TIMEOUT_S was not set, defaulting to %d."
+	MSG00143 string = "SRV_HEALTH_BIND_PORT %d must differ from SRV_BIND_PORT."
+	MSG00144 string = "SRV_ADMIN_CA_CERT_PEM_BASE64 is not a valid base64 string."
+	MSG00145 string = "SRV_ADMIN_CA_CERT_PEM_FILE is not a valid file path."
+	MSG00146 string = "Admin CA cert is not a valid PEM certificate."
+	MSG00147 string = "SRV_ADMIN_BIND_HOST was not set, defaulting to %s."
+	MSG00148 string = "SRV_ADMIN_URL was not set, defaulting to %s."
+	MSG00149 string = "SRV_ADMIN_BIND_PORT %d must differ from SRV_BIND_PORT, SRV_METRICS_BIND_PORT and SRV_HEALTH_BIND_PORT."
+	MSG00150 string = "SRV_ADMIN_BIND_PORT needs SRV_API_ADMIN_OU or SRV_ADMIN_CA_CERT_PEM_ to tell admins."
+	MSG00151 string = "Admin listener %s stopped: %s"
+	MSG00152 string = "SRV_ENABLE_PROFILE needs SRV_ADMIN_BIND_PORT, profiling is served on the admin listener only."
+	MSG00153 string = "Cannot write last seen clients to %s, Error: `%s'."
+	MSG00154 string = "Cannot open SRV_LAST_SEEN_FILE %s, Error: `%s'."
+	MSG00155 string = "SRV_LAST_SEEN_FLUSH_S was not set, defaulting to %d."
+	MSG00156 string = "SRV_LAST_SEEN_STALE_H was not set, defaulting to %d."
+	MSG00157 string = "SRV_API_RSP_RETRY_AFTER_S was not set, defaulting to %d."
+	MSG00158 string = "SRV_HEALTH_CHECK_CACHE_S was not set, defaulting to %d."
+	MSG00159 string = "SRV_API_WINDOW_CACHE_MAX_ENTRIES was not set, defaulting to %d."
+
 	RSP00001 string = "Your certificate cannot be validated. Go away."
 	RSL00001 string = "TLS not used. It should have been rejected earlier. Server misconfig?"
 	RSP00002 string = "Your certificate is revoked in CRL. Go away."
@@ -103,4 +212,179 @@ const (
 	RSL00014 string = "Client sent away. Fatal MINIO S3 configuration Error: %s"
 	RSL00015 string = "Begin session %d: Client: CommonName %d, Organization: %s, download file: %s."
 	RSL00016 string = "End session %d: Client: CommonName %d, Organization: %s, download file: %s."
+	RSL00017 string = "Cannot keep generation %s of %s for client CommonName %d, Error: `%s'. Delta will not be available."
+	RSL00018 string = "Cannot compute patch from generation %s to %s of %s for client CommonName %d, Error: `%s'. Serving full file."
+	RSL00019 string = "Cannot encode %s with %s for client CommonName %d, Error: `%s'. Serving identity."
+	RSP00012 string = "Cannot provide datafile signature for you. Try again later."
+	RSL00020 string = "Cannot sign %s for client CommonName %d, Error: `%s'. Client sent away."
+	RSP00013 string = "Your certificate key cannot be used for encryption. Contact administrator."
+	RSL00021 string = "Cannot encrypt %s for client CommonName %d, Error: `%s'. Client sent away."
+	RSL00022 string = "Cannot provide Repr-Digest of %s for client CommonName %d, Error: `%s'. Serving without it."
+	RSL00023 string = "Cannot store digests of %s in %s, Error: `%s'. Digests are kept in memory only."
+	RSP00015 string = "There is no such resource. Check the URL."
+	RSL00024 string = "Client CommonName %d asked for unknown resource %s. Client sent away."
+	RSP00016 string = "You are not allowed to download this resource. Go away."
+	RSL00025 string = "Client CommonName %d, customer %s is not allowed to download resource %s. Client sent away."
+	RSL00026 string = "Cannot list files for manifest of client CommonName %d, Error: `%s'. Client sent away."
+	RSP00017 string = "You are not allowed to publish files. Go away."
+	RSL00027 string = "Client cert CommonName %s, Subject: %s is not a producer. Client sent away."
+	RSP00018 string = "Cannot publish the file. Check the client ID, resource and version."
+	RSL00028 string = "Producer %s sent an invalid publish request for %s. Producer sent away."
+	RSP00019 string = "The file is too large."
+	RSL00029 string = "Cannot publish %s for producer %s, Error: `%s'. Producer sent away."
+	RSL00030 string = "Producer %s published %s, ETag %s."
+	RSP00020 string = "Too many event streams are open. Try again later."
+	RSL00031 string = "Client CommonName %d cannot open an event stream, all %d streams are taken. Client sent away."
+	RSL00032 string = "Event stream of client CommonName %d closed, Error: `%s'."
+	RSP00021 string = "You are not allowed to administer the server. Go away."
+	RSL00033 string = "Client cert CommonName %s, Subject: %s is not an admin. Client sent away."
+	RSP00022 string = "Invalid pin. Set resolvers, customers or all and the resource must exist."
+	RSL00034 string = "Admin %s sent an invalid pin, Error: `%s'. Admin sent away."
+	RSL00035 string = "Admin %s added pin %s."
+	RSL00036 string = "Admin %s removed pin %s."
+	RSP00023 string = "There is no such pin."
+	RSL00037 string = "Cannot store pins for admin %s, Error: `%s'."
+	RSP00024 string = "Pinned generation is not available. Try again later."
+	RSL00038 string = "Pinned generation %s of %s is not kept for client CommonName %d. Client sent away."
+	RSL00039 string = "Cannot keep generation %s of %s for pinning, Error: `%s'."
+	RSL00040 string = "%s has an invalid publication window, Error: `%s'. It is treated as missing."
+	RSL00041 string = "Cannot write the audit record of %s, Error: `%s'."
+	RSL00042 string = "Cannot write an audit checkpoint, Error: `%s'."
+	RSL00043 string = "Admin %s reloaded certificates, server certificate %s is valid until %s."
+	RSL00044 string = "Admin %s cannot reload certificates, Error: `%s'. Previous certificates are kept."
+	RSP00025 string = "Certificates cannot be reloaded, previous ones are kept. Check the server log."
+	RSL00045 string = "Admin %s flushed the %s cache."
+	RSL00046 string = "Admin %s cannot flush the %s cache, Error: `%s'."
+	RSP00026 string = "There is no such cache."
+	RSL00047 string = "Admin %s cannot look up client %s, Error: `%s'."
+	RSP00027 string = "Invalid serial number. Send it in hex."
+	RSP00028 string = "Invalid client lookup. Send the client CommonName and the customer query parameter."
+	RSP00029 string = "Profiling is switched off. Switch it on first."
+	RSL00048 string = "Admin %s switched profiling %s."
+	RSP00030 string = "Invalid hours. Send a positive number."
+	RSL00049 string = "Admin %s cannot tell outdated clients, Error: `%s'."
+	RSL00050 string = "Client cert CommonName %s, Subject: %s is issued by the producer CA, it may only publish. Client sent away."
+	RSL00051 string = "Client %d was held for a change, its write deadline cannot be extended for the transfer, Error: `%s'."
+	RSL00052 string = "OCSP request for client cert CommonName %s cannot be created, Error: `%s'."
+	RSL00053 string = "OCSP %s cannot tell the status of client cert CommonName %s, Error: `%s'."
+	RSL00054 string = "Audit file %s cannot be rotated, records are appended to it as it is, Error: `%s'."
+	RSL00055 string = "File watcher failed, changes may have been missed, waiting requests check their files again, Error: `%s'."
+	RSL00056 string = "Polling %s for changes failed, Error: `%s'."
 )
+
+// codes lists all messages, so that logs and metrics can carry the code of a message as a field.
+// Codes with the same message share the first code.
+var codes = []struct{ code, message string }{
+	{"MSG00001", MSG00001}, {"MSG00002", MSG00002}, {"MSG00003", MSG00003}, {"MSG00004", MSG00004},
+	{"MSG00005", MSG00005}, {"MSG00006", MSG00006}, {"MSG00007", MSG00007}, {"MSG00008", MSG00008},
+	{"MSG00009", MSG00009}, {"MSG00010", MSG00010}, {"MSG00011", MSG00011}, {"MSG00012", MSG00012},
+	{"MSG00013", MSG00013}, {"MSG00014", MSG00014}, {"MSG00015", MSG00015}, {"MSG00016", MSG00016},
+	{"MSG00017", MSG00017}, {"MSG00018", MSG00018}, {"MSG00019", MSG00019}, {"MSG00020", MSG00020},
+	{"MSG00021", MSG00021}, {"MSG00022", MSG00022}, {"MSG00023", MSG00023}, {"MSG00024", MSG00024},
+	{"MSG00025", MSG00025}, {"MSG00026", MSG00026}, {"MSG00027", MSG00027}, {"MSG00028", MSG00028},
+	{"MSG00029", MSG00029}, {"MSG00030", MSG00030}, {"MSG00031", MSG00031}, {"MSG00032", MSG00032},
+	{"MSG00033", MSG00033}, {"MSG00034", MSG00034}, {"MSG00035", MSG00035}, {"MSG00036", MSG00036},
+	{"MSG00037", MSG00037}, {"MSG00038", MSG00038}, {"MSG00039", MSG00039}, {"MSG00040", MSG00040},
+	{"MSG00041", MSG00041}, {"MSG00042", MSG00042}, {"MSG00043", MSG00043}, {"MSG00044", MSG00044},
+	{"MSG00045", MSG00045}, {"MSG00046", MSG00046}, {"MSG00047", MSG00047}, {"MSG00048", MSG00048},
+	{"MSG00049", MSG00049}, {"MSG00050", MSG00050}, {"MSG00051", MSG00051}, {"MSG00052", MSG00052},
+	{"MSG00053", MSG00053}, {"MSG00054", MSG00054}, {"MSG00055", MSG00055}, {"MSG00056", MSG00056},
+	{"MSG00057", MSG00057}, {"MSG00058", MSG00058}, {"MSG00059", MSG00059}, {"MSG00060", MSG00060},
+	{"MSG00061", MSG00061}, {"MSG00062", MSG00062}, {"MSG00063", MSG00063}, {"MSG00064", MSG00064},
+	{"MSG00065", MSG00065}, {"MSG00066", MSG00066}, {"MSG00067", MSG00067}, {"MSG00068", MSG00068},
+	{"MSG00069", MSG00069}, {"MSG00070", MSG00070}, {"MSG00071", MSG00071}, {"MSG00072", MSG00072},
+	{"MSG00073", MSG00073}, {"MSG00074", MSG00074}, {"MSG00075", MSG00075}, {"MSG00076", MSG00076},
+	{"MSG00077", MSG00077}, {"MSG00078", MSG00078}, {"MSG00079", MSG00079}, {"MSG00080", MSG00080},
+	{"MSG00081", MSG00081}, {"MSG00082", MSG00082}, {"MSG00083", MSG00083}, {"MSG00084", MSG00084},
+	{"MSG00085", MSG00085}, {"MSG00086", MSG00086}, {"MSG00087", MSG00087}, {"MSG00088", MSG00088},
+	{"MSG00089", MSG00089}, {"MSG00090", MSG00090}, {"MSG00091", MSG00091}, {"MSG00092", MSG00092},
+	{"MSG00093", MSG00093}, {"MSG00094", MSG00094}, {"MSG00095", MSG00095}, {"MSG00096", MSG00096},
+	{"MSG00097", MSG00097}, {"MSG00098", MSG00098}, {"MSG00099", MSG00099}, {"MSG00100", MSG00100},
+	{"MSG00101", MSG00101}, {"MSG00102", MSG00102}, {"MSG00103", MSG00103}, {"MSG00104", MSG00104},
+	{"MSG00105", MSG00105}, {"MSG00106", MSG00106}, {"MSG00107", MSG00107}, {"MSG00108", MSG00108},
+	{"MSG00109", MSG00109}, {"MSG00111", MSG00111}, {"MSG00112", MSG00112},
+	{"MSG00113", MSG00113}, {"MSG00114", MSG00114}, {"MSG00115", MSG00115}, {"MSG00116", MSG00116},
+	{"MSG00117", MSG00117}, {"MSG00118", MSG00118}, {"MSG00119", MSG00119}, {"MSG00120", MSG00120},
+	{"MSG00121", MSG00121}, {"MSG00122", MSG00122}, {"MSG00123", MSG00123}, {"MSG00124", MSG00124},
+	{"MSG00125", MSG00125}, {"MSG00126", MSG00126}, {"MSG00127", MSG00127}, {"MSG00128", MSG00128},
+	{"MSG00129", MSG00129}, {"MSG00130", MSG00130}, {"MSG00131", MSG00131}, {"MSG00132", MSG00132},
+	{"MSG00133", MSG00133}, {"MSG00134", MSG00134}, {"MSG00135", MSG00135}, {"MSG00136", MSG00136},
+	{"MSG00137", MSG00137}, {"MSG00138", MSG00138}, {"MSG00139", MSG00139}, {"MSG00140", MSG00140},
+	{"MSG00141", MSG00141}, {"MSG00142", MSG00142}, {"MSG00143", MSG00143}, {"MSG00144", MSG00144},
+	{"MSG00145", MSG00145}, {"MSG00146", MSG00146}, {"MSG00147", MSG00147}, {"MSG00148", MSG00148},
+	{"MSG00149", MSG00149}, {"MSG00150", MSG00150}, {"MSG00151", MSG00151}, {"MSG00152", MSG00152},
+	{"MSG00153", MSG00153}, {"MSG00154", MSG00154}, {"MSG00155", MSG00155}, {"MSG00156", MSG00156},
+	{"RSP00001", RSP00001}, {"RSL00001", RSL00001}, {"RSP00002", RSP00002}, {"RSL00002", RSL00002},
+	{"RSP00003", RSP00003}, {"RSL00003", RSL00003}, {"RSP00004", RSP00004}, {"RSL00004", RSL00004},
+	{"RSP00005", RSP00005}, {"RSL00005", RSL00005}, {"RSP00006", RSP00006}, {"RSL00006", RSL00006},
+	{"RSP00007", RSP00007}, {"RSL00007", RSL00007}, {"RSP00008", RSP00008}, {"RSL00008", RSL00008},
+	{"RSP00009", RSP00009}, {"RSL00009", RSL00009}, {"RSP00010", RSP00010}, {"RSL00010", RSL00010},
+	{"RSP00011", RSP00011}, {"RSL00011", RSL00011}, {"RSL00012", RSL00012}, {"RSL00013", RSL00013},
+	{"RSP00014", RSP00014}, {"RSL00014", RSL00014}, {"RSL00015", RSL00015}, {"RSL00016", RSL00016},
+	{"RSL00017", RSL00017}, {"RSL00018", RSL00018}, {"RSL00019", RSL00019}, {"RSP00012", RSP00012},
+	{"RSL00020", RSL00020}, {"RSP00013", RSP00013}, {"RSL00021", RSL00021}, {"RSL00022", RSL00022},
+	{"RSL00023", RSL00023}, {"RSP00015", RSP00015}, {"RSL00024", RSL00024}, {"RSP00016", RSP00016},
+	{"RSL00025", RSL00025}, {"RSL00026", RSL00026}, {"RSP00017", RSP00017}, {"RSL00027", RSL00027},
+	{"RSP00018", RSP00018}, {"RSL00028", RSL00028}, {"RSP00019", RSP00019}, {"RSL00029", RSL00029},
+	{"RSL00030", RSL00030}, {"RSP00020", RSP00020}, {"RSL00031", RSL00031}, {"RSL00032", RSL00032},
+	{"RSP00021", RSP00021}, {"RSL00033", RSL00033}, {"RSP00022", RSP00022}, {"RSL00034", RSL00034},
+	{"RSL00035", RSL00035}, {"RSL00036", RSL00036}, {"RSP00023", RSP00023}, {"RSL00037", RSL00037},
+	{"RSP00024", RSP00024}, {"RSL00038", RSL00038}, {"RSL00039", RSL00039}, {"RSL00040", RSL00040},
+	{"RSL00041", RSL00041}, {"RSL00042", RSL00042}, {"RSL00043", RSL00043}, {"RSL00044", RSL00044},
+	{"RSP00025", RSP00025}, {"RSL00045", RSL00045}, {"RSL00046", RSL00046}, {"RSP00026", RSP00026},
+	{"RSL00047", RSL00047}, {"RSP00027", RSP00027}, {"RSP00028", RSP00028}, {"RSP00029", RSP00029},
+	{"RSL00048", RSL00048}, {"RSP00030", RSP00030}, {"RSL00049", RSL00049}, {"MSG00157", MSG00157},
+	{"RSL00050", RSL00050}, {"RSL00051", RSL00051}, {"RSL00052", RSL00052}, {"RSL00053", RSL00053},
+	{"RSL00054", RSL00054}, {"MSG00158", MSG00158}, {"RSL00055", RSL00055}, {"RSL00056", RSL00056},
+	{"MSG00159", MSG00159},
+}
+
+var (
+	codeOf = map[string]string{}
+	// Patterns of formatted messages, the most specific first.
+	patterns []struct {
+		code    string
+		pattern *regexp.Regexp
+	}
+)
+
+func init() {
+	verbs := strings.NewReplacer("%s", ".*", "%d", ".*")
+	for _, c := range codes {
+		if _, exists := codeOf[c.message]; !exists {
+			codeOf[c.message] = c.code
+		}
+		patterns = append(patterns, struct {
+			code    string
+			pattern *regexp.Regexp
+		}{c.code, regexp.MustCompile("^" + verbs.Replace(regexp.QuoteMeta(c.message)) + "$")})
+	}
+	literal := func(i int) int {
+		return len(strings.ReplaceAll(patterns[i].pattern.String(), ".*", ""))
+	}
+	sort.SliceStable(patterns, func(i, j int) bool { return literal(i) > literal(j) })
+}
+
+// Code tells the code of a message or of a message formatted with arguments, empty if it is not one of ours.
+func Code(message string) string {
+	if code, exists := codeOf[message]; exists {
+		return code
+	}
+	for _, p := range patterns {
+		if p.pattern.MatchString(message) {
+			return p.code
+		}
+	}
+	return ""
+}
+
+// ResponseCode tells the RSP code of an error header value, empty if there is none and "unknown" if it is not an RSP message.
+func ResponseCode(message string) string {
+	if len(message) == 0 {
+		return ""
+	}
+	if code := Code(message); strings.HasPrefix(code, "RSP") {
+		return code
+	}
+	return "unknown"
+}
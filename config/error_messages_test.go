@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package config
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCode(t *testing.T) {
+	assert.Equal(t, "", ResponseCode(""))
+	assert.Equal(t, "RSP00015", ResponseCode(RSP00015))
+	assert.Equal(t, "RSP00007", ResponseCode(fmt.Sprintf(RSP00007, 666, 777, "x-resolver-id")))
+	assert.Equal(t, "RSP00005", ResponseCode(fmt.Sprintf(RSP00005, "x-resolver-id")))
+	assert.Equal(t, "unknown", ResponseCode("Something else."))
+}
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, "MSG00148", Code(MSG00148))
+	assert.Equal(t, "MSG00148", Code(fmt.Sprintf(MSG00148, "/admin/")))
+	assert.Equal(t, "MSG00084", Code(fmt.Sprintf(MSG00084, "SRV_API_GEOIP_DATA_FILE_TEMPLATE", "%s/%s_geoip%s.bin")))
+	assert.Equal(t, "RSL00030", Code(fmt.Sprintf(RSL00030, "producer", "/data/666_resolver_cache.bin", "\"abc\"")))
+	assert.Equal(t, "", Code("Stopped."))
+}
+
+// TestCodesComplete makes sure new messages are added to codes.
+func TestCodesComplete(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "error_messages.go", nil, 0)
+	assert.NoError(t, err)
+	listed := map[string]bool{}
+	for _, c := range codes {
+		listed[c.code] = true
+	}
+	for _, decl := range file.Decls {
+		if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.CONST {
+			for _, spec := range decl.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					assert.True(t, listed[name.Name], "%s is missing in codes", name.Name)
+				}
+			}
+		}
+	}
+}
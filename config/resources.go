@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Resource is a file kept per client ID and served on API_URL/{name}. The resolver cache
+// is the default resource with an empty name, served on API_URL itself.
+// Named resources are configured with SRV_API_RESOURCE_<NAME>_ properties, e.g.
+// SRV_API_RESOURCE_GEOIP_DATA_FILE_TEMPLATE for the resource geoip.
+//
+//nolint:revive,stylecheck
+type Resource struct {
+	Name string `ignored:"true"`
+
+	// Local filesystem: API_FILE_DIR, client ID and version, e.g. %s/%s_geoip%s.mmdb
+	DATA_FILE_TEMPLATE string
+	// Local filesystem: API_FILE_DIR and client ID, e.g. %s/%s_geoip.mmdb.md5
+	HASH_FILE_TEMPLATE string
+	// S3: client ID and version, e.g. %s_geoip%s.mmdb
+	S3_DATA_FILE_TEMPLATE string
+
+	// If empty, Content-Type is derived from the file name.
+	CONTENT_TYPE  string
+	CACHE_CONTROL string
+
+	// Customer IDs (client certificate Locality) allowed to download the resource.
+	// If empty, all clients are allowed.
+	ALLOWED_CUSTOMERS []string
+
+	// Levels tried in order if there is no file for the resolver, see Levels.
+	FALLBACK []string
+}
+
+// Fallback levels. The data and hash file templates are formatted with the level key instead
+// of the client ID: resolver CommonName, customer Locality, Organization or "default".
+const (
+	LevelResolver     = "resolver"
+	LevelCustomer     = "customer"
+	LevelOrganization = "organization"
+	LevelDefault      = "default"
+)
+
+type Level struct {
+	Name string
+	Key  string
+}
+
+// Levels lists the resolver's own file followed by the fallback levels applicable to the certificate.
+func (r *Resource) Levels(cert *x509.Certificate) []Level {
+	levels := []Level{{Name: LevelResolver, Key: cert.Subject.CommonName}}
+	for _, name := range r.FALLBACK {
+		switch name {
+		case LevelCustomer:
+			if len(cert.Subject.Locality) > 0 {
+				levels = append(levels, Level{Name: name, Key: cert.Subject.Locality[0]})
+			}
+		case LevelOrganization:
+			if len(cert.Subject.Organization) > 0 {
+				levels = append(levels, Level{Name: name, Key: cert.Subject.Organization[0]})
+			}
+		case LevelDefault:
+			levels = append(levels, Level{Name: name, Key: LevelDefault})
+		}
+	}
+	return levels
+}
+
+func parseFallback(property string, fallback []string) []string {
+	levels := make([]string, 0, len(fallback))
+	for _, level := range fallback {
+		level = strings.ToLower(strings.TrimSpace(level))
+		if level != LevelCustomer && level != LevelOrganization && level != LevelDefault {
+			log.Fatal(fmt.Sprintf(MSG00089, level, property))
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+var resourceName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Allows tells whether the client with the certificate may download the resource.
+func (r *Resource) Allows(cert *x509.Certificate) bool {
+	if len(r.ALLOWED_CUSTOMERS) == 0 {
+		return true
+	}
+	for _, customer := range r.ALLOWED_CUSTOMERS {
+		for _, locality := range cert.Subject.Locality {
+			if strings.TrimSpace(customer) == locality {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadResources(settings *Settings) {
+	settings.Resources = map[string]*Resource{
+		"": {
+			DATA_FILE_TEMPLATE:    settings.API_DATA_FILE_TEMPLATE,
+			HASH_FILE_TEMPLATE:    settings.API_HASH_FILE_TEMPLATE,
+			S3_DATA_FILE_TEMPLATE: settings.S3_DATA_FILE_TEMPLATE,
+			FALLBACK:              parseFallback("SRV_API_FALLBACK", settings.API_FALLBACK),
+		},
+	}
+	for _, name := range settings.API_RESOURCES {
+		name = strings.TrimSpace(name)
+		if !resourceName.MatchString(name) {
+			log.Fatal(fmt.Sprintf(MSG00082, name))
+		}
+		if _, exists := settings.Resources[name]; exists {
+			log.Fatal(fmt.Sprintf(MSG00083, name))
+		}
+		resource := &Resource{Name: name}
+		prefix := "SRV_API_RESOURCE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if err := envconfig.Process(prefix, resource); err != nil {
+			log.Fatal(err.Error())
+		}
+		resource.FALLBACK = parseFallback(prefix+"_FALLBACK", resource.FALLBACK)
+		if settings.API_USE_S3 {
+			if len(resource.S3_DATA_FILE_TEMPLATE) == 0 {
+				resource.S3_DATA_FILE_TEMPLATE = "%s_" + name + "%s.bin"
+				log.Printf(MSG00084, prefix+"_S3_DATA_FILE_TEMPLATE", resource.S3_DATA_FILE_TEMPLATE)
+			}
+		} else {
+			if len(resource.DATA_FILE_TEMPLATE) == 0 {
+				resource.DATA_FILE_TEMPLATE = "%s/%s_" + name + "%s.bin"
+				log.Printf(MSG00084, prefix+"_DATA_FILE_TEMPLATE", resource.DATA_FILE_TEMPLATE)
+			}
+			if len(resource.HASH_FILE_TEMPLATE) == 0 {
+				resource.HASH_FILE_TEMPLATE = "%s/%s_" + name + ".bin.md5"
+				log.Printf(MSG00084, prefix+"_HASH_FILE_TEMPLATE", resource.HASH_FILE_TEMPLATE)
+			}
+		}
+		settings.Resources[name] = resource
+	}
+}
+
+// GenerationKey distinguishes kept generations of resources with the same client ID and version.
+// The resolver cache keeps its keys from before named resources were introduced.
+func (r *Resource) GenerationKey(clientIDAndVersion string) string {
+	if len(r.Name) == 0 {
+		return clientIDAndVersion
+	}
+	return r.Name + "_" + clientIDAndVersion
+}
@@ -0,0 +1,47 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package config
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceAllows(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "666", Locality: []string{"999"}}}
+	assert.True(t, (&Resource{}).Allows(cert))
+	assert.True(t, (&Resource{ALLOWED_CUSTOMERS: []string{"1000", " 999"}}).Allows(cert))
+	assert.False(t, (&Resource{ALLOWED_CUSTOMERS: []string{"1000"}}).Allows(cert))
+}
+
+func TestResourceGenerationKey(t *testing.T) {
+	assert.Equal(t, "666_v3", (&Resource{}).GenerationKey("666_v3"))
+	assert.Equal(t, "geoip_666_v3", (&Resource{Name: "geoip"}).GenerationKey("666_v3"))
+}
+
+func TestResourceLevels(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "666", Locality: []string{"999"}}}
+	res := &Resource{FALLBACK: []string{LevelCustomer, LevelOrganization, LevelDefault}}
+	assert.Equal(t, []Level{
+		{Name: LevelResolver, Key: "666"},
+		{Name: LevelCustomer, Key: "999"},
+		{Name: LevelDefault, Key: "default"},
+	}, res.Levels(cert))
+}
@@ -17,17 +17,24 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
+	"whalebone.io/serve-file/compression"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/signing"
 )
 
 //nolint:revive,stylecheck
@@ -35,6 +42,32 @@ type Settings struct {
 	// Network
 	BIND_HOST string
 	BIND_PORT uint16
+	// Prometheus metrics are served over plain HTTP on a separate listener, disabled if METRICS_BIND_PORT is 0.
+	// Requests are counted per client CommonName only if METRICS_PER_RESOLVER is true, mind the cardinality.
+	METRICS_BIND_HOST    string
+	METRICS_BIND_PORT    uint16
+	METRICS_URL          string
+	METRICS_PER_RESOLVER bool
+	// Liveness, startup and readiness probes are served over plain HTTP on a separate listener, disabled if
+	// HEALTH_BIND_PORT is 0. It may be the metrics listener. Readiness checks get HEALTH_CHECK_TIMEOUT_S.
+	// Results of S3 and OCSP checks are reused for HEALTH_CHECK_CACHE_S, so that probes do not pile up on them.
+	HEALTH_BIND_HOST       string
+	HEALTH_BIND_PORT       uint16
+	HEALTH_LIVE_URL        string
+	HEALTH_READY_URL       string
+	HEALTH_STARTUP_URL     string
+	HEALTH_CHECK_TIMEOUT_S uint16
+	HEALTH_CHECK_CACHE_S   uint16
+	// The admin API is served over TLS on a separate listener at ADMIN_URL, disabled if ADMIN_BIND_PORT is 0.
+	// Admins are clients with API_ADMIN_OU in their certificate OrganizationalUnit or issued by the ADMIN_CA_.
+	ADMIN_BIND_HOST string
+	ADMIN_BIND_PORT uint16
+	ADMIN_URL       string
+	// Last seen state of every client is kept in LAST_SEEN_FILE, written every LAST_SEEN_FLUSH_S seconds.
+	// The admin API reports clients not seen for LAST_SEEN_STALE_H hours. Disabled if LAST_SEEN_FILE is not set.
+	LAST_SEEN_FILE    string
+	LAST_SEEN_FLUSH_S int
+	LAST_SEEN_STALE_H int
 
 	// Certificates - if both _BASE64 and _FILE are set, _BASE64 takes precedence.
 	CA_CERT_PEM_BASE64     string
@@ -43,6 +76,12 @@ type Settings struct {
 	SERVER_CERT_PEM_FILE   string
 	SERVER_KEY_PEM_BASE64  string
 	SERVER_KEY_PEM_FILE    string
+	// Producers may also have certificates issued by a separate CA.
+	PRODUCER_CA_CERT_PEM_BASE64 string
+	PRODUCER_CA_CERT_PEM_FILE   string
+	// Admin CA is trusted on the admin listener only, see ADMIN_BIND_PORT.
+	ADMIN_CA_CERT_PEM_BASE64 string
+	ADMIN_CA_CERT_PEM_FILE   string
 
 	// CRL / OCSP mechanism
 	// If no revocation mechanism is set, this validation step is omitted.
@@ -56,6 +95,17 @@ type Settings struct {
 	CRL_PEM_FILE   string
 	OCSP_URL       string
 
+	// Detached signatures
+	// Files are signed with the SIGNING_KEY_ (PKCS #8 Ed25519 or ECDSA) unless a publisher
+	// provided a signature in the API_SIGNATURE_FILE_TEMPLATE sidecar or in S3 user metadata.
+	// SIGNING_PUBLIC_KEYS_ may contain more PEM public keys to be announced on API_KEYS_URL,
+	// e.g. the previous signing key during rotation or keys of publishers.
+	// If neither is set, no signatures are sent.
+	SIGNING_KEY_PEM_BASE64         string
+	SIGNING_KEY_PEM_FILE           string
+	SIGNING_PUBLIC_KEYS_PEM_BASE64 string
+	SIGNING_PUBLIC_KEYS_PEM_FILE   string
+
 	// Web server
 	READ_TIMEOUT_S        uint16
 	READ_HEADER_TIMEOUT_S uint16
@@ -63,19 +113,154 @@ type Settings struct {
 	IDLE_TIMEOUT_S        uint16
 	MAX_HEADER_BYTES      int
 
-	NUM_OF_CPUS         int
+	NUM_OF_CPUS int
+	// Profiling is served on the admin listener only and may be switched there, ENABLE_PROFILE is its state on start.
 	ENABLE_PROFILE      bool
 	AUDIT_LOG_DOWNLOADS bool
 
+	// Audit records of all requests, served or denied, go to AUDIT_LOG_SINK, stdout, file or syslog, as JSON.
+	// The file sink rotates AUDIT_LOG_FILE once it has AUDIT_LOG_MAX_SIZE_MB or is AUDIT_LOG_MAX_AGE_H old.
+	// Disabled if AUDIT_LOG_SINK is not set.
+	AUDIT_LOG_SINK        string
+	AUDIT_LOG_FILE        string
+	AUDIT_LOG_MAX_SIZE_MB int
+	AUDIT_LOG_MAX_AGE_H   int
+	AUDIT_LOG_MAX_BACKUPS int
+	AUDIT_LOG_SYSLOG_TAG  string
+	// AUDIT_LOG_CHAIN makes the audit log tamper-evident: records are hash-chained and a checkpoint signed
+	// with the SIGNING_KEY_ is written after AUDIT_LOG_CHECKPOINT_RECORDS records or AUDIT_LOG_CHECKPOINT_INTERVAL_S.
+	AUDIT_LOG_CHAIN                 bool
+	AUDIT_LOG_CHECKPOINT_RECORDS    uint64
+	AUDIT_LOG_CHECKPOINT_INTERVAL_S int
+
+	// Spans are exported to the OpenTelemetry collector at TRACING_OTLP_ENDPOINT, host:port of OTLP/HTTP,
+	// disabled if not set. TRACING_SAMPLE_RATIO of new traces are sampled, traces of clients keep their decision.
+	TRACING_OTLP_ENDPOINT string
+	TRACING_OTLP_INSECURE bool
+	TRACING_SAMPLE_RATIO  float64
+	TRACING_SERVICE_NAME  string
+
+	// Logging, LOG_FORMAT is text or json, LOG_LEVEL is debug, info, warn or error.
+	// Records carry the message code, e.g. RSL00010, in the code field. Records of requests carry
+	// the request ID from LOG_REQUEST_ID_HEADER, or a generated one, the client ID and the customer.
+	// An access record of every request is logged at debug level.
+	LOG_FORMAT            string
+	LOG_LEVEL             string
+	LOG_REQUEST_ID_HEADER string
+
 	API_URL                     string
 	API_ID_REQ_HEADER           string
 	API_VERSION_REQ_HEADER      string
 	API_RSP_TRY_LATER_HTTP_CODE int
 	API_RSP_ERROR_HEADER        string
+	// Clients that accept application/problem+json get errors as RFC 9457 problem details too.
+	// Retryable errors without a Retry-After of their own suggest API_RSP_RETRY_AFTER_S.
+	API_RSP_RETRY_AFTER_S int
+	API_SIGNATURE_HEADER  string
+	API_KEYS_URL          string
+	// Lists files available to the client with their sizes, ETags, digests and signatures.
+	API_MANIFEST_URL string
+	// Lists versions of a resource available to the client, API_VERSIONS_URL/{resource}.
+	// Only versions matching API_VERSIONS_PATTERN are listed, at most API_VERSIONS_MAX newest
+	// of them if set. The policy applies to the manifest too, downloads are not restricted.
+	API_VERSIONS_URL     string
+	API_VERSIONS_PATTERN string
+	API_VERSIONS_MAX     int
+
+	// Levels tried in order if there is no file for the resolver: customer, organization and default.
+	// The level served is sent in API_RSP_LEVEL_HEADER.
+	API_FALLBACK         []string
+	API_RSP_LEVEL_HEADER string
+
+	// Named resources served on API_URL/{name} next to the resolver cache, e.g. blocklist,config,geoip.
+	// See Resource for their SRV_API_RESOURCE_<NAME>_ properties.
+	API_RESOURCES []string
+
+	// Producers upload files with PUT or POST to API_PUBLISH_URL/{client ID}[/{resource}], the version
+	// is taken from API_VERSION_REQ_HEADER. A producer is a client with API_PRODUCER_OU in its certificate
+	// OrganizationalUnit or with a certificate issued by the PRODUCER_CA_. If neither is set, publishing is disabled.
+	// The producer CA is not one of the CA_CERT_ ones, its certificates may reach API_PUBLISH_URL only.
+	// Files for the cloud S3 customer are published with its ID in API_CUSTOMER_REQ_HEADER.
+	API_PUBLISH_URL         string
+	API_PRODUCER_OU         string
+	API_PUBLISH_MAX_BYTES   int64
+	API_CUSTOMER_REQ_HEADER string
 
 	API_FILE_DIR           string
 	API_DATA_FILE_TEMPLATE string
 	API_HASH_FILE_TEMPLATE string
+	// Applied to the data file path
+	API_SIGNATURE_FILE_TEMPLATE string
+	API_DIGEST_FILE_TEMPLATE    string
+	// Not-Before and Not-After of the file, see the window package. S3 objects have them in user metadata,
+	// they are kept in memory per object generation, up to API_WINDOW_CACHE_MAX_ENTRIES.
+	API_WINDOW_FILE_TEMPLATE     string
+	API_WINDOW_CACHE_MAX_ENTRIES int
+	// Repr-Digest of served files and of their encoded, encrypted and patch variants are kept in memory.
+	// If API_STORE_DIGESTS is true, digests computed by the server are also written to API_DIGEST_FILE_TEMPLATE,
+	// or to the Repr-Digest user metadata of S3 objects.
+	API_DIGEST_CACHE_MAX_ENTRIES int
+	API_STORE_DIGESTS            bool
+
+	// Binary delta downloads between file generations
+	// If API_DELTA_GENERATIONS is 0, no generations are kept and the full file is always served.
+	// Clients get a patch only if they send an older ETag in If-None-Match and list
+	// API_DELTA_MEDIA_TYPE in Accept.
+	API_DELTA_GENERATIONS int
+	API_DELTA_DIR         string
+	API_DELTA_MEDIA_TYPE  string
+
+	// Content encoding
+	// Comma separated list of zstd, br and gzip in the order of server preference.
+	// If empty, files are always sent as they are. Precompressed .zst/.br/.gz siblings
+	// are used when they are not older than the file, otherwise the file is compressed
+	// on the fly and kept in API_COMPRESSION_CACHE_DIR.
+	API_CONTENT_ENCODINGS             string
+	API_COMPRESSION_CACHE_DIR         string
+	API_COMPRESSION_CACHE_MAX_ENTRIES int
+
+	// Per-client encryption
+	// If true, every file is sent as a JWE (application/jose) encrypted to the public key
+	// of the client certificate. Delta and content encoding are not used then.
+	// Encrypted files are kept in API_ENCRYPTION_CACHE_DIR per file generation and client key.
+	API_ENCRYPT_FILES                bool
+	API_ENCRYPTION_CACHE_DIR         string
+	API_ENCRYPTION_CACHE_MAX_ENTRIES int
+
+	// Long-poll
+	// Clients sending their current ETag in If-None-Match and Prefer: wait=<seconds> are held until the file
+	// changes, at most API_WAIT_MAX_S seconds. If API_WAIT_MAX_S is 0, 304 is sent right away as before.
+	// The transfer after the wait gets the whole WRITE_TIMEOUT_S again.
+	// Changes are watched in API_FILE_DIR. S3 objects someone waits for are listed once every API_WAIT_S3_POLL_S seconds,
+	// however many requests wait for them, and only waiters of changed objects are woken up.
+	// At most API_WAIT_MAX_CONNECTIONS requests are held, others get 304 right away.
+	API_WAIT_MAX_S           int
+	API_WAIT_MAX_CONNECTIONS int
+	API_WAIT_S3_POLL_S       int
+
+	// Staged rollout
+	// Clients not asking for a version get the one given by the rollout policy in API_ROLLOUT_FILE,
+	// see rollout.Policy. The file is reloaded every API_ROLLOUT_RELOAD_S seconds if it changed.
+	API_ROLLOUT_FILE     string
+	API_ROLLOUT_RELOAD_S int
+
+	// Pins force clients onto a version or a generation, whatever version they ask for, see pin.Pin.
+	// Pins are kept in API_PINS_FILE and managed by admins on the admin API, see ADMIN_BIND_PORT.
+	// The last API_PIN_GENERATIONS generations of every file served are kept in API_PIN_GENERATIONS_DIR,
+	// so that clients can be pinned to them.
+	API_PINS_FILE           string
+	API_ADMIN_OU            string
+	API_PIN_GENERATIONS     int
+	API_PIN_GENERATIONS_DIR string
+
+	// Server-Sent Events
+	// Clients may keep a text/event-stream open on API_EVENTS_URL to be told whenever any of their files
+	// is published. Heartbeats are sent every API_EVENTS_HEARTBEAT_S seconds. Changes are detected the same
+	// way as for long-poll, files of a client are listed once per change for all its streams.
+	// If API_EVENTS_MAX_CONNECTIONS is 0, the stream is disabled.
+	API_EVENTS_URL             string
+	API_EVENTS_MAX_CONNECTIONS int
+	API_EVENTS_HEARTBEAT_S     int
 
 	API_USE_S3 bool
 	// main S3
@@ -103,6 +288,17 @@ type Settings struct {
 	CACertPool    *x509.CertPool
 	CACert        *x509.Certificate
 	CRL           *x509.RevocationList
+
+	ProducerCACert *x509.Certificate `ignored:"true"`
+	AdminCACert    *x509.Certificate `ignored:"true"`
+
+	SigningKey        crypto.Signer
+	SigningPublicKeys []crypto.PublicKey
+
+	ContentEncodings []string
+	VersionsPattern  *regexp.Regexp `ignored:"true"`
+
+	Resources map[string]*Resource
 }
 
 func LoadSettings() Settings {
@@ -112,6 +308,19 @@ func LoadSettings() Settings {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	if len(settings.LOG_FORMAT) == 0 {
+		settings.LOG_FORMAT = "text"
+	}
+	if len(settings.LOG_LEVEL) == 0 {
+		settings.LOG_LEVEL = "info"
+	}
+	if err := logging.Setup(os.Stderr, settings.LOG_FORMAT, settings.LOG_LEVEL, Code); err != nil {
+		log.Fatal(fmt.Sprintf(MSG00121, err.Error()))
+	}
+	if len(settings.LOG_REQUEST_ID_HEADER) == 0 {
+		settings.LOG_REQUEST_ID_HEADER = "X-Request-Id"
+		log.Printf(MSG00122, settings.LOG_REQUEST_ID_HEADER)
+	}
 	settings.CACertPool = x509.NewCertPool()
 
 	// Cap on goroutines going haywire
@@ -131,6 +340,91 @@ func LoadSettings() Settings {
 	if settings.BIND_PORT == 0 {
 		log.Fatal(fmt.Sprintf(MSG00016, settings.BIND_PORT))
 	}
+	if settings.METRICS_BIND_PORT > 0 {
+		if len(settings.METRICS_BIND_HOST) == 0 {
+			settings.METRICS_BIND_HOST = settings.BIND_HOST
+			log.Printf(MSG00117, settings.METRICS_BIND_HOST)
+		}
+		if len(settings.METRICS_URL) == 0 {
+			settings.METRICS_URL = "/metrics"
+			log.Printf(MSG00118, settings.METRICS_URL)
+		}
+		if settings.METRICS_BIND_PORT == settings.BIND_PORT && settings.METRICS_BIND_HOST == settings.BIND_HOST {
+			log.Fatal(fmt.Sprintf(MSG00119, settings.METRICS_BIND_PORT))
+		}
+	}
+
+	if len(settings.TRACING_OTLP_ENDPOINT) > 0 {
+		if settings.TRACING_SAMPLE_RATIO <= 0 {
+			settings.TRACING_SAMPLE_RATIO = 1
+			log.Printf(MSG00134, settings.TRACING_SAMPLE_RATIO)
+		}
+		if settings.TRACING_SAMPLE_RATIO > 1 {
+			log.Fatal(fmt.Sprintf(MSG00135, settings.TRACING_SAMPLE_RATIO))
+		}
+		if len(settings.TRACING_SERVICE_NAME) == 0 {
+			settings.TRACING_SERVICE_NAME = "serve-file"
+			log.Printf(MSG00136, settings.TRACING_SERVICE_NAME)
+		}
+	}
+
+	switch settings.AUDIT_LOG_SINK {
+	case "":
+	case "stdout":
+	case "file":
+		if len(settings.AUDIT_LOG_FILE) == 0 {
+			log.Fatal(MSG00124)
+		}
+		if settings.AUDIT_LOG_MAX_SIZE_MB <= 0 {
+			settings.AUDIT_LOG_MAX_SIZE_MB = 100
+			log.Printf(MSG00125, settings.AUDIT_LOG_MAX_SIZE_MB)
+		}
+		if settings.AUDIT_LOG_MAX_AGE_H <= 0 {
+			settings.AUDIT_LOG_MAX_AGE_H = 24
+			log.Printf(MSG00126, settings.AUDIT_LOG_MAX_AGE_H)
+		}
+		if settings.AUDIT_LOG_MAX_BACKUPS <= 0 {
+			settings.AUDIT_LOG_MAX_BACKUPS = 7
+			log.Printf(MSG00127, settings.AUDIT_LOG_MAX_BACKUPS)
+		}
+	case "syslog":
+		if len(settings.AUDIT_LOG_SYSLOG_TAG) == 0 {
+			settings.AUDIT_LOG_SYSLOG_TAG = "serve-file"
+			log.Printf(MSG00128, settings.AUDIT_LOG_SYSLOG_TAG)
+		}
+	default:
+		log.Fatal(fmt.Sprintf(MSG00123, settings.AUDIT_LOG_SINK))
+	}
+
+	if settings.HEALTH_BIND_PORT > 0 {
+		if len(settings.HEALTH_BIND_HOST) == 0 {
+			settings.HEALTH_BIND_HOST = settings.BIND_HOST
+			log.Printf(MSG00138, settings.HEALTH_BIND_HOST)
+		}
+		if len(settings.HEALTH_LIVE_URL) == 0 {
+			settings.HEALTH_LIVE_URL = "/livez"
+			log.Printf(MSG00139, settings.HEALTH_LIVE_URL)
+		}
+		if len(settings.HEALTH_READY_URL) == 0 {
+			settings.HEALTH_READY_URL = "/readyz"
+			log.Printf(MSG00140, settings.HEALTH_READY_URL)
+		}
+		if len(settings.HEALTH_STARTUP_URL) == 0 {
+			settings.HEALTH_STARTUP_URL = "/startupz"
+			log.Printf(MSG00141, settings.HEALTH_STARTUP_URL)
+		}
+		if settings.HEALTH_CHECK_TIMEOUT_S == 0 {
+			settings.HEALTH_CHECK_TIMEOUT_S = 5
+			log.Printf(MSG00142, settings.HEALTH_CHECK_TIMEOUT_S)
+		}
+		if settings.HEALTH_CHECK_CACHE_S == 0 {
+			settings.HEALTH_CHECK_CACHE_S = 5
+			log.Printf(MSG00158, settings.HEALTH_CHECK_CACHE_S)
+		}
+		if settings.HEALTH_BIND_PORT == settings.BIND_PORT && settings.HEALTH_BIND_HOST == settings.BIND_HOST {
+			log.Fatal(fmt.Sprintf(MSG00143, settings.HEALTH_BIND_PORT))
+		}
+	}
 
 	// Web server params
 	if settings.READ_TIMEOUT_S == 0 {
@@ -216,6 +510,93 @@ func LoadSettings() Settings {
 	}
 	settings.CACertPool.AddCert(settings.CACert)
 
+	// Producer CA cert
+	var producerCACertBytes []byte
+	if len(settings.PRODUCER_CA_CERT_PEM_BASE64) > 0 {
+		producerCACertBytes, err = base64.StdEncoding.DecodeString(settings.PRODUCER_CA_CERT_PEM_BASE64)
+		if err != nil {
+			log.Fatal(MSG00091, err)
+		}
+	} else if len(settings.PRODUCER_CA_CERT_PEM_FILE) > 0 {
+		producerCACertBytes, err = os.ReadFile(settings.PRODUCER_CA_CERT_PEM_FILE)
+		if err != nil {
+			log.Fatal(MSG00092, err)
+		}
+	}
+	if producerCACertBytes != nil {
+		block, _ := pem.Decode(producerCACertBytes)
+		if block == nil {
+			log.Fatal(MSG00093)
+		}
+		settings.ProducerCACert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatal(MSG00093, err)
+		}
+	}
+
+	// Admin CA cert
+	var adminCACertBytes []byte
+	if len(settings.ADMIN_CA_CERT_PEM_BASE64) > 0 {
+		adminCACertBytes, err = base64.StdEncoding.DecodeString(settings.ADMIN_CA_CERT_PEM_BASE64)
+		if err != nil {
+			log.Fatal(MSG00144, err)
+		}
+	} else if len(settings.ADMIN_CA_CERT_PEM_FILE) > 0 {
+		adminCACertBytes, err = os.ReadFile(settings.ADMIN_CA_CERT_PEM_FILE)
+		if err != nil {
+			log.Fatal(MSG00145, err)
+		}
+	}
+	if adminCACertBytes != nil {
+		block, _ := pem.Decode(adminCACertBytes)
+		if block == nil {
+			log.Fatal(MSG00146)
+		}
+		settings.AdminCACert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatal(MSG00146, err)
+		}
+	}
+
+	// Admin API
+	if settings.ADMIN_BIND_PORT > 0 {
+		if len(settings.ADMIN_BIND_HOST) == 0 {
+			settings.ADMIN_BIND_HOST = settings.BIND_HOST
+			log.Printf(MSG00147, settings.ADMIN_BIND_HOST)
+		}
+		if len(settings.ADMIN_URL) == 0 {
+			settings.ADMIN_URL = "/admin/"
+			log.Printf(MSG00148, settings.ADMIN_URL)
+		}
+		for _, other := range []struct {
+			host string
+			port uint16
+		}{
+			{settings.BIND_HOST, settings.BIND_PORT},
+			{settings.METRICS_BIND_HOST, settings.METRICS_BIND_PORT},
+			{settings.HEALTH_BIND_HOST, settings.HEALTH_BIND_PORT},
+		} {
+			if settings.ADMIN_BIND_PORT == other.port && settings.ADMIN_BIND_HOST == other.host {
+				log.Fatal(fmt.Sprintf(MSG00149, settings.ADMIN_BIND_PORT))
+			}
+		}
+		if len(settings.API_ADMIN_OU) == 0 && settings.AdminCACert == nil {
+			log.Fatal(MSG00150)
+		}
+	} else if settings.ENABLE_PROFILE {
+		log.Println(MSG00152)
+	}
+	if len(settings.LAST_SEEN_FILE) > 0 {
+		if settings.LAST_SEEN_FLUSH_S <= 0 {
+			settings.LAST_SEEN_FLUSH_S = 10
+			log.Printf(MSG00155, settings.LAST_SEEN_FLUSH_S)
+		}
+		if settings.LAST_SEEN_STALE_H <= 0 {
+			settings.LAST_SEEN_STALE_H = 24
+			log.Printf(MSG00156, settings.LAST_SEEN_STALE_H)
+		}
+	}
+
 	// Server cert key pair
 	var serverCert []byte
 	if len(settings.SERVER_CERT_PEM_BASE64) > 0 {
@@ -250,6 +631,60 @@ func LoadSettings() Settings {
 		log.Fatal(MSG00011, err)
 	}
 
+	// Signing keys
+	var signingKey []byte
+	if len(settings.SIGNING_KEY_PEM_BASE64) > 0 {
+		signingKey, err = base64.StdEncoding.DecodeString(settings.SIGNING_KEY_PEM_BASE64)
+		if err != nil {
+			log.Fatal(MSG00066, err)
+		}
+	} else if len(settings.SIGNING_KEY_PEM_FILE) > 0 {
+		signingKey, err = os.ReadFile(settings.SIGNING_KEY_PEM_FILE)
+		if err != nil {
+			log.Fatal(MSG00067, err)
+		}
+	}
+	if len(signingKey) > 0 {
+		settings.SigningKey, err = signing.ParsePrivateKey(signingKey)
+		if err != nil {
+			log.Fatal(MSG00068, err)
+		}
+	}
+	var signingPublicKeys []byte
+	if len(settings.SIGNING_PUBLIC_KEYS_PEM_BASE64) > 0 {
+		signingPublicKeys, err = base64.StdEncoding.DecodeString(settings.SIGNING_PUBLIC_KEYS_PEM_BASE64)
+		if err != nil {
+			log.Fatal(MSG00069, err)
+		}
+	} else if len(settings.SIGNING_PUBLIC_KEYS_PEM_FILE) > 0 {
+		signingPublicKeys, err = os.ReadFile(settings.SIGNING_PUBLIC_KEYS_PEM_FILE)
+		if err != nil {
+			log.Fatal(MSG00070, err)
+		}
+	}
+	if len(signingPublicKeys) > 0 {
+		settings.SigningPublicKeys, err = signing.ParsePublicKeys(signingPublicKeys)
+		if err != nil {
+			log.Fatal(MSG00071, err)
+		}
+	}
+	if settings.SigningKey == nil && len(settings.SigningPublicKeys) == 0 {
+		log.Println(MSG00072)
+	}
+	if settings.AUDIT_LOG_CHAIN {
+		if len(settings.AUDIT_LOG_SINK) == 0 || settings.SigningKey == nil {
+			log.Fatal(MSG00130)
+		}
+		if settings.AUDIT_LOG_CHECKPOINT_RECORDS == 0 {
+			settings.AUDIT_LOG_CHECKPOINT_RECORDS = 1000
+			log.Printf(MSG00131, settings.AUDIT_LOG_CHECKPOINT_RECORDS)
+		}
+		if settings.AUDIT_LOG_CHECKPOINT_INTERVAL_S <= 0 {
+			settings.AUDIT_LOG_CHECKPOINT_INTERVAL_S = 300
+			log.Printf(MSG00132, settings.AUDIT_LOG_CHECKPOINT_INTERVAL_S)
+		}
+	}
+
 	// API settings
 	if len(settings.API_URL) == 0 {
 		settings.API_URL = "/sinkit/rest/protostream/resolvercache/"
@@ -263,6 +698,51 @@ func LoadSettings() Settings {
 		settings.API_VERSION_REQ_HEADER = "x-version"
 		log.Printf(MSG00030, settings.API_VERSION_REQ_HEADER)
 	}
+	if len(settings.API_RSP_LEVEL_HEADER) == 0 {
+		settings.API_RSP_LEVEL_HEADER = "X-File-Level"
+		log.Printf(MSG00090, settings.API_RSP_LEVEL_HEADER)
+	}
+	if len(settings.API_MANIFEST_URL) == 0 {
+		settings.API_MANIFEST_URL = "/sinkit/rest/protostream/manifest"
+		log.Printf(MSG00085, settings.API_MANIFEST_URL)
+	}
+	if len(settings.API_VERSIONS_URL) == 0 {
+		settings.API_VERSIONS_URL = "/sinkit/rest/protostream/versions"
+		log.Printf(MSG00086, settings.API_VERSIONS_URL)
+	}
+	if len(settings.API_VERSIONS_PATTERN) > 0 {
+		settings.VersionsPattern, err = regexp.Compile(settings.API_VERSIONS_PATTERN)
+		if err != nil {
+			log.Fatal(MSG00087, err)
+		}
+	}
+	if settings.API_VERSIONS_MAX < 0 {
+		log.Fatal(fmt.Sprintf(MSG00088, settings.API_VERSIONS_MAX))
+	}
+	if settings.PublishEnabled() {
+		if len(settings.API_PUBLISH_URL) == 0 {
+			settings.API_PUBLISH_URL = "/sinkit/rest/protostream/publish/"
+			log.Printf(MSG00095, settings.API_PUBLISH_URL)
+		}
+		if settings.API_PUBLISH_MAX_BYTES <= 0 {
+			settings.API_PUBLISH_MAX_BYTES = 1 << 30
+			log.Printf(MSG00096, settings.API_PUBLISH_MAX_BYTES)
+		}
+		if len(settings.API_CUSTOMER_REQ_HEADER) == 0 {
+			settings.API_CUSTOMER_REQ_HEADER = "x-customer-id"
+			log.Printf(MSG00097, settings.API_CUSTOMER_REQ_HEADER)
+		}
+	} else {
+		log.Println(MSG00094)
+	}
+	if settings.API_DIGEST_CACHE_MAX_ENTRIES <= 0 {
+		settings.API_DIGEST_CACHE_MAX_ENTRIES = 10000
+		log.Printf(MSG00081, settings.API_DIGEST_CACHE_MAX_ENTRIES)
+	}
+	if settings.API_WINDOW_CACHE_MAX_ENTRIES <= 0 {
+		settings.API_WINDOW_CACHE_MAX_ENTRIES = 10000
+		log.Printf(MSG00159, settings.API_WINDOW_CACHE_MAX_ENTRIES)
+	}
 	if settings.API_RSP_TRY_LATER_HTTP_CODE <= 0 {
 		settings.API_RSP_TRY_LATER_HTTP_CODE = 466
 		log.Printf(MSG00034, settings.API_RSP_TRY_LATER_HTTP_CODE)
@@ -271,6 +751,20 @@ func LoadSettings() Settings {
 		settings.API_RSP_ERROR_HEADER = "X-error"
 		log.Printf(MSG00035, settings.API_RSP_ERROR_HEADER)
 	}
+	if settings.API_RSP_RETRY_AFTER_S <= 0 {
+		settings.API_RSP_RETRY_AFTER_S = 60
+		log.Printf(MSG00157, settings.API_RSP_RETRY_AFTER_S)
+	}
+	if settings.SigningKey != nil || len(settings.SigningPublicKeys) > 0 {
+		if len(settings.API_SIGNATURE_HEADER) == 0 {
+			settings.API_SIGNATURE_HEADER = "Content-Signature"
+			log.Printf(MSG00073, settings.API_SIGNATURE_HEADER)
+		}
+		if len(settings.API_KEYS_URL) == 0 {
+			settings.API_KEYS_URL = "/sinkit/rest/protostream/keys"
+			log.Printf(MSG00074, settings.API_KEYS_URL)
+		}
+	}
 	// S3 storage
 	if settings.API_USE_S3 {
 		log.Println(MSG00040)
@@ -334,10 +828,196 @@ func LoadSettings() Settings {
 			settings.API_HASH_FILE_TEMPLATE = "%s/%s_resolver_cache.bin.md5"
 			log.Printf(MSG00033, settings.API_HASH_FILE_TEMPLATE)
 		}
+		if len(settings.API_DIGEST_FILE_TEMPLATE) == 0 {
+			settings.API_DIGEST_FILE_TEMPLATE = "%s.digest"
+			log.Printf(MSG00080, settings.API_DIGEST_FILE_TEMPLATE)
+		}
+		if len(settings.API_WINDOW_FILE_TEMPLATE) == 0 {
+			settings.API_WINDOW_FILE_TEMPLATE = "%s.window"
+			log.Printf(MSG00116, settings.API_WINDOW_FILE_TEMPLATE)
+		}
+		if len(settings.API_SIGNATURE_FILE_TEMPLATE) == 0 && (settings.SigningKey != nil || len(settings.SigningPublicKeys) > 0) {
+			settings.API_SIGNATURE_FILE_TEMPLATE = "%s.sig"
+			log.Printf(MSG00075, settings.API_SIGNATURE_FILE_TEMPLATE)
+		}
+	}
+
+	// Delta downloads
+	if settings.API_DELTA_GENERATIONS < 0 {
+		log.Fatal(fmt.Sprintf(MSG00057, settings.API_DELTA_GENERATIONS))
+	}
+	if settings.API_DELTA_GENERATIONS > 0 {
+		if len(settings.API_DELTA_DIR) == 0 {
+			settings.API_DELTA_DIR = "/tmp/serve-file/generations"
+			log.Printf(MSG00058, settings.API_DELTA_DIR)
+		}
+		if len(settings.API_DELTA_MEDIA_TYPE) == 0 {
+			settings.API_DELTA_MEDIA_TYPE = "application/vnd.whalebone.zstd-patch"
+			log.Printf(MSG00059, settings.API_DELTA_MEDIA_TYPE)
+		}
+	}
+
+	// Content encoding
+	if len(settings.API_CONTENT_ENCODINGS) > 0 {
+		settings.ContentEncodings, err = compression.ParseEncodings(settings.API_CONTENT_ENCODINGS)
+		if err != nil {
+			log.Fatal(MSG00061, err)
+		}
+	}
+	if len(settings.ContentEncodings) > 0 {
+		if len(settings.API_COMPRESSION_CACHE_DIR) == 0 {
+			settings.API_COMPRESSION_CACHE_DIR = "/tmp/serve-file/encoded"
+			log.Printf(MSG00062, settings.API_COMPRESSION_CACHE_DIR)
+		}
+		if settings.API_COMPRESSION_CACHE_MAX_ENTRIES <= 0 {
+			settings.API_COMPRESSION_CACHE_MAX_ENTRIES = 1000
+			log.Printf(MSG00063, settings.API_COMPRESSION_CACHE_MAX_ENTRIES)
+		}
+	} else {
+		log.Println(MSG00064)
+	}
+
+	// Per-client encryption
+	if settings.API_ENCRYPT_FILES {
+		log.Println(MSG00076)
+		if len(settings.API_ENCRYPTION_CACHE_DIR) == 0 {
+			settings.API_ENCRYPTION_CACHE_DIR = "/tmp/serve-file/encrypted"
+			log.Printf(MSG00077, settings.API_ENCRYPTION_CACHE_DIR)
+		}
+		if settings.API_ENCRYPTION_CACHE_MAX_ENTRIES <= 0 {
+			settings.API_ENCRYPTION_CACHE_MAX_ENTRIES = 10000
+			log.Printf(MSG00078, settings.API_ENCRYPTION_CACHE_MAX_ENTRIES)
+		}
+	}
+
+	if settings.API_WAIT_MAX_S < 0 {
+		log.Fatal(fmt.Sprintf(MSG00098, settings.API_WAIT_MAX_S))
+	}
+	if settings.API_WAIT_MAX_S > 0 {
+		if settings.API_WAIT_MAX_S >= int(settings.WRITE_TIMEOUT_S) {
+			log.Fatal(fmt.Sprintf(MSG00099, settings.API_WAIT_MAX_S, settings.WRITE_TIMEOUT_S))
+		}
+		if settings.API_WAIT_MAX_CONNECTIONS <= 0 {
+			settings.API_WAIT_MAX_CONNECTIONS = 1000
+			log.Printf(MSG00100, settings.API_WAIT_MAX_CONNECTIONS)
+		}
+	}
+	if len(settings.API_ROLLOUT_FILE) > 0 && settings.API_ROLLOUT_RELOAD_S <= 0 {
+		settings.API_ROLLOUT_RELOAD_S = 30
+		log.Printf(MSG00106, settings.API_ROLLOUT_RELOAD_S)
+	}
+	if len(settings.API_PINS_FILE) > 0 {
+		if settings.ADMIN_BIND_PORT == 0 {
+			log.Println(MSG00115)
+		}
+		if settings.API_PIN_GENERATIONS <= 0 {
+			settings.API_PIN_GENERATIONS = 5
+			log.Printf(MSG00111, settings.API_PIN_GENERATIONS)
+		}
+		if len(settings.API_PIN_GENERATIONS_DIR) == 0 {
+			settings.API_PIN_GENERATIONS_DIR = "/tmp/serve-file/pinned"
+			log.Printf(MSG00112, settings.API_PIN_GENERATIONS_DIR)
+		}
 	}
+	if settings.API_EVENTS_MAX_CONNECTIONS < 0 {
+		log.Fatal(fmt.Sprintf(MSG00103, settings.API_EVENTS_MAX_CONNECTIONS))
+	}
+	if settings.API_EVENTS_MAX_CONNECTIONS > 0 {
+		if len(settings.API_EVENTS_URL) == 0 {
+			settings.API_EVENTS_URL = "/sinkit/rest/protostream/events"
+			log.Printf(MSG00104, settings.API_EVENTS_URL)
+		}
+		if settings.API_EVENTS_HEARTBEAT_S <= 0 {
+			settings.API_EVENTS_HEARTBEAT_S = 15
+			log.Printf(MSG00105, settings.API_EVENTS_HEARTBEAT_S)
+		}
+	}
+	if (settings.API_WAIT_MAX_S > 0 || settings.API_EVENTS_MAX_CONNECTIONS > 0) &&
+		settings.API_USE_S3 && settings.API_WAIT_S3_POLL_S <= 0 {
+		settings.API_WAIT_S3_POLL_S = 5
+		log.Printf(MSG00101, settings.API_WAIT_S3_POLL_S)
+	}
+
+	// Named resources
+	loadResources(&settings)
 	return settings
 }
 
 func (s *Settings) UseCloudS3() bool {
 	return s.CLOUD_S3_CUSTOMER_ID != ""
 }
+
+// PublishEnabled tells whether producers are configured, see API_PUBLISH_URL.
+func (s *Settings) PublishEnabled() bool {
+	return len(s.API_PRODUCER_OU) > 0 || s.ProducerCACert != nil
+}
+
+// LoadCertificates reads the server key pair and the CRL again, e.g. after they were renewed on disk.
+// _BASE64 properties cannot change while running, so they yield the same certificates as on start.
+func (s *Settings) LoadCertificates() (tls.Certificate, *x509.RevocationList, error) {
+	serverCert, err := readPEM(s.SERVER_CERT_PEM_BASE64, s.SERVER_CERT_PEM_FILE)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serverKey, err := readPEM(s.SERVER_KEY_PEM_BASE64, s.SERVER_KEY_PEM_FILE)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	keyPair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	// Unlike certificates, CRL_PEM_FILE takes precedence, see LoadSettings.
+	crlBytes, err := readPEM("", s.CRL_PEM_FILE)
+	if err == nil && len(crlBytes) == 0 {
+		crlBytes, err = readPEM(s.CRL_PEM_BASE64, "")
+	}
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	if len(crlBytes) <= 1 {
+		return keyPair, nil, nil
+	}
+	crlBlock, _ := pem.Decode(crlBytes)
+	if crlBlock == nil {
+		return tls.Certificate{}, nil, errors.New(MSG00025)
+	}
+	crl, err := x509.ParseRevocationList(crlBlock.Bytes)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return keyPair, crl, nil
+}
+
+func readPEM(base64Value, file string) ([]byte, error) {
+	if len(base64Value) > 0 {
+		return base64.StdEncoding.DecodeString(base64Value)
+	}
+	if len(file) > 0 {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// secret matches properties whose values are never shown, see Effective.
+var secret = regexp.MustCompile(`SECRET|ACCESS_KEY|PASSWORD|TOKEN|_PEM_BASE64$`)
+
+// Effective lists the properties in effect, i.e. with defaults applied, by their names without the SRV_ prefix.
+// Values of secrets are replaced with REDACTED.
+func (s *Settings) Effective() map[string]interface{} {
+	effective := make(map[string]interface{})
+	v := reflect.ValueOf(*s)
+	for i := 0; i < v.NumField(); i++ {
+		name, value := v.Type().Field(i).Name, v.Field(i)
+		// Parsed certificates, keys and the like are not properties.
+		if strings.ToUpper(name) != name || value.Kind() == reflect.Ptr || value.Kind() == reflect.Map {
+			continue
+		}
+		if secret.MatchString(name) && !value.IsZero() {
+			effective[name] = "REDACTED"
+			continue
+		}
+		effective[name] = value.Interface()
+	}
+	return effective
+}
@@ -17,6 +17,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"os"
@@ -176,3 +178,47 @@ func TestCertConfig(t *testing.T) {
 	}
 	PanicOnWrongSettings(t, props, "258 long SRV_BIND_HOST is too long. Could the property be mixed up with a BASE64 cert one?")
 }
+
+func TestLoadCertificates(t *testing.T) {
+	settings := Settings{
+		SERVER_CERT_PEM_FILE:  "../certs/server/certs/server.cert.pem",
+		SERVER_KEY_PEM_BASE64: testutil.GetBase64("../certs/server/private/server.key.nopass.pem"),
+		CRL_PEM_FILE:          "../certs/crl/certs/intermediate.crl.pem",
+	}
+	keyPair, crl, err := settings.LoadCertificates()
+	assert.NoError(t, err)
+	assert.Len(t, keyPair.Certificate, 1)
+	assert.NotNil(t, crl)
+
+	settings.CRL_PEM_FILE = ""
+	_, crl, err = settings.LoadCertificates()
+	assert.NoError(t, err)
+	assert.Nil(t, crl)
+
+	settings.SERVER_CERT_PEM_FILE = "/does/not/exist"
+	_, _, err = settings.LoadCertificates()
+	assert.Error(t, err)
+}
+
+func TestEffective(t *testing.T) {
+	settings := Settings{
+		BIND_PORT:             3000,
+		S3_SECRET_KEY:         "minio123",
+		CLOUD_S3_SECRET_KEY:   "",
+		SERVER_KEY_PEM_BASE64: "c2VjcmV0",
+		SERVER_KEY_PEM_FILE:   "/etc/serve-file/server.key.pem",
+		API_RESOURCES:         []string{"blocklist"},
+		ServerKeyPair:         tls.Certificate{},
+		ProducerCACert:        &x509.Certificate{},
+		Resources:             map[string]*Resource{},
+	}
+	effective := settings.Effective()
+	assert.Equal(t, uint16(3000), effective["BIND_PORT"])
+	assert.Equal(t, "REDACTED", effective["S3_SECRET_KEY"])
+	assert.Equal(t, "", effective["CLOUD_S3_SECRET_KEY"])
+	assert.Equal(t, "REDACTED", effective["SERVER_KEY_PEM_BASE64"])
+	assert.Equal(t, "/etc/serve-file/server.key.pem", effective["SERVER_KEY_PEM_FILE"])
+	assert.Equal(t, []string{"blocklist"}, effective["API_RESOURCES"])
+	assert.NotContains(t, effective, "ServerKeyPair")
+	assert.NotContains(t, effective, "CRL")
+}
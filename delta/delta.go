@@ -0,0 +1,256 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package delta
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"whalebone.io/serve-file/filecache"
+)
+
+// Generations are kept on local disk regardless of the storage backend:
+//
+//	<dir>/<key>/<etag>.gen              copy of a served file generation
+//	<dir>/<key>/<from>_<to>.patch       zstd frame of <to> using <from> as a raw dictionary
+//
+// A patch is the zstd "--patch-from" format, i.e. the client decompresses it with
+// its current (old) file as the dictionary.
+const (
+	generationSuffix = ".gen"
+	patchSuffix      = ".patch"
+)
+
+var ErrUnknownGeneration = errors.New("generation is not kept")
+
+type Store struct {
+	dir   string
+	keep  int
+	mutex sync.Mutex
+}
+
+func New(dir string, keep int) (*Store, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("at least one generation must be kept, got %d", keep)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, keep: keep}, nil
+}
+
+// Has tells whether the generation identified by etag is kept for the key.
+func (s *Store) Has(key, etag string) bool {
+	_, err := os.Stat(s.generationPath(key, etag))
+	return err == nil
+}
+
+// Remember stores the content as the generation identified by etag and prunes
+// the oldest generations of the key, together with their patches.
+func (s *Store) Remember(key, etag string, content io.Reader) error {
+	return s.RememberAt(key, etag, content, time.Time{})
+}
+
+// RememberAt is Remember of a generation published at the time, see At. Generations remembered
+// with Remember are taken as published when remembered.
+func (s *Store) RememberAt(key, etag string, content io.Reader, published time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Has(key, etag) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, filecache.Sanitize(key)), 0o750); err != nil {
+		return err
+	}
+	if err := filecache.WriteAtomically(s.generationPath(key, etag), func(w io.Writer) error {
+		_, err := io.Copy(w, content)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !published.IsZero() {
+		if err := os.Chtimes(s.generationPath(key, etag), published, published); err != nil {
+			return err
+		}
+	}
+	return s.prune(key, etag)
+}
+
+// At returns the ETag of the latest generation of the key published at or before the time.
+func (s *Store) At(key string, t time.Time) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, filecache.Sanitize(key)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	var etag string
+	var latest time.Time
+	for _, entry := range entries {
+		name, isGeneration := strings.CutSuffix(entry.Name(), generationSuffix)
+		if !isGeneration {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(t) || info.ModTime().Before(latest) {
+			continue
+		}
+		etag, latest = name, info.ModTime()
+	}
+	if len(etag) == 0 {
+		return "", ErrUnknownGeneration
+	}
+	return etag, nil
+}
+
+// Open reads the generation identified by etag kept for the key.
+func (s *Store) Open(key, etag string) (*os.File, error) {
+	file, err := os.Open(s.generationPath(key, etag))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnknownGeneration
+	}
+	return file, err
+}
+
+// Patch returns a path to the patch turning fromETag generation into toETag generation.
+// Patches are computed once and cached next to the generations.
+func (s *Store) Patch(key, fromETag, toETag string) (string, error) {
+	patchPath := filepath.Join(s.dir, filecache.Sanitize(key), filecache.Sanitize(fromETag)+"_"+filecache.Sanitize(toETag)+patchSuffix)
+	if _, err := os.Stat(patchPath); err == nil {
+		return patchPath, nil
+	}
+	from, err := os.ReadFile(s.generationPath(key, fromETag))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrUnknownGeneration
+		}
+		return "", err
+	}
+	to, err := os.ReadFile(s.generationPath(key, toETag))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrUnknownGeneration
+		}
+		return "", err
+	}
+	err = filecache.WriteAtomically(patchPath, func(w io.Writer) error {
+		return Diff(from, to, w)
+	})
+	if err != nil {
+		return "", err
+	}
+	return patchPath, nil
+}
+
+// Diff writes a zstd frame of "to" compressed with "from" as a raw dictionary.
+func Diff(from, to []byte, w io.Writer) error {
+	enc, err := zstd.NewWriter(w,
+		zstd.WithEncoderDictRaw(0, from),
+		zstd.WithWindowSize(windowSize(len(from)+len(to))),
+		zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	if _, err = enc.Write(to); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// Apply is the client side counterpart of Diff.
+func Apply(from []byte, patch io.Reader) ([]byte, error) {
+	dec, err := zstd.NewReader(patch,
+		zstd.WithDecoderDictRaw(0, from),
+		zstd.WithDecoderMaxWindow(zstd.MaxWindowSize),
+		zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return io.ReadAll(dec)
+}
+
+func (s *Store) prune(key, current string) error {
+	keyDir := filepath.Join(s.dir, filecache.Sanitize(key))
+	entries, err := os.ReadDir(keyDir)
+	if err != nil {
+		return err
+	}
+	type generation struct {
+		name    string
+		modTime int64
+	}
+	var generations []generation
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), generationSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation{
+			name:    strings.TrimSuffix(entry.Name(), generationSuffix),
+			modTime: info.ModTime().UnixNano(),
+		})
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].modTime > generations[j].modTime })
+	kept := make(map[string]bool, s.keep)
+	for i, g := range generations {
+		if i < s.keep {
+			kept[g.name] = true
+			continue
+		}
+		if err := os.Remove(filepath.Join(keyDir, g.name+generationSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// Only patches leading to the current generation are of any use.
+	current = filecache.Sanitize(current)
+	for _, entry := range entries {
+		name, isPatch := strings.CutSuffix(entry.Name(), patchSuffix)
+		if !isPatch {
+			continue
+		}
+		from, to, _ := strings.Cut(name, "_")
+		if to != current || !kept[from] {
+			if err := os.Remove(filepath.Join(keyDir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) generationPath(key, etag string) string {
+	return filepath.Join(s.dir, filecache.Sanitize(key), filecache.Sanitize(etag)+generationSuffix)
+}
+
+func windowSize(n int) int {
+	size := zstd.MinWindowSize
+	for size < n && size < zstd.MaxWindowSize {
+		size <<= 1
+	}
+	return size
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package delta
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func generations() ([]byte, []byte) {
+	rnd := rand.New(rand.NewSource(42))
+	old := make([]byte, 256*1024)
+	rnd.Read(old)
+	current := bytes.Clone(old)
+	copy(current[1000:], []byte("a few changed bytes"))
+	current = append(current, []byte("and a new record at the end")...)
+	return old, current
+}
+
+func TestDiffApply(t *testing.T) {
+	old, current := generations()
+	var patch bytes.Buffer
+	assert.NoError(t, Diff(old, current, &patch))
+	assert.Less(t, patch.Len(), len(current)/100, "patch is not much smaller than the file")
+	applied, err := Apply(old, &patch)
+	assert.NoError(t, err)
+	assert.Equal(t, current, applied)
+}
+
+func TestStore(t *testing.T) {
+	old, current := generations()
+	store, err := New(t.TempDir(), 2)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Remember("403_v3", "\"aaa\"", bytes.NewReader(old)))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, store.Remember("403_v3", "\"bbb\"", bytes.NewReader(current)))
+	assert.True(t, store.Has("403_v3", "\"aaa\""))
+
+	patchPath, err := store.Patch("403_v3", "\"aaa\"", "\"bbb\"")
+	assert.NoError(t, err)
+	patch, err := os.Open(patchPath)
+	assert.NoError(t, err)
+	defer patch.Close()
+	applied, err := Apply(old, patch)
+	assert.NoError(t, err)
+	assert.Equal(t, current, applied)
+
+	_, err = store.Patch("403_v3", "\"zzz\"", "\"bbb\"")
+	assert.ErrorIs(t, err, ErrUnknownGeneration)
+	kept, err := store.Open("403_v3", "\"aaa\"")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(kept)
+	kept.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, old, content)
+	_, err = store.Open("403_v3", "\"zzz\"")
+	assert.ErrorIs(t, err, ErrUnknownGeneration)
+
+	// The third generation pushes the first one out.
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, store.Remember("403_v3", "\"ccc\"", bytes.NewReader([]byte("ccc"))))
+	assert.False(t, store.Has("403_v3", "\"aaa\""))
+	assert.True(t, store.Has("403_v3", "\"bbb\""))
+	_, err = os.Stat(patchPath)
+	assert.True(t, os.IsNotExist(err), "stale patch was not pruned")
+}
+
+func TestAt(t *testing.T) {
+	store, err := New(t.TempDir(), 3)
+	assert.NoError(t, err)
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = store.At("666", monday)
+	assert.ErrorIs(t, err, ErrUnknownGeneration)
+	assert.NoError(t, store.RememberAt("666", "aaa", bytes.NewReader([]byte("aaa")), monday))
+	assert.NoError(t, store.RememberAt("666", "ccc", bytes.NewReader([]byte("ccc")), monday.Add(48*time.Hour)))
+	assert.NoError(t, store.RememberAt("666", "bbb", bytes.NewReader([]byte("bbb")), monday.Add(24*time.Hour)))
+
+	_, err = store.At("666", monday.Add(-time.Hour))
+	assert.ErrorIs(t, err, ErrUnknownGeneration)
+	etag, err := store.At("666", monday)
+	assert.NoError(t, err)
+	assert.Equal(t, "aaa", etag)
+	etag, _ = store.At("666", monday.Add(36*time.Hour))
+	assert.Equal(t, "bbb", etag)
+	etag, _ = store.At("666", time.Now())
+	assert.Equal(t, "ccc", etag)
+}
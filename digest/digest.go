@@ -0,0 +1,187 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Integrity fields, https://www.rfc-editor.org/rfc/rfc9530
+const (
+	SHA256 = "sha-256"
+	SHA512 = "sha-512"
+)
+
+// Digests of a representation, keyed by the algorithm name.
+type Digests map[string][]byte
+
+// Compute reads the content once and digests it with all supported algorithms.
+func Compute(content io.Reader) (Digests, error) {
+	w := NewWriter()
+	if _, err := io.Copy(w, content); err != nil {
+		return nil, err
+	}
+	return w.Digests(), nil
+}
+
+// Writer digests everything written to it with all supported algorithms, e.g. while the content
+// is being stored.
+type Writer struct {
+	h256, h512 hash.Hash
+}
+
+func NewWriter() *Writer {
+	return &Writer{h256: sha256.New(), h512: sha512.New()}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.h256.Write(p)
+	return w.h512.Write(p)
+}
+
+// Digests of the content written so far.
+func (w *Writer) Digests() Digests {
+	return Digests{SHA256: w.h256.Sum(nil), SHA512: w.h512.Sum(nil)}
+}
+
+// Parse reads the Repr-Digest field value, e.g. as stored by a publisher in a sidecar file
+// or in S3 user metadata. Unknown algorithms are skipped.
+func Parse(field string) (Digests, error) {
+	digests := make(Digests)
+	for _, member := range strings.Split(field, ",") {
+		alg, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found {
+			return nil, fmt.Errorf("malformed digest %q", member)
+		}
+		alg = strings.ToLower(alg)
+		if alg != SHA256 && alg != SHA512 {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil {
+			return nil, err
+		}
+		digests[alg] = raw
+	}
+	if len(digests) == 0 {
+		return nil, fmt.Errorf("no supported digest in %q", field)
+	}
+	return digests, nil
+}
+
+// Field formats all digests as a Repr-Digest field value.
+func (d Digests) Field() string {
+	return d.Select("")
+}
+
+// Select formats the digests the client asked for in Want-Repr-Digest. Without preferences,
+// all digests are sent. Otherwise, only the most preferred supported algorithm is sent,
+// or nothing if all supported algorithms have preference 0.
+func (d Digests) Select(want string) string {
+	algorithms := []string{SHA256, SHA512}
+	if len(strings.TrimSpace(want)) > 0 {
+		best, bestPreference := "", int64(0)
+		for _, member := range strings.Split(want, ",") {
+			alg, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+			alg = strings.ToLower(alg)
+			if _, ok := d[alg]; !ok {
+				continue
+			}
+			preference, err := strconv.ParseInt(strings.TrimSpace(value), 10, 8)
+			if err != nil || preference <= bestPreference {
+				continue
+			}
+			best, bestPreference = alg, preference
+		}
+		if len(best) == 0 {
+			return ""
+		}
+		algorithms = []string{best}
+	}
+	var members []string
+	for _, alg := range algorithms {
+		if raw, ok := d[alg]; ok {
+			members = append(members, alg+"=:"+base64.StdEncoding.EncodeToString(raw)+":")
+		}
+	}
+	return strings.Join(members, ", ")
+}
+
+// Cache keeps digests of immutable content, e.g. a file generation identified by its ETag
+// or a file in one of the on disk caches.
+type Cache struct {
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]Digests
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{maxEntries: maxEntries, entries: make(map[string]Digests)}
+}
+
+// Get returns cached digests for the key or computes them from the content.
+func (c *Cache) Get(key string, open func() (io.ReadCloser, error)) (Digests, error) {
+	c.mutex.Lock()
+	digests, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok {
+		return digests, nil
+	}
+	content, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	digests, err = Compute(content)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(key, digests)
+	return digests, nil
+}
+
+// Put stores digests obtained elsewhere, e.g. provided by a publisher.
+func (c *Cache) Put(key string, digests Digests) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.entries = make(map[string]Digests)
+	}
+	c.entries[key] = digests
+}
+
+// Len tells how many digests are cached.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// Purge forgets all digests, they are computed again on demand.
+func (c *Cache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]Digests)
+}
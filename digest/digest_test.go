@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package digest
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Examples from https://www.rfc-editor.org/rfc/rfc9530#appendix-B
+const (
+	helloSHA256 = "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:"
+	helloSHA512 = "sha-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:"
+)
+
+func TestCompute(t *testing.T) {
+	d, err := Compute(strings.NewReader(`{"hello": "world"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, helloSHA256+", "+helloSHA512, d.Field())
+	parsed, err := Parse(d.Field())
+	assert.NoError(t, err)
+	assert.Equal(t, d, parsed)
+	_, err = Parse("md5=:garbage:")
+	assert.Error(t, err)
+}
+
+func TestSelect(t *testing.T) {
+	d, _ := Compute(strings.NewReader(`{"hello": "world"}`))
+	assert.Equal(t, helloSHA256+", "+helloSHA512, d.Select(""))
+	assert.Equal(t, helloSHA512, d.Select("sha-256=3, sha-512=10"))
+	assert.Equal(t, helloSHA256, d.Select("sha-256=1, sha-512=0, md5=10"))
+	assert.Equal(t, "", d.Select("sha-256=0, sha-512=0"))
+	assert.Equal(t, "", d.Select("unixsum=5"))
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(10)
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(strings.NewReader(`{"hello": "world"}`)), nil
+	}
+	first, err := cache.Get("\"abc\"", open)
+	assert.NoError(t, err)
+	second, err := cache.Get("\"abc\"", open)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, opened)
+	assert.Equal(t, 1, cache.Len())
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+	_, err = cache.Get("\"abc\"", open)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, opened)
+}
+
+func TestWriter(t *testing.T) {
+	w := NewWriter()
+	io.WriteString(w, `{"hello": `)
+	io.WriteString(w, `"world"}`)
+	assert.Equal(t, helloSHA256+", "+helloSHA512, w.Digests().Field())
+}
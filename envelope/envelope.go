@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"whalebone.io/serve-file/filecache"
+)
+
+// MediaType of the JWE compact serialization, https://www.rfc-editor.org/rfc/rfc7516#section-9
+const MediaType = "application/jose"
+
+var ErrUnsupportedKey = errors.New("only RSA and ECDSA keys can be used for encryption")
+
+// Encrypt seals the plaintext to the recipient's public key: RSA keys get RSA-OAEP-256,
+// ECDSA keys get ECDH-ES+A256KW, the content is always A256GCM.
+func Encrypt(plaintext []byte, recipient crypto.PublicKey) ([]byte, error) {
+	var alg jose.KeyAlgorithm
+	switch recipient.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: recipient},
+		(&jose.EncrypterOptions{}).WithContentType("application/octet-stream"))
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(serialized), nil
+}
+
+// Decrypt is the client side counterpart of Encrypt.
+func Decrypt(jwe []byte, key crypto.PrivateKey) ([]byte, error) {
+	parsed, err := jose.ParseEncrypted(string(jwe))
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Decrypt(key)
+}
+
+// Fingerprint identifies the recipient's key, i.e. SHA-256 of its SubjectPublicKeyInfo.
+func Fingerprint(recipient crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(recipient)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Cache keeps encrypted files keyed by the ETag of the plaintext and the recipient's key,
+// so a file is encrypted once per generation and client key.
+type Cache struct {
+	dir        string
+	maxEntries int
+	mutex      sync.Mutex
+}
+
+func NewCache(dir string, maxEntries int) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, maxEntries: maxEntries}, nil
+}
+
+// Get returns a path to the encrypted file. The plaintext is read to memory only on a cache miss.
+func (c *Cache) Get(etag string, recipient crypto.PublicKey, open func() (io.ReadCloser, error)) (string, error) {
+	fingerprint, err := Fingerprint(recipient)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.dir, filecache.Sanitize(etag)+"_"+fingerprint+".jwe")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	original, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+	plaintext, err := io.ReadAll(original)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := Encrypt(plaintext, recipient)
+	if err != nil {
+		return "", err
+	}
+	err = filecache.WriteAtomically(path, func(w io.Writer) error {
+		_, err := w.Write(jwe)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return path, filecache.Prune(c.dir, c.maxEntries)
+}
+
+// Usage tells how many files the cache holds.
+func (c *Cache) Usage() (filecache.Usage, error) {
+	return filecache.DirUsage(c.dir)
+}
+
+// Purge removes all cached files, they are created again on demand.
+func (c *Cache) Purge() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return filecache.Purge(c.dir)
+}
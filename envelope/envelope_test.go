@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		jwe, err := Encrypt([]byte("resolver cache"), key.Public())
+		assert.NoError(t, err)
+		assert.NotContains(t, string(jwe), "resolver cache")
+		plaintext, err := Decrypt(jwe, key)
+		assert.NoError(t, err)
+		assert.Equal(t, "resolver cache", string(plaintext))
+	}
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err := Encrypt([]byte("resolver cache"), edPublic)
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+}
+
+func TestCache(t *testing.T) {
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cache, err := NewCache(t.TempDir(), 10)
+	assert.NoError(t, err)
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(strings.NewReader("resolver cache")), nil
+	}
+	firstPath, err := cache.Get("\"abc\"", first.Public(), open)
+	assert.NoError(t, err)
+	again, err := cache.Get("\"abc\"", first.Public(), open)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPath, again)
+	secondPath, err := cache.Get("\"abc\"", second.Public(), open)
+	assert.NoError(t, err)
+	assert.NotEqual(t, firstPath, secondPath)
+	assert.Equal(t, 2, opened)
+
+	jwe, err := os.ReadFile(secondPath)
+	assert.NoError(t, err)
+	_, err = Decrypt(jwe, first)
+	assert.Error(t, err, "decrypted with someone else's key")
+	plaintext, err := Decrypt(jwe, second)
+	assert.NoError(t, err)
+	assert.Equal(t, "resolver cache", string(plaintext))
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package filecache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const tmpPrefix = ".tmp-"
+
+// WriteAtomically lets readers see either no file or the complete one.
+func WriteAtomically(path string, write func(w io.Writer) error) error {
+	staged, err := Stage(path, write)
+	if err != nil {
+		return err
+	}
+	defer staged.Discard()
+	return staged.Commit()
+}
+
+// Staged is a complete file not yet visible to readers, so that other files can be written before it.
+type Staged struct {
+	tmp, path string
+}
+
+// Stage writes a temporary file next to path.
+func Stage(path string, write func(w io.Writer) error) (*Staged, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &Staged{tmp: tmp.Name(), path: path}, nil
+}
+
+// Commit moves the file into place.
+func (s *Staged) Commit() error {
+	return os.Rename(s.tmp, s.path)
+}
+
+// Discard removes the file unless it was committed.
+func (s *Staged) Discard() {
+	os.Remove(s.tmp)
+}
+
+// Prune removes the least recently written files from the directory so that at most maxEntries remain.
+func Prune(dir string, maxEntries int) error {
+	if maxEntries <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type cached struct {
+		name    string
+		modTime int64
+	}
+	var files []cached
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{name: entry.Name(), modTime: info.ModTime().UnixNano()})
+	}
+	if len(files) <= maxEntries {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime < files[j].modTime })
+	for _, file := range files[:len(files)-maxEntries] {
+		if err := os.Remove(filepath.Join(dir, file.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage tells how many files the directory holds and their total size.
+type Usage struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// DirUsage counts the files in the directory, files being written are left out.
+func DirUsage(dir string) (Usage, error) {
+	var usage Usage
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return usage, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		usage.Entries++
+		usage.Bytes += info.Size()
+	}
+	return usage, nil
+}
+
+// Purge removes all files from the directory, files being written are left alone.
+func Purge(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sanitize keeps ETags and keys usable as file names, e.g. "ce1ac9c4f8ac" or "1a2b3c-2" from multipart S3 uploads.
+func Sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r == '_', r == '.':
+			return '-'
+		default:
+			return -1
+		}
+	}, s)
+}
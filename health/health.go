@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package health answers liveness, startup and readiness probes. Readiness runs checks of the subsystems
+// the server depends on and reports each of them.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Check tells whether a subsystem works. detail describes its state either way, e.g. when a certificate expires.
+type Check func(ctx context.Context) (detail string, err error)
+
+// Statuses of reports and checks.
+const (
+	OK   = "ok"
+	Fail = "fail"
+)
+
+// Result is the outcome of a check.
+type Result struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the response of probes. Checks are listed in the order they were added.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+type named struct {
+	name  string
+	check Check
+}
+
+// Health keeps the checks. It is not ready before Started and after Stopping.
+type Health struct {
+	timeout time.Duration
+	checks  []named
+	started atomic.Bool
+	stopped atomic.Bool
+}
+
+// New makes probes with checks that each get timeout to answer.
+func New(timeout time.Duration) *Health {
+	return &Health{timeout: timeout}
+}
+
+// Add adds a readiness check. Checks are added before the probes are served.
+func (h *Health) Add(name string, check Check) {
+	h.checks = append(h.checks, named{name: name, check: check})
+}
+
+// Started marks the server as accepting clients. Like Stopping, it does nothing on a nil Health.
+func (h *Health) Started() {
+	if h != nil {
+		h.started.Store(true)
+	}
+}
+
+// Stopping marks the server as going away, so that no new clients are sent to it.
+func (h *Health) Stopping() {
+	if h != nil {
+		h.stopped.Store(true)
+	}
+}
+
+// Check runs all checks at once.
+func (h *Health) Check(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	report := Report{Status: OK, Checks: make([]Result, len(h.checks))}
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func(i int, c named) {
+			defer wg.Done()
+			start := time.Now()
+			detail, err := c.check(ctx)
+			result := Result{Name: c.name, Status: OK, Detail: detail, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status, result.Error = Fail, err.Error()
+			}
+			report.Checks[i] = result
+		}(i, c)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != OK {
+			report.Status = Fail
+		}
+	}
+	return report
+}
+
+// Cached runs the check once at a time however many probes ask, and reuses its result for ttl.
+// The check gets timeout of its own, a probe giving up early leaves it running for the next ones,
+// so a check that hangs holds one goroutine rather than one per probe.
+func Cached(check Check, ttl, timeout time.Duration) Check {
+	var group singleflight.Group
+	var mutex sync.Mutex
+	var checked time.Time
+	var detail string
+	var err error
+	return func(ctx context.Context) (string, error) {
+		mutex.Lock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			defer mutex.Unlock()
+			return detail, err
+		}
+		mutex.Unlock()
+		results := group.DoChan("", func() (interface{}, error) {
+			checkCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			d, e := check(checkCtx)
+			mutex.Lock()
+			checked, detail, err = time.Now(), d, e
+			mutex.Unlock()
+			return d, e
+		})
+		select {
+		case result := <-results:
+			return result.Val.(string), result.Err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Live answers as long as the process serves HTTP.
+func (h *Health) Live() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		write(w, Report{Status: OK})
+	}
+}
+
+// Startup answers once the server accepts clients.
+func (h *Health) Startup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.started.Load() {
+			write(w, Report{Status: Fail})
+			return
+		}
+		write(w, Report{Status: OK})
+	}
+}
+
+// Ready answers with the results of all checks, 503 Service Unavailable if any of them fails,
+// before the server started or once it is stopping.
+func (h *Health) Ready() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.Check(r.Context())
+		if !h.started.Load() || h.stopped.Load() {
+			report.Status = Fail
+		}
+		write(w, report)
+	}
+}
+
+func write(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
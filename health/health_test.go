@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, Report) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var report Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	return rec.Code, report
+}
+
+func TestProbes(t *testing.T) {
+	h := New(100 * time.Millisecond)
+	broken := errors.New("connection refused")
+	h.Add("file-dir", func(ctx context.Context) (string, error) {
+		return "/opt/data", nil
+	})
+	h.Add("ocsp", func(ctx context.Context) (string, error) {
+		return "", broken
+	})
+	h.Add("s3-main", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+
+	code, _ := probe(t, h.Live())
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = probe(t, h.Startup())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	h.Started()
+	code, _ = probe(t, h.Startup())
+	assert.Equal(t, http.StatusOK, code)
+	code, report := probe(t, h.Ready())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, Fail, report.Status)
+	assert.Len(t, report.Checks, 3)
+	assert.Equal(t, Result{Name: "file-dir", Status: OK, Detail: "/opt/data"},
+		Result{Name: report.Checks[0].Name, Status: report.Checks[0].Status, Detail: report.Checks[0].Detail})
+	assert.Equal(t, "connection refused", report.Checks[1].Error)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[2].Error)
+}
+
+func TestReady(t *testing.T) {
+	h := New(time.Second)
+	h.Add("crl", func(ctx context.Context) (string, error) {
+		return "next update 2030-01-01T00:00:00Z", nil
+	})
+	code, report := probe(t, h.Ready())
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not started")
+	assert.Equal(t, OK, report.Checks[0].Status)
+
+	h.Started()
+	code, report = probe(t, h.Ready())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OK, report.Status)
+
+	h.Stopping()
+	code, _ = probe(t, h.Ready())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	var none *Health
+	none.Started()
+	none.Stopping()
+}
+
+func TestCached(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	check := Cached(func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "pong", nil
+	}, 50*time.Millisecond, time.Second)
+
+	// Probes give up on a hung check, it keeps running for the next ones.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := check(ctx)
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+	close(release)
+	assert.Eventually(t, func() bool {
+		detail, err := check(context.Background())
+		return detail == "pong" && err == nil
+	}, time.Second, time.Millisecond)
+	check(context.Background())
+	assert.Equal(t, int32(1), calls.Load(), "reused")
+	time.Sleep(60 * time.Millisecond)
+	check(context.Background())
+	assert.Equal(t, int32(2), calls.Load(), "expired")
+}
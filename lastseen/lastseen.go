@@ -0,0 +1,266 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package lastseen keeps, per client, when it was last seen, how it was answered and which generations of
+// files it was served and presented. The state is kept in a bbolt file, so that it survives restarts.
+package lastseen
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+var bucket = []byte("clients")
+
+// Poll is the last request of the client for a resource.
+type Poll struct {
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status"`
+	Served    string    `json:"served_etag,omitempty"`
+	Presented string    `json:"presented_etag,omitempty"`
+	// Only if the client asked for a version itself, rather than being served one by rollouts.
+	Requested string `json:"requested_version,omitempty"`
+}
+
+// Client is what is known about the client, keyed by its certificate CommonName.
+type Client struct {
+	ID           string          `json:"id"`
+	Customer     string          `json:"customer,omitempty"`
+	Organization string          `json:"organization,omitempty"`
+	Time         time.Time       `json:"last_seen"`
+	Endpoint     string          `json:"endpoint"`
+	Status       int             `json:"status"`
+	Resources    map[string]Poll `json:"resources,omitempty"`
+}
+
+// Tracker keeps all clients in memory and writes those that changed to the file every flush interval.
+type Tracker struct {
+	path    string
+	db      *bolt.DB
+	mutex   sync.Mutex
+	clients map[string]*Client
+	dirty   map[string]bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Open loads the clients from the file, creating it if needed.
+func Open(path string, flushEvery time.Duration) (*Tracker, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracker{
+		path:    path,
+		db:      db,
+		clients: make(map[string]*Client),
+		dirty:   make(map[string]bool),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var c Client
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			t.clients[string(k)] = &c
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go t.flushEvery(flushEvery)
+	return t, nil
+}
+
+func (t *Tracker) flushEvery(interval time.Duration) {
+	defer close(t.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				logging.Error(context.Background(), config.MSG00153, t.path, err.Error())
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Track records the request once it is served. Clients are told by their certificate CommonName, the resource
+// by the "resource" field annotated by the handler. Requests without a resource update the client only.
+func (t *Tracker) Track(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := logging.NewRecorder(w)
+		next(recorder, r)
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return
+		}
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		c := Client{ID: subject.CommonName, Time: time.Now().UTC(), Endpoint: endpoint, Status: recorder.Code()}
+		if len(subject.Locality) > 0 {
+			c.Customer = subject.Locality[0]
+		}
+		if len(subject.Organization) > 0 {
+			c.Organization = subject.Organization[0]
+		}
+		var resource *string
+		if name, annotated := logging.Lookup(r.Context(), "resource"); annotated {
+			resource = &name
+		}
+		t.record(c, resource, Poll{
+			Time:      c.Time,
+			Status:    c.Status,
+			Served:    recorder.Header().Get("ETag"),
+			Presented: r.Header.Get("If-None-Match"),
+			Requested: logging.Field(r.Context(), "requested_version"),
+		})
+	}
+}
+
+func (t *Tracker) record(c Client, resource *string, poll Poll) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if previous, exists := t.clients[c.ID]; exists {
+		c.Resources = previous.Resources
+	}
+	if resource != nil {
+		if c.Resources == nil {
+			c.Resources = make(map[string]Poll)
+		}
+		// A client answered without an ETag, e.g. sent away, still holds what it was served before.
+		if len(poll.Served) == 0 {
+			poll.Served = c.Resources[*resource].Served
+		}
+		c.Resources[*resource] = poll
+	}
+	t.clients[c.ID] = &c
+	t.dirty[c.ID] = true
+}
+
+// Get returns a copy of the client.
+func (t *Tracker) Get(id string) (Client, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, exists := t.clients[id]
+	if !exists {
+		return Client{}, false
+	}
+	return c.copy(), true
+}
+
+// Clients lists copies of all clients ordered by ID.
+func (t *Tracker) Clients() []Client {
+	t.mutex.Lock()
+	clients := make([]Client, 0, len(t.clients))
+	for _, c := range t.clients {
+		clients = append(clients, c.copy())
+	}
+	t.mutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// NotSeenSince lists clients last seen before the time, the longest silent first.
+func (t *Tracker) NotSeenSince(since time.Time) []Client {
+	var stale []Client
+	for _, c := range t.Clients() {
+		if c.Time.Before(since) {
+			stale = append(stale, c)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].Time.Before(stale[j].Time) })
+	return stale
+}
+
+func (c *Client) copy() Client {
+	clone := *c
+	if c.Resources != nil {
+		clone.Resources = make(map[string]Poll, len(c.Resources))
+		for name, poll := range c.Resources {
+			clone.Resources[name] = poll
+		}
+	}
+	return clone
+}
+
+// Flush writes the clients that changed since the last flush in one transaction.
+func (t *Tracker) Flush() error {
+	t.mutex.Lock()
+	changed := make(map[string][]byte, len(t.dirty))
+	for id := range t.dirty {
+		value, err := json.Marshal(t.clients[id])
+		if err != nil {
+			t.mutex.Unlock()
+			return err
+		}
+		changed[id] = value
+	}
+	t.dirty = make(map[string]bool)
+	t.mutex.Unlock()
+	if len(changed) == 0 {
+		return nil
+	}
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for id, value := range changed {
+			if err := b.Put([]byte(id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Written next time.
+		t.mutex.Lock()
+		for id := range changed {
+			t.dirty[id] = true
+		}
+		t.mutex.Unlock()
+	}
+	return err
+}
+
+// Close flushes the clients and closes the file.
+func (t *Tracker) Close() error {
+	close(t.stop)
+	<-t.stopped
+	err := t.Flush()
+	if closeErr := t.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
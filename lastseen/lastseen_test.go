@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package lastseen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/logging"
+)
+
+func TestTrack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last-seen.db")
+	tracker, err := Open(path, time.Hour)
+	assert.NoError(t, err)
+	download := logging.Requests(tracker.Track("download", func(w http.ResponseWriter, r *http.Request) {
+		logging.Annotate(r.Context(), slog.String("resource", ""))
+		if r.Header.Get("If-None-Match") == `"hash-2"` {
+			w.Header().Set("ETag", `"hash-2"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Header.Get("x-resolver-id") != "666" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"hash-2"`)
+		w.Write([]byte("resolver cache"))
+	}), "X-Request-Id")
+	manifest := logging.Requests(tracker.Track("manifest", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), "X-Request-Id")
+	request := func(id, presented string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/sinkit/rest/protostream/resolvercache/", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+			Subject: pkix.Name{CommonName: id, Locality: []string{"999"}, Organization: []string{"Whalebone"}},
+		}}}}
+		req.Header.Set("x-resolver-id", "666")
+		if len(presented) > 0 {
+			req.Header.Set("If-None-Match", presented)
+		}
+		return req
+	}
+
+	download.ServeHTTP(httptest.NewRecorder(), request("666", `"hash-1"`))
+	c, seen := tracker.Get("666")
+	assert.True(t, seen)
+	assert.Equal(t, "999", c.Customer)
+	assert.Equal(t, "Whalebone", c.Organization)
+	assert.Equal(t, http.StatusOK, c.Status)
+	assert.Equal(t, Poll{Time: c.Time, Status: http.StatusOK, Served: `"hash-2"`, Presented: `"hash-1"`}, c.Resources[""])
+
+	// Sent away, the client still holds the generation served before.
+	req := request("666", "")
+	req.Header.Set("x-resolver-id", "777")
+	download.ServeHTTP(httptest.NewRecorder(), req)
+	manifest.ServeHTTP(httptest.NewRecorder(), request("666", ""))
+	c, _ = tracker.Get("666")
+	assert.Equal(t, "manifest", c.Endpoint)
+	assert.Equal(t, http.StatusForbidden, c.Resources[""].Status)
+	assert.Equal(t, `"hash-2"`, c.Resources[""].Served)
+
+	download.ServeHTTP(httptest.NewRecorder(), request("777", `"hash-2"`))
+	_, seen = tracker.Get("10001")
+	assert.False(t, seen)
+	assert.Len(t, tracker.Clients(), 2)
+	assert.Empty(t, tracker.NotSeenSince(time.Now().Add(-time.Minute)))
+	stale := tracker.NotSeenSince(time.Now().Add(time.Minute))
+	assert.Equal(t, "666", stale[0].ID)
+	assert.Equal(t, "777", stale[1].ID)
+
+	// The state survives restarts.
+	assert.NoError(t, tracker.Close())
+	tracker, err = Open(path, time.Hour)
+	assert.NoError(t, err)
+	defer tracker.Close()
+	c, seen = tracker.Get("777")
+	assert.True(t, seen)
+	assert.Equal(t, http.StatusNotModified, c.Resources[""].Status)
+	assert.Equal(t, `"hash-2"`, c.Resources[""].Served)
+}
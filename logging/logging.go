@@ -0,0 +1,275 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup makes the slog default logger write records in the format, text or json, from the level on,
+// debug, info, warn or error. Records logged with the standard log package go there too, at info level.
+// code tells the code of a message, e.g. config.Code, and it becomes the code field of records.
+func Setup(w io.Writer, format, level string, code func(message string) string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %s, use text or json", format)
+	}
+	slog.SetDefault(slog.New(&codeHandler{Handler: handler, code: code}))
+	return nil
+}
+
+// codeHandler adds the code of the message, the fields of the request and the trace IDs to records.
+type codeHandler struct {
+	slog.Handler
+	code func(message string) string
+}
+
+func (h *codeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var coded bool
+	r.Attrs(func(a slog.Attr) bool {
+		coded = a.Key == "code"
+		return !coded
+	})
+	if !coded && h.code != nil {
+		if code := h.code(r.Message); len(code) > 0 {
+			r.AddAttrs(slog.String("code", code))
+		}
+	}
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		r.AddAttrs(req.fields()...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *codeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &codeHandler{Handler: h.Handler.WithAttrs(attrs), code: h.code}
+}
+
+func (h *codeHandler) WithGroup(name string) slog.Handler {
+	return &codeHandler{Handler: h.Handler.WithGroup(name), code: h.code}
+}
+
+// Debug, Info, Warn and Error log a message, formatted like log.Printf. The format gives the code.
+func Debug(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelDebug, format, args...)
+}
+
+func Info(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelInfo, format, args...)
+}
+
+func Warn(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelWarn, format, args...)
+}
+
+func Error(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelError, format, args...)
+}
+
+// Fatal logs an error and exits.
+func Fatal(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+func logf(ctx context.Context, level slog.Level, format string, args ...any) {
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	var attrs []slog.Attr
+	if h, ok := logger.Handler().(*codeHandler); ok && h.code != nil {
+		if code := h.code(format); len(code) > 0 {
+			attrs = append(attrs, slog.String("code", code))
+		}
+	}
+	logger.LogAttrs(ctx, level, fmt.Sprintf(format, args...), attrs...)
+}
+
+type requestKey struct{}
+
+// request keeps the fields of a request for its records.
+type request struct {
+	mutex sync.Mutex
+	attrs []slog.Attr
+}
+
+func (r *request) fields() []slog.Attr {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]slog.Attr{}, r.attrs...)
+}
+
+// Annotate adds fields to the later records of the request, e.g. the object name once it is known.
+func Annotate(ctx context.Context, attrs ...slog.Attr) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		req.mutex.Lock()
+		req.attrs = append(req.attrs, attrs...)
+		req.mutex.Unlock()
+	}
+}
+
+// Field is the value of a field of the request, e.g. request_id or object, empty if it has none.
+func Field(ctx context.Context, key string) string {
+	value, _ := Lookup(ctx, key)
+	return value
+}
+
+// Lookup is Field that also tells whether the field was annotated at all.
+func Lookup(ctx context.Context, key string) (string, bool) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		for _, a := range req.fields() {
+			if a.Key == key {
+				return a.Value.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// requestID restricts request IDs sent by clients, others are replaced.
+var requestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Requests gives records logged with the request context the request ID, the client ID and customer from
+// the client certificate. The request ID is taken from the idHeader or generated, and sent back in it.
+// When the request is served, an access record with the status, bytes and duration is logged at info level.
+func Requests(next http.Handler, idHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(idHeader)
+		if !requestID.MatchString(id) {
+			random := make([]byte, 8)
+			rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set(idHeader, id)
+		req := &request{attrs: []slog.Attr{slog.String("request_id", id)}}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			req.attrs = append(req.attrs, slog.String("client_id", subject.CommonName))
+			if len(subject.Locality) > 0 {
+				req.attrs = append(req.attrs, slog.String("customer", subject.Locality[0]))
+			}
+		}
+		ctx := context.WithValue(r.Context(), requestKey{}, req)
+		recorder := NewRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		slog.LogAttrs(ctx, slog.LevelInfo, "Request served.",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.Code()),
+			slog.Int64("bytes", recorder.Written()),
+			slog.Duration("duration", time.Since(start)))
+	})
+}
+
+// Recorder remembers the status code and counts the body. It keeps sendfile working for http.ServeFile.
+type Recorder struct {
+	http.ResponseWriter
+	code        int
+	written     int64
+	wroteHeader bool
+	err         error
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w, code: http.StatusOK}
+}
+
+func (w *Recorder) Code() int {
+	return w.code
+}
+
+func (w *Recorder) Written() int64 {
+	return w.written
+}
+
+// Err is the first error writing the body, e.g. when the client went away.
+func (w *Recorder) Err() error {
+	return w.err
+}
+
+func (w *Recorder) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *Recorder) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *Recorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		w.fail(err)
+	}
+	return n, err
+}
+
+func (w *Recorder) ReadFrom(r io.Reader) (int64, error) {
+	w.wroteHeader = true
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.written += n
+	if err != nil {
+		w.fail(err)
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush event streams.
+func (w *Recorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
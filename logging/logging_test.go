@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func code(message string) string {
+	if strings.HasPrefix(message, "Served %s") {
+		return "TST00001"
+	}
+	return ""
+}
+
+func records(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var recs []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		rec := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &rec), line)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	assert.Error(t, Setup(&bytes.Buffer{}, "xml", "info", code))
+	assert.Error(t, Setup(&bytes.Buffer{}, "json", "loud", code))
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, Setup(out, "json", "warn", code))
+	Info(context.Background(), "Served %s.", "cache.bin")
+	Warn(context.Background(), "Served %s.", "cache.bin")
+	recs := records(t, out)
+	assert.Len(t, recs, 1)
+	assert.Equal(t, "WARN", recs[0]["level"])
+	assert.Equal(t, "Served cache.bin.", recs[0]["msg"])
+	assert.Equal(t, "TST00001", recs[0]["code"])
+}
+
+func TestRequests(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	out := &bytes.Buffer{}
+	// The access record is there at the default level.
+	assert.NoError(t, Setup(out, "json", "info", code))
+	handler := Requests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Annotate(r.Context(), slog.String("object", "cache.bin"))
+		Info(r.Context(), "Served %s.", "cache.bin")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), "X-Request-Id")
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+		Subject: pkix.Name{CommonName: "666", Locality: []string{"999"}},
+	}}}}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "abc-123", rec.Header().Get("X-Request-Id"))
+
+	recs := records(t, out)
+	assert.Len(t, recs, 2)
+	for _, r := range recs {
+		assert.Equal(t, "abc-123", r["request_id"])
+		assert.Equal(t, "666", r["client_id"])
+		assert.Equal(t, "999", r["customer"])
+		assert.Equal(t, "cache.bin", r["object"])
+	}
+	assert.Equal(t, "TST00001", recs[0]["code"])
+	assert.Equal(t, "Request served.", recs[1]["msg"])
+	assert.Equal(t, "INFO", recs[1]["level"])
+	assert.Equal(t, float64(http.StatusCreated), recs[1]["status"])
+	assert.Equal(t, float64(5), recs[1]["bytes"])
+	assert.Contains(t, recs[1], "duration")
+
+	// IDs clients should not put in logs are replaced.
+	req.Header.Set("X-Request-Id", "a b\nc")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Regexp(t, "^[0-9a-f]{16}$", rec.Header().Get("X-Request-Id"))
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	MediaTypeJSON = "application/json"
+	MediaTypeCBOR = "application/cbor"
+)
+
+// versionMarker stands in for the version in a data file template, so the template can be split
+// into the parts before and after the version.
+const versionMarker = "\x00"
+
+// Manifest lists all files a client may download. Clients compare ETags of the entries
+// with what they have and download only the files that changed.
+type Manifest struct {
+	ClientID int64   `json:"client_id"`
+	Files    []Entry `json:"files"`
+}
+
+// Entry describes a file generation as it is served, i.e. the ETag is the identity ETag
+// and the digest and signature are of the identity representation.
+type Entry struct {
+	// Empty for the resolver cache.
+	Resource string `json:"resource,omitempty"`
+	URL      string `json:"url"`
+	// Value for the version request header, empty for the unversioned file.
+	Version   string    `json:"version,omitempty"`
+	Size      int64     `json:"size"`
+	ETag      string    `json:"etag"`
+	Digest    string    `json:"digest,omitempty"`
+	Modified  time.Time `json:"modified"`
+	Signature string    `json:"signature,omitempty"`
+	// The unversioned file is the current one, i.e. served without the version request header.
+	Current bool `json:"current,omitempty"`
+	// Fallback level of the file if fallbacks are configured.
+	Level string `json:"level,omitempty"`
+}
+
+// Versions lists the versions of a resource visible to a client.
+type Versions struct {
+	ClientID int64   `json:"client_id"`
+	Resource string  `json:"resource,omitempty"`
+	URL      string  `json:"url"`
+	Versions []Entry `json:"versions"`
+}
+
+// Sort orders entries by URL and version.
+func Sort(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL != entries[j].URL {
+			return entries[i].URL < entries[j].URL
+		}
+		return entries[i].Version < entries[j].Version
+	})
+}
+
+// Visible applies the version policy: only versions matching the pattern are listed, at most max
+// newest of them if max is positive. The current (unversioned) entry is always visible.
+func Visible(entries []Entry, pattern *regexp.Regexp, max int) []Entry {
+	versioned := make([]Entry, 0, len(entries))
+	visible := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry.Version) == 0 {
+			visible = append(visible, entry)
+		} else if pattern == nil || pattern.MatchString(entry.Version) {
+			versioned = append(versioned, entry)
+		}
+	}
+	sort.SliceStable(versioned, func(i, j int) bool { return versioned[i].Modified.After(versioned[j].Modified) })
+	if max > 0 && len(versioned) > max {
+		versioned = versioned[:max]
+	}
+	visible = append(visible, versioned...)
+	Sort(visible)
+	return visible
+}
+
+// Encode serializes a Manifest or Versions in the media type. The ETag is derived from the serialized document.
+func Encode(document interface{}, mediaType string) ([]byte, string, error) {
+	var body []byte
+	var err error
+	switch mediaType {
+	case MediaTypeJSON:
+		body, err = json.Marshal(document)
+	case MediaTypeCBOR:
+		body, err = cbor.Marshal(document)
+	default:
+		err = fmt.Errorf("unsupported manifest media type %s", mediaType)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(body)
+	return body, "\"" + hex.EncodeToString(sum[:16]) + "\"", nil
+}
+
+// SplitTemplate formats the data file template with the version left out and returns
+// the parts of the file name before and after the version.
+func SplitTemplate(template string, args ...interface{}) (string, string) {
+	prefix, suffix, _ := strings.Cut(fmt.Sprintf(template, append(args, versionMarker)...), versionMarker)
+	return prefix, suffix
+}
+
+// VersionOf tells the version of a file name made by the data file template, see SplitTemplate.
+// Versions are appended as "_<version>" by the server.
+func VersionOf(name, prefix, suffix string) (string, bool) {
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	version := name[len(prefix) : len(name)-len(suffix)]
+	if len(version) == 0 {
+		return "", true
+	}
+	if len(version) < 2 || version[0] != '_' || strings.ContainsAny(version, "/") {
+		return "", false
+	}
+	return version[1:], true
+}
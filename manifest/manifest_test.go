@@ -0,0 +1,91 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package manifest
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionOf(t *testing.T) {
+	prefix, suffix := SplitTemplate("%s/%s_resolver_cache%s.bin", "test-data", "666")
+	assert.Equal(t, "test-data/666_resolver_cache", prefix)
+	assert.Equal(t, ".bin", suffix)
+	for name, expected := range map[string]string{
+		"test-data/666_resolver_cache.bin":    "",
+		"test-data/666_resolver_cache_v3.bin": "v3",
+	} {
+		version, ok := VersionOf(name, prefix, suffix)
+		assert.True(t, ok, name)
+		assert.Equal(t, expected, version)
+	}
+	for _, name := range []string{
+		"test-data/666_resolver_cache.bin.md5",
+		"test-data/666_resolver_cachev3.bin",
+		"test-data/666_resolver_cache_.bin",
+		"test-data/6666_resolver_cache.bin",
+	} {
+		_, ok := VersionOf(name, prefix, suffix)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	m := Manifest{ClientID: 666, Files: []Entry{
+		{URL: "/files/", Version: "v3", Size: 2, ETag: "\"b\"", Modified: time.Unix(0, 0).UTC()},
+		{URL: "/files/", Size: 1, ETag: "\"a\"", Modified: time.Unix(0, 0).UTC()},
+	}}
+	Sort(m.Files)
+	body, etag, err := Encode(m, MediaTypeJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"client_id":666,"files":[`+
+		`{"url":"/files/","size":1,"etag":"\"a\"","modified":"1970-01-01T00:00:00Z"},`+
+		`{"url":"/files/","version":"v3","size":2,"etag":"\"b\"","modified":"1970-01-01T00:00:00Z"}]}`, string(body))
+	_, sameETag, _ := Encode(m, MediaTypeJSON)
+	assert.Equal(t, etag, sameETag)
+
+	body, cborETag, err := Encode(m, MediaTypeCBOR)
+	assert.NoError(t, err)
+	assert.NotEqual(t, etag, cborETag)
+	var decoded Manifest
+	assert.NoError(t, cbor.Unmarshal(body, &decoded))
+	assert.Equal(t, m.ClientID, decoded.ClientID)
+	assert.Equal(t, "v3", decoded.Files[1].Version)
+}
+
+func TestVisible(t *testing.T) {
+	entries := []Entry{
+		{Version: "", Current: true},
+		{Version: "v1", Modified: time.Unix(1, 0)},
+		{Version: "v2", Modified: time.Unix(2, 0)},
+		{Version: "v3", Modified: time.Unix(3, 0)},
+		{Version: "beta", Modified: time.Unix(4, 0)},
+	}
+	versions := func(entries []Entry) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Version)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"", "beta", "v1", "v2", "v3"}, versions(Visible(entries, nil, 0)))
+	assert.Equal(t, []string{"", "v2", "v3"}, versions(Visible(entries, regexp.MustCompile(`^v\d+$`), 2)))
+}
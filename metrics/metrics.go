@@ -0,0 +1,221 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package metrics
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+const namespace = "serve_file"
+
+// Metrics collects Prometheus metrics of the server. Labels are bounded: endpoints, HTTP status codes,
+// RSP codes, S3 backends and operations. Resolver IDs are labels only if METRICS_PER_RESOLVER is true.
+// All methods are no-ops on a nil *Metrics, so that callers need not check whether metrics are enabled.
+type Metrics struct {
+	errorHeader string
+	registry    *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	resolverRequests *prometheus.CounterVec
+	bytes            *prometheus.CounterVec
+	duration         *prometheus.HistogramVec
+	s3Duration       *prometheus.HistogramVec
+	s3Errors         *prometheus.CounterVec
+	revocation       *prometheus.HistogramVec
+	handshakeErrors  *prometheus.CounterVec
+	connections      prometheus.Gauge
+}
+
+func New(settings *config.Settings) *Metrics {
+	m := &Metrics{
+		errorHeader: settings.API_RSP_ERROR_HEADER,
+		registry:    prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests by endpoint, HTTP status code and RSP error code.",
+		}, []string{"endpoint", "code", "error"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_bytes_total",
+			Help:      "Bytes of response bodies by endpoint.",
+		}, []string{"endpoint"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time to serve requests by endpoint and HTTP status code.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"endpoint", "code"}),
+		s3Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "s3_request_duration_seconds",
+			Help:      "Latency of S3 operations by backend.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation"}),
+		s3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "s3_errors_total",
+			Help:      "Failed S3 operations by backend. Missing and not modified objects are not failures.",
+		}, []string{"backend", "operation"}),
+		revocation: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "revocation_check_duration_seconds",
+			Help:      "Latency of client certificate revocation checks by method (crl, ocsp) and result (good, revoked, error).",
+			Buckets:   []float64{.0001, .001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"method", "result"}),
+		handshakeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_handshake_errors_total",
+			Help:      "Failed TLS handshakes by reason.",
+		}, []string{"reason"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections",
+			Help:      "Open client connections.",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.bytes, m.duration, m.s3Duration, m.s3Errors, m.revocation,
+		m.handshakeErrors, m.connections, collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if settings.METRICS_PER_RESOLVER {
+		m.resolverRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "resolver_requests_total",
+			Help:      "Requests by client certificate CommonName and endpoint.",
+		}, []string{"resolver", "endpoint"})
+		m.registry.MustRegister(m.resolverRequests)
+	}
+	return m
+}
+
+// Handler serves the metrics for scraping.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Instrument counts requests, bytes and durations of the endpoint.
+func (m *Metrics) Instrument(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := logging.NewRecorder(w)
+		next(recorder, r)
+		code := strconv.Itoa(recorder.Code())
+		m.requests.WithLabelValues(endpoint, code, config.ResponseCode(recorder.Header().Get(m.errorHeader))).Inc()
+		m.bytes.WithLabelValues(endpoint).Add(float64(recorder.Written()))
+		m.duration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+		if m.resolverRequests != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			m.resolverRequests.WithLabelValues(r.TLS.VerifiedChains[0][0].Subject.CommonName, endpoint).Inc()
+		}
+	}
+}
+
+// S3Observer times operations of the S3 backend, see s3client.Observed.
+func (m *Metrics) S3Observer(backend string) func(operation string, took time.Duration, err error) {
+	return func(operation string, took time.Duration, err error) {
+		if m == nil {
+			return
+		}
+		m.s3Duration.WithLabelValues(backend, operation).Observe(took.Seconds())
+		if err != nil {
+			m.s3Errors.WithLabelValues(backend, operation).Inc()
+		}
+	}
+}
+
+// ObserveRevocation records a client certificate revocation check, method is crl or ocsp.
+func (m *Metrics) ObserveRevocation(method string, revoked, ok bool, took time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "good"
+	if !ok {
+		result = "error"
+	} else if revoked {
+		result = "revoked"
+	}
+	m.revocation.WithLabelValues(method, result).Observe(took.Seconds())
+}
+
+// ConnState counts open connections, see http.Server ConnState.
+func (m *Metrics) ConnState(_ net.Conn, state http.ConnState) {
+	if m == nil {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		m.connections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		m.connections.Dec()
+	}
+}
+
+// ErrorLog is the http.Server ErrorLog. It counts TLS handshake errors and logs everything as usual.
+// It is nil if metrics are disabled, i.e. the standard logger is used.
+func (m *Metrics) ErrorLog() *log.Logger {
+	if m == nil {
+		return nil
+	}
+	return log.New(&errorLog{metrics: m}, "", 0)
+}
+
+// Reasons of TLS handshake errors by a part of the error message, the first match wins.
+var handshakeReasons = []struct{ match, reason string }{
+	{"didn't provide a certificate", "no_client_certificate"},
+	{"failed to verify certificate", "bad_client_certificate"},
+	{"x509:", "bad_client_certificate"},
+	{"remote error", "remote_alert"},
+	{"protocol version", "protocol_version"},
+	{"cipher", "no_shared_cipher"},
+	{"does not look like a TLS handshake", "not_tls"},
+	{"timeout", "timeout"},
+	{"EOF", "eof"},
+	{"connection reset", "eof"},
+}
+
+type errorLog struct {
+	metrics *Metrics
+}
+
+func (e *errorLog) Write(p []byte) (int, error) {
+	if _, message, found := bytes.Cut(p, []byte("TLS handshake error")); found {
+		reason := "other"
+		for _, r := range handshakeReasons {
+			if bytes.Contains(message, []byte(r.match)) {
+				reason = r.reason
+				break
+			}
+		}
+		e.metrics.handshakeErrors.WithLabelValues(reason).Inc()
+	}
+	log.Print(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
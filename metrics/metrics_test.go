@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/config"
+)
+
+func TestInstrument(t *testing.T) {
+	m := New(&config.Settings{API_RSP_ERROR_HEADER: "X-Error"})
+	handler := m.Instrument("download", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.Header().Set("X-Error", config.RSP00015)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("resolver cache"))
+	})
+	for _, path := range []string{"/", "/", "/missing"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues("download", "200", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("download", "404", "RSP00015")))
+	assert.Equal(t, 28.0, testutil.ToFloat64(m.bytes.WithLabelValues("download")))
+
+	var nothing *Metrics
+	assert.NotNil(t, nothing.Instrument("download", handler))
+	assert.Nil(t, nothing.ErrorLog())
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	m := New(&config.Settings{})
+	m.ErrorLog().Printf("http: TLS handshake error from 127.0.0.1:4242: tls: client didn't provide a certificate")
+	m.ErrorLog().Printf("http: TLS handshake error from 127.0.0.1:4242: EOF")
+	m.ErrorLog().Printf("http: TLS handshake error from 127.0.0.1:4242: something new")
+	m.ErrorLog().Printf("http: superfluous response.WriteHeader call")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.handshakeErrors.WithLabelValues("no_client_certificate")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.handshakeErrors.WithLabelValues("eof")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.handshakeErrors.WithLabelValues("other")))
+	count, err := testutil.GatherAndCount(m.registry, "serve_file_tls_handshake_errors_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
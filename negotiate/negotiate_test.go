@@ -0,0 +1,32 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package negotiate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccepts(t *testing.T) {
+	mediaType := "application/vnd.whalebone.zstd-patch"
+	assert.True(t, Accepts("application/octet-stream, application/vnd.whalebone.zstd-patch", mediaType))
+	assert.True(t, Accepts("Application/Vnd.Whalebone.Zstd-Patch;q=0.5", mediaType))
+	assert.False(t, Accepts("application/vnd.whalebone.zstd-patch;q=0", mediaType))
+	assert.False(t, Accepts("*/*", mediaType))
+	assert.False(t, Accepts("", mediaType))
+}
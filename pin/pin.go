@@ -0,0 +1,170 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package pin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"whalebone.io/serve-file/filecache"
+)
+
+// Pin forces resolvers, customers or everyone onto a version of a resource, whatever version they ask for.
+// If Generation is set, the generation with that ETag is served instead of the current file of the version,
+// e.g. to roll back a bad generation. A generation is one file, so only a single resolver can be pinned to it.
+// If AsOf is set, each client gets the generation of its own file that was published at that time.
+type Pin struct {
+	ID       string `json:"id"`
+	Resource string `json:"resource"`
+	// Targets, resolver CommonNames, customer Localities or everyone.
+	Resolvers []string `json:"resolvers,omitempty"`
+	Customers []string `json:"customers,omitempty"`
+	All       bool     `json:"all,omitempty"`
+	// Empty for the unversioned file.
+	Version    string     `json:"version,omitempty"`
+	Generation string     `json:"generation,omitempty"`
+	AsOf       *time.Time `json:"as_of,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+var (
+	ErrNoTarget         = errors.New("pin has no resolvers, customers or all")
+	ErrGenerationTarget = errors.New("generation is a file of one resolver, pin others with as_of")
+	ErrGenerationAsOf   = errors.New("pin has both generation and as_of")
+)
+
+// Table keeps pins in a JSON file, so they survive restarts.
+type Table struct {
+	mutex sync.RWMutex
+	path  string
+	pins  []Pin
+}
+
+// Open loads pins from the file. A missing file is an empty table.
+func Open(path string) (*Table, error) {
+	t := &Table{path: path}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return t, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &t.pins); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Table) List() []Pin {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return append([]Pin{}, t.pins...)
+}
+
+// Validate tells whether the pin can be applied to its targets.
+func (p Pin) Validate() error {
+	switch {
+	case len(p.Resolvers) == 0 && len(p.Customers) == 0 && !p.All:
+		return ErrNoTarget
+	case len(p.Generation) > 0 && p.AsOf != nil:
+		return ErrGenerationAsOf
+	case len(p.Generation) > 0 && (len(p.Resolvers) != 1 || len(p.Customers) > 0 || p.All):
+		return ErrGenerationTarget
+	}
+	return nil
+}
+
+// Add stores the pin with a new ID.
+func (t *Table) Add(p Pin) (Pin, error) {
+	if err := p.Validate(); err != nil {
+		return Pin{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Pin{}, err
+	}
+	p.ID = hex.EncodeToString(id)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.store(append(append([]Pin{}, t.pins...), p)); err != nil {
+		return Pin{}, err
+	}
+	return p, nil
+}
+
+// Remove deletes the pin. It tells whether there was such a pin.
+func (t *Table) Remove(id string) (Pin, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, p := range t.pins {
+		if p.ID == id {
+			pins := append(append([]Pin{}, t.pins[:i]...), t.pins[i+1:]...)
+			return p, true, t.store(pins)
+		}
+	}
+	return Pin{}, false, nil
+}
+
+// Find returns the pin applicable to the resolver. Pins of the resolver take precedence over pins
+// of its customer and those over pins of everyone. The latest pin wins on the same level.
+func (t *Table) Find(resource, resolverID, customerID string) (Pin, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, matches := range []func(p Pin) bool{
+		func(p Pin) bool { return contains(p.Resolvers, resolverID) },
+		func(p Pin) bool { return contains(p.Customers, customerID) },
+		func(p Pin) bool { return p.All },
+	} {
+		for i := len(t.pins) - 1; i >= 0; i-- {
+			if t.pins[i].Resource == resource && matches(t.pins[i]) {
+				return t.pins[i], true
+			}
+		}
+	}
+	return Pin{}, false
+}
+
+func (t *Table) store(pins []Pin) error {
+	err := filecache.WriteAtomically(t.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(pins)
+	})
+	if err != nil {
+		return err
+	}
+	t.pins = pins
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package pin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	table, err := Open(t.TempDir() + "/pins.json")
+	assert.NoError(t, err)
+	_, err = table.Add(Pin{Version: "v1"})
+	assert.ErrorIs(t, err, ErrNoTarget)
+	_, err = table.Add(Pin{All: true, Generation: "\"good\""})
+	assert.ErrorIs(t, err, ErrGenerationTarget)
+	_, err = table.Add(Pin{Resolvers: []string{"666", "777"}, Generation: "\"good\""})
+	assert.ErrorIs(t, err, ErrGenerationTarget)
+	asOf := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = table.Add(Pin{Resolvers: []string{"666"}, Generation: "\"good\"", AsOf: &asOf})
+	assert.ErrorIs(t, err, ErrGenerationAsOf)
+	everyone, err := table.Add(Pin{All: true, AsOf: &asOf})
+	assert.NoError(t, err)
+	customer, err := table.Add(Pin{Customers: []string{"999"}, Version: "v1"})
+	assert.NoError(t, err)
+	resolver, err := table.Add(Pin{Resolvers: []string{"666"}, Version: "v2"})
+	assert.NoError(t, err)
+	_, err = table.Add(Pin{Resource: "geoip", All: true, Version: "v3"})
+	assert.NoError(t, err)
+
+	found, ok := table.Find("", "666", "999")
+	assert.True(t, ok)
+	assert.Equal(t, resolver, found)
+	found, _ = table.Find("", "777", "999")
+	assert.Equal(t, customer, found)
+	found, _ = table.Find("", "10001", "1000042")
+	assert.Equal(t, everyone, found)
+	found, _ = table.Find("geoip", "666", "999")
+	assert.Equal(t, "v3", found.Version)
+	_, ok = table.Find("config", "666", "999")
+	assert.False(t, ok)
+}
+
+func TestRemove(t *testing.T) {
+	path := t.TempDir() + "/pins.json"
+	table, err := Open(path)
+	assert.NoError(t, err)
+	added, err := table.Add(Pin{Resolvers: []string{"666"}, Version: "v2", CreatedBy: "admin"})
+	assert.NoError(t, err)
+
+	reopened, err := Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Pin{added}, reopened.List())
+	removed, ok, err := reopened.Remove(added.ID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, added, removed)
+	_, ok, _ = reopened.Remove(added.ID)
+	assert.False(t, ok)
+
+	reopened, err = Open(path)
+	assert.NoError(t, err)
+	assert.Empty(t, reopened.List())
+}
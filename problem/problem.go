@@ -0,0 +1,151 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package problem tells errors as RFC 9457 problem details to clients that accept application/problem+json.
+// Others get the error header with an empty body as ever.
+package problem
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/negotiate"
+)
+
+const MediaType = "application/problem+json"
+
+// Details of an error, https://www.rfc-editor.org/rfc/rfc9457. Code is the stable RSP code of the error header
+// message, "unknown" if it is not one. RetryAfter is in seconds, the same as the Retry-After header.
+type Details struct {
+	Type       string `json:"type"`
+	Title      string `json:"title,omitempty"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Code       string `json:"code"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// Errors writes problem details for responses with the API_RSP_ERROR_HEADER set and an error status. Errors with
+// API_RSP_TRY_LATER_HTTP_CODE, 429 or 503, or with a Retry-After, are retryable. Those without a Retry-After get
+// one of API_RSP_RETRY_AFTER_S. The request ID is that of logging.Requests, so Errors goes inside it.
+func Errors(settings *config.Settings, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !negotiate.Accepts(r.Header.Get("Accept"), MediaType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&writer{ResponseWriter: w, r: r, settings: settings}, r)
+	})
+}
+
+// writer replaces the body of an error with problem details. Whatever the handler writes after is dropped.
+type writer struct {
+	http.ResponseWriter
+	r           *http.Request
+	settings    *config.Settings
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *writer) WriteHeader(code int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	message := w.Header().Get(w.settings.API_RSP_ERROR_HEADER)
+	if code < http.StatusBadRequest || len(message) == 0 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	details := Details{
+		Type:      "about:blank",
+		Title:     http.StatusText(code),
+		Status:    code,
+		Detail:    message,
+		Code:      config.ResponseCode(message),
+		RequestID: logging.Field(w.r.Context(), "request_id"),
+	}
+	if retryAfter := w.Header().Get("Retry-After"); len(retryAfter) > 0 {
+		details.Retryable, details.RetryAfter = true, seconds(retryAfter)
+	} else if code == w.settings.API_RSP_TRY_LATER_HTTP_CODE || code == http.StatusTooManyRequests ||
+		code == http.StatusServiceUnavailable {
+		details.Retryable, details.RetryAfter = true, w.settings.API_RSP_RETRY_AFTER_S
+		w.Header().Set("Retry-After", strconv.Itoa(details.RetryAfter))
+	}
+	body, err := json.Marshal(details)
+	if err != nil {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.replaced = true
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", MediaType)
+	w.Header().Add("Vary", "Accept")
+	w.ResponseWriter.WriteHeader(code)
+	if w.r.Method != http.MethodHead {
+		w.ResponseWriter.Write(body)
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps sendfile working for http.ServeFile, see logging.Recorder.
+func (w *writer) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return io.Copy(io.Discard, r)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush event streams.
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// seconds tells the seconds of a Retry-After, either a number of seconds or a date.
+func seconds(retryAfter string) int {
+	if s, err := strconv.Atoi(retryAfter); err == nil {
+		return s
+	}
+	if at, err := http.ParseTime(retryAfter); err == nil {
+		return int(math.Max(0, math.Ceil(time.Until(at).Seconds())))
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+func TestErrors(t *testing.T) {
+	settings := &config.Settings{
+		API_RSP_ERROR_HEADER:        "X-Error",
+		API_RSP_TRY_LATER_HTTP_CODE: 466,
+		API_RSP_RETRY_AFTER_S:       60,
+		LOG_REQUEST_ID_HEADER:       "X-Request-Id",
+	}
+	handler := logging.Requests(Errors(settings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/later":
+			w.Header().Set("X-Error", config.RSP00008)
+			w.WriteHeader(466)
+		case "/embargo":
+			w.Header().Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			w.Header().Set("X-Error", config.RSP00010)
+			w.WriteHeader(466)
+		case "/missing":
+			w.Header().Set("X-Error", config.RSP00015)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("dropped"))
+		default:
+			w.Write([]byte("resolver cache"))
+		}
+	})), settings.LOG_REQUEST_ID_HEADER)
+	serve := func(path, accept string) (*httptest.ResponseRecorder, Details) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Request-Id", "9f86d081884c7d65")
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, req)
+		var details Details
+		json.Unmarshal(rsp.Body.Bytes(), &details)
+		return rsp, details
+	}
+
+	rsp, details := serve("/later", MediaType)
+	assert.Equal(t, 466, rsp.Code)
+	assert.Equal(t, MediaType, rsp.Header().Get("Content-Type"))
+	assert.Equal(t, config.RSP00008, rsp.Header().Get("X-Error"))
+	assert.Equal(t, "60", rsp.Header().Get("Retry-After"))
+	assert.Equal(t, Details{Type: "about:blank", Status: 466, Detail: config.RSP00008, Code: "RSP00008",
+		Retryable: true, RetryAfter: 60, RequestID: "9f86d081884c7d65"}, details)
+
+	rsp, details = serve("/embargo", "application/json, "+MediaType)
+	assert.True(t, details.Retryable)
+	assert.InDelta(t, 3600, details.RetryAfter, 5)
+	assert.Contains(t, rsp.Header().Get("Retry-After"), "GMT")
+
+	rsp, details = serve("/missing", MediaType)
+	assert.Equal(t, http.StatusNotFound, rsp.Code)
+	assert.Equal(t, "Not Found", details.Title)
+	assert.Equal(t, "RSP00015", details.Code)
+	assert.False(t, details.Retryable)
+	assert.NotContains(t, rsp.Body.String(), "dropped")
+
+	// The legacy behaviour stays the default.
+	rsp, _ = serve("/later", "*/*")
+	assert.Equal(t, 466, rsp.Code)
+	assert.Empty(t, rsp.Body.String())
+	assert.Empty(t, rsp.Header().Get("Retry-After"))
+	rsp, _ = serve("/later", MediaType+";q=0")
+	assert.Empty(t, rsp.Body.String())
+
+	rsp, _ = serve("/", MediaType)
+	assert.Equal(t, http.StatusOK, rsp.Code)
+	assert.Equal(t, "resolver cache", rsp.Body.String())
+}
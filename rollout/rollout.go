@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rollout
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Rollout serves a version of a resource to some resolvers instead of the current file.
+// A resolver gets the version if it is listed in Resolvers, its customer is listed in Customers
+// or it falls in the Percent of resolvers picked by a hash of its ID. The rollout applies
+// from From until Until, if set.
+type Rollout struct {
+	// Empty for the resolver cache.
+	Resource  string    `json:"resource"`
+	Version   string    `json:"version"`
+	Percent   float64   `json:"percent"`
+	Resolvers []string  `json:"resolvers"`
+	Customers []string  `json:"customers"`
+	From      time.Time `json:"from"`
+	Until     time.Time `json:"until"`
+}
+
+// Policy lists rollouts, the first one applicable to the resolver wins.
+type Policy struct {
+	Rollouts []Rollout `json:"rollouts"`
+}
+
+// Load reads the policy file, e.g.
+//
+//	{"rollouts": [{"resource": "geoip", "version": "v4", "percent": 10, "customers": ["999"], "from": "2024-06-01T00:00:00Z"}]}
+func Load(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, err
+	}
+	for i, rollout := range policy.Rollouts {
+		if len(rollout.Version) == 0 {
+			return nil, fmt.Errorf("rollout %d has no version", i)
+		}
+		if rollout.Percent < 0 || rollout.Percent > 100 {
+			return nil, fmt.Errorf("rollout %d has percent %v out of 0-100", i, rollout.Percent)
+		}
+	}
+	return &policy, nil
+}
+
+// Version tells the version of the resource the resolver gets, empty for the current file.
+func (p *Policy) Version(resource, resolverID, customerID string, now time.Time) string {
+	for _, rollout := range p.Rollouts {
+		if rollout.Resource != resource || now.Before(rollout.From) || (!rollout.Until.IsZero() && !now.Before(rollout.Until)) {
+			continue
+		}
+		if contains(rollout.Resolvers, resolverID) || contains(rollout.Customers, customerID) ||
+			bucket(resource, rollout.Version, resolverID) < rollout.Percent {
+			return rollout.Version
+		}
+	}
+	return ""
+}
+
+// bucket places the resolver in 0-100 for the version. Raising the percent of a rollout
+// keeps the resolvers that have the version already.
+func bucket(resource, version, resolverID string) float64 {
+	sum := sha256.Sum256([]byte(resource + "\x00" + version + "\x00" + resolverID))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// File keeps the policy loaded from a file and reloads it when the file changes.
+// If the changed file is invalid, the previous policy is kept.
+type File struct {
+	path    string
+	policy  atomic.Pointer[Policy]
+	modTime time.Time
+}
+
+func NewFile(path string) (*File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{path: path, modTime: info.ModTime()}
+	f.policy.Store(policy)
+	return f, nil
+}
+
+func (f *File) Policy() *Policy {
+	return f.policy.Load()
+}
+
+// Reload loads the file again if it changed since the last load. It tells whether the policy changed.
+func (f *File) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+	policy, err := Load(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.modTime = info.ModTime()
+	f.policy.Store(policy)
+	return true, nil
+}
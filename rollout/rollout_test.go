@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rollout
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	launch := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	policy := &Policy{Rollouts: []Rollout{
+		{Resource: "geoip", Version: "v5", Resolvers: []string{"666"}, Until: launch},
+		{Resource: "geoip", Version: "v4", Customers: []string{"999"}},
+		{Resource: "", Version: "v2", Percent: 100, From: launch},
+	}}
+	before := launch.Add(-time.Hour)
+	assert.Equal(t, "v5", policy.Version("geoip", "666", "999", before))
+	assert.Equal(t, "v4", policy.Version("geoip", "666", "999", launch))
+	assert.Equal(t, "", policy.Version("geoip", "777", "1000", launch))
+	assert.Equal(t, "", policy.Version("", "777", "1000", before))
+	assert.Equal(t, "v2", policy.Version("", "777", "1000", launch))
+}
+
+func TestPercent(t *testing.T) {
+	ten := &Policy{Rollouts: []Rollout{{Version: "v2", Percent: 10}}}
+	fifty := &Policy{Rollouts: []Rollout{{Version: "v2", Percent: 50}}}
+	inTen, inFifty := 0, 0
+	for id := 0; id < 10000; id++ {
+		resolverID := fmt.Sprintf("%d", id)
+		if ten.Version("", resolverID, "", time.Now()) == "v2" {
+			inTen++
+			// Raising the percent keeps resolvers that have the version already.
+			assert.Equal(t, "v2", fifty.Version("", resolverID, "", time.Now()))
+		}
+		if fifty.Version("", resolverID, "", time.Now()) == "v2" {
+			inFifty++
+		}
+	}
+	assert.InDelta(t, 1000, inTen, 150)
+	assert.InDelta(t, 5000, inFifty, 300)
+}
+
+func TestReload(t *testing.T) {
+	path := t.TempDir() + "/rollout.json"
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rollouts": [{"version": "v2", "resolvers": ["666"]}]}`), 0o600))
+	f, err := NewFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", f.Policy().Version("", "666", "999", time.Now()))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rollouts": [{"version": "", "resolvers": ["666"]}]}`), 0o600))
+	modified := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modified, modified))
+	_, err = f.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "v2", f.Policy().Version("", "666", "999", time.Now()))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rollouts": [{"version": "v3", "customers": ["999"]}]}`), 0o600))
+	modified = modified.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modified, modified))
+	reloaded, err := f.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "v3", f.Policy().Version("", "666", "999", time.Now()))
+}
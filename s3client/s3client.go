@@ -3,14 +3,30 @@ package s3client
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/tracing"
 )
 
 type S3Client interface {
 	GetObjectWithContext(ctx context.Context, objectName string, opts minio.GetObjectOptions) (*minio.Object, error)
+	// StatObject takes ctx for tracing only, minio-go cannot cancel it.
+	StatObject(ctx context.Context, objectName string) (minio.ObjectInfo, error)
+	ListObjects(ctx context.Context, prefix string) ([]minio.ObjectInfo, error)
+	PutObjectWithContext(ctx context.Context, objectName string, reader io.Reader, size int64, opts minio.PutObjectOptions) (int64, error)
+	// Ping checks the bucket exists. Like StatObject, it cannot be cancelled.
+	Ping(ctx context.Context) error
+	// ReplaceMetadata copies the object onto itself with the metadata, if it still has the ETag.
+	// Like StatObject, it cannot be cancelled.
+	ReplaceMetadata(ctx context.Context, objectName, etag string, metadata map[string]string) error
 }
 
 type s3ClientImpl struct {
@@ -42,3 +58,171 @@ func New(endpoint, accessKey, secretKey, bucketName, dataFileTmpl string, unsecu
 func (c *s3ClientImpl) GetObjectWithContext(ctx context.Context, objectName string, opts minio.GetObjectOptions) (*minio.Object, error) {
 	return c.client.GetObjectWithContext(ctx, c.bucketName, objectName, opts)
 }
+
+func (c *s3ClientImpl) StatObject(_ context.Context, objectName string) (minio.ObjectInfo, error) {
+	return c.client.StatObject(c.bucketName, objectName, minio.StatObjectOptions{})
+}
+
+// ListObjects lists objects with the prefix, without user metadata.
+func (c *s3ClientImpl) ListObjects(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
+	done := make(chan struct{})
+	defer close(done)
+	var objects []minio.ObjectInfo
+	for object := range c.client.ListObjectsV2(c.bucketName, prefix, false, done) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, object)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+func (c *s3ClientImpl) Ping(_ context.Context) error {
+	exists, err := c.client.BucketExists(c.bucketName)
+	if err == nil && !exists {
+		err = fmt.Errorf("bucket %s does not exist", c.bucketName)
+	}
+	return err
+}
+
+func (c *s3ClientImpl) ReplaceMetadata(_ context.Context, objectName, etag string, metadata map[string]string) error {
+	src := minio.NewSourceInfo(c.bucketName, objectName, nil)
+	if err := src.SetMatchETagCond(etag); err != nil {
+		return err
+	}
+	dst, err := minio.NewDestinationInfo(c.bucketName, objectName, nil, metadata)
+	if err != nil {
+		return err
+	}
+	return c.client.CopyObject(dst, src)
+}
+
+func (c *s3ClientImpl) PutObjectWithContext(ctx context.Context, objectName string, reader io.Reader, size int64,
+	opts minio.PutObjectOptions) (int64, error) {
+	return c.client.PutObjectWithContext(ctx, c.bucketName, objectName, reader, size, opts)
+}
+
+// Observer is told how long an S3 operation took. err is nil for missing and not modified objects,
+// those are answers rather than failures.
+type Observer func(operation string, took time.Duration, err error)
+
+type observed struct {
+	S3Client
+	observer Observer
+}
+
+// Observed reports every operation of the client to the observer. Objects are requested right away,
+// instead of on the first read, so that the request can be timed. Errors are kept in the object.
+func Observed(client S3Client, observer Observer) S3Client {
+	return &observed{S3Client: client, observer: observer}
+}
+
+func (o *observed) observe(operation string, start time.Time, err error) {
+	if code := minio.ToErrorResponse(err).StatusCode; code == http.StatusNotFound || code == http.StatusNotModified {
+		err = nil
+	}
+	o.observer(operation, time.Since(start), err)
+}
+
+func (o *observed) GetObjectWithContext(ctx context.Context, objectName string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	start := time.Now()
+	object, err := o.S3Client.GetObjectWithContext(ctx, objectName, opts)
+	if err != nil {
+		o.observe("get", start, err)
+		return nil, err
+	}
+	_, statErr := object.Stat()
+	o.observe("get", start, statErr)
+	return object, nil
+}
+
+func (o *observed) StatObject(ctx context.Context, objectName string) (minio.ObjectInfo, error) {
+	start := time.Now()
+	info, err := o.S3Client.StatObject(ctx, objectName)
+	o.observe("stat", start, err)
+	return info, err
+}
+
+func (o *observed) ListObjects(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
+	start := time.Now()
+	objects, err := o.S3Client.ListObjects(ctx, prefix)
+	o.observe("list", start, err)
+	return objects, err
+}
+
+func (o *observed) PutObjectWithContext(ctx context.Context, objectName string, reader io.Reader, size int64,
+	opts minio.PutObjectOptions) (int64, error) {
+	start := time.Now()
+	n, err := o.S3Client.PutObjectWithContext(ctx, objectName, reader, size, opts)
+	o.observe("put", start, err)
+	return n, err
+}
+
+func (o *observed) ReplaceMetadata(ctx context.Context, objectName, etag string, metadata map[string]string) error {
+	start := time.Now()
+	err := o.S3Client.ReplaceMetadata(ctx, objectName, etag, metadata)
+	o.observe("copy", start, err)
+	return err
+}
+
+type traced struct {
+	S3Client
+}
+
+// Traced wraps every operation of the client in a span. Like Observed, objects are requested right away.
+func Traced(client S3Client) S3Client {
+	return &traced{S3Client: client}
+}
+
+// end ends the span, missing and not modified objects are not failures.
+func end(span trace.Span, err error) {
+	if code := minio.ToErrorResponse(err).StatusCode; code == http.StatusNotFound || code == http.StatusNotModified {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+		err = nil
+	}
+	tracing.End(span, err)
+}
+
+func (t *traced) GetObjectWithContext(ctx context.Context, objectName string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	ctx, span := tracing.Start(ctx, "s3.get", attribute.String("s3.key", objectName))
+	object, err := t.S3Client.GetObjectWithContext(ctx, objectName, opts)
+	if err != nil {
+		end(span, err)
+		return nil, err
+	}
+	_, statErr := object.Stat()
+	end(span, statErr)
+	return object, nil
+}
+
+func (t *traced) StatObject(ctx context.Context, objectName string) (minio.ObjectInfo, error) {
+	ctx, span := tracing.Start(ctx, "s3.stat", attribute.String("s3.key", objectName))
+	info, err := t.S3Client.StatObject(ctx, objectName)
+	end(span, err)
+	return info, err
+}
+
+func (t *traced) ListObjects(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
+	ctx, span := tracing.Start(ctx, "s3.list", attribute.String("s3.prefix", prefix))
+	objects, err := t.S3Client.ListObjects(ctx, prefix)
+	end(span, err)
+	return objects, err
+}
+
+func (t *traced) PutObjectWithContext(ctx context.Context, objectName string, reader io.Reader, size int64,
+	opts minio.PutObjectOptions) (int64, error) {
+	ctx, span := tracing.Start(ctx, "s3.put", attribute.String("s3.key", objectName))
+	n, err := t.S3Client.PutObjectWithContext(ctx, objectName, reader, size, opts)
+	end(span, err)
+	return n, err
+}
+
+func (t *traced) ReplaceMetadata(ctx context.Context, objectName, etag string, metadata map[string]string) error {
+	ctx, span := tracing.Start(ctx, "s3.copy", attribute.String("s3.key", objectName))
+	err := t.S3Client.ReplaceMetadata(ctx, objectName, etag, metadata)
+	end(span, err)
+	return err
+}
@@ -18,204 +18,591 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	minio "github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
 	"whalebone.io/serve-file/app"
+	"whalebone.io/serve-file/audit"
+	"whalebone.io/serve-file/certstore"
+	"whalebone.io/serve-file/compression"
 	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/delta"
+	"whalebone.io/serve-file/digest"
+	"whalebone.io/serve-file/envelope"
+	"whalebone.io/serve-file/health"
+	"whalebone.io/serve-file/lastseen"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/metrics"
+	"whalebone.io/serve-file/negotiate"
+	"whalebone.io/serve-file/pin"
+	"whalebone.io/serve-file/problem"
+	"whalebone.io/serve-file/rollout"
 	"whalebone.io/serve-file/s3client"
+	"whalebone.io/serve-file/signing"
+	"whalebone.io/serve-file/tracing"
 	"whalebone.io/serve-file/validation"
+	"whalebone.io/serve-file/watch"
+	"whalebone.io/serve-file/window"
 )
 
+// services are the optional parts of the server, nil when disabled in settings.
+type services struct {
+	generations *delta.Store
+	encoded     *compression.Cache
+	signer      *signing.Signer
+	encrypted   *envelope.Cache
+	digests     *digest.Cache
+	windows     *window.Cache
+	changes     *watch.Changes
+	waiting     watch.Slots
+	streams     watch.Slots
+	rollouts    *rollout.File
+	pins        *pin.Table
+	archive     *delta.Store
+	metrics     *metrics.Metrics
+	audit       *audit.Log
+	certs       *certstore.Store
+	seen        *lastseen.Tracker
+}
+
 //nolint:gocognit,cyclop
-func createServer(settings *config.Settings, s3main, s3cloud s3client.S3Client) *http.Server {
+func createServer(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) *http.Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc(settings.API_URL, func(w http.ResponseWriter, r *http.Request) {
+	// route instruments and audits the handler of an endpoint.
+	route := func(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+		return svc.audit.Audit(endpoint, svc.metrics.Instrument(endpoint, next))
+	}
+	// polled also keeps track of clients, see lastseen.Tracker.
+	polled := func(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+		return route(endpoint, svc.seen.Track(endpoint, next))
+	}
+	if svc.signer != nil {
+		keySet, err := svc.signer.KeySet()
+		if err != nil {
+			logging.Fatal(context.Background(), "%v", err)
+		}
+		mux.HandleFunc(settings.API_KEYS_URL, route("keys", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			w.Header().Set("Content-Type", "application/jwk-set+json")
+			w.Header().Set("Cache-Control", "max-age=300")
+			w.Write(keySet)
+		}))
+	}
+	mux.HandleFunc(settings.API_MANIFEST_URL, polled("manifest", manifestHandler(settings, s3main, s3cloud, svc)))
+	if svc.streams != nil {
+		mux.HandleFunc(settings.API_EVENTS_URL, polled("events", eventsHandler(settings, s3main, s3cloud, svc)))
+	}
+	versions := polled("versions", versionsHandler(settings, s3main, s3cloud, svc))
+	mux.HandleFunc(settings.API_VERSIONS_URL, versions)
+	if !strings.HasSuffix(settings.API_VERSIONS_URL, "/") {
+		mux.HandleFunc(settings.API_VERSIONS_URL+"/", versions)
+	}
+	if settings.PublishEnabled() {
+		mux.HandleFunc(settings.API_PUBLISH_URL, route("publish", publishHandler(settings, s3main, s3cloud, svc)))
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-		if r.TLS == nil {
-			log.Printf(config.RSL00001)
-			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00001)
-			w.WriteHeader(http.StatusForbidden)
+		idFromCert, ok := authenticate(w, r, settings, svc)
+		if !ok {
 			return
 		}
-		idFromCertStr := string(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		idFromCertStr := r.TLS.VerifiedChains[0][0].Subject.CommonName
 		clientIDFromCert := r.TLS.VerifiedChains[0][0].Subject.Locality[0]
-		var idFromCert int64
-		idFromCert, err := strconv.ParseInt(idFromCertStr, 10, 64)
-		if err != nil {
-			log.Printf(config.RSL00006)
-			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00006)
-			w.WriteHeader(http.StatusForbidden)
+
+		resourceName := strings.Trim(strings.TrimPrefix(r.URL.Path, settings.API_URL), "/")
+		res, exists := settings.Resources[resourceName]
+		if !exists {
+			logging.Warn(r.Context(), config.RSL00024, idFromCert, resourceName)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00015)
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if settings.CRL != nil && validation.CertIsRevokedCRL(r.TLS.VerifiedChains[0][0], settings.CRL) {
-			log.Printf(config.RSL00002, idFromCertStr)
-			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00002)
+		if !res.Allows(r.TLS.VerifiedChains[0][0]) {
+			logging.Warn(r.Context(), config.RSL00025, idFromCert, clientIDFromCert, resourceName)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00016)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-		if len(settings.OCSP_URL) > 0 {
-			if revoked, ok := validation.CertIsRevokedOCSP(r.TLS.VerifiedChains[0][0], settings.CACert, settings.OCSP_URL); !ok {
-				log.Printf(config.RSL00003, idFromCertStr, settings.OCSP_URL)
-				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00003)
-				w.WriteHeader(http.StatusServiceUnavailable)
-				return
-			} else if revoked {
-				log.Printf(config.RSL00004, idFromCertStr, settings.OCSP_URL)
-				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00004)
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
+		logging.Annotate(r.Context(), slog.String("resource", resourceName))
+
+		version := strings.Trim(r.Header.Get(settings.API_VERSION_REQ_HEADER), " ")
+		if len(version) > 0 {
+			logging.Annotate(r.Context(), slog.String("requested_version", version))
 		}
-		var idFromHeader int64
-		idFromHeader, err = strconv.ParseInt(
-			strings.Trim(r.Header.Get(settings.API_ID_REQ_HEADER), " "), 10, 64)
-		if err != nil {
-			log.Printf(config.RSL00005, idFromCertStr, settings.API_ID_REQ_HEADER)
-			w.Header().Set(settings.API_RSP_ERROR_HEADER,
-				fmt.Sprintf(config.RSP00005, settings.API_ID_REQ_HEADER))
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		if len(version) == 0 && svc.rollouts != nil {
+			// The version asked for by the client wins over the rollout policy.
+			version = svc.rollouts.Policy().Version(resourceName, idFromCertStr, clientIDFromCert, time.Now())
+			if len(version) > 0 {
+				w.Header().Set(settings.API_VERSION_REQ_HEADER, version)
+			}
 		}
-		if idFromCert != idFromHeader {
-			log.Printf(config.RSL00007, idFromCert, idFromHeader, settings.API_ID_REQ_HEADER)
-			w.Header().Set(settings.API_RSP_ERROR_HEADER,
-				fmt.Sprintf(config.RSP00007, idFromCert, idFromHeader, settings.API_ID_REQ_HEADER))
-			w.WriteHeader(http.StatusForbidden)
-			return
+		// Pins win over both, so that clients can be rolled back whatever they ask for.
+		var generation string
+		var pinnedAt time.Time
+		if svc.pins != nil {
+			if pinned, ok := svc.pins.Find(resourceName, idFromCertStr, clientIDFromCert); ok {
+				version = pinned.Version
+				generation = pinned.Generation
+				if pinned.AsOf != nil {
+					pinnedAt = *pinned.AsOf
+				}
+				w.Header().Del(settings.API_VERSION_REQ_HEADER)
+				if len(version) > 0 {
+					w.Header().Set(settings.API_VERSION_REQ_HEADER, version)
+				}
+			}
 		}
-
-		version := strings.Trim(r.Header.Get(settings.API_VERSION_REQ_HEADER), " ")
 		if len(version) > 0 {
 			version = fmt.Sprintf("_%s", version)
 		}
 
-		if settings.API_USE_S3 {
-			objectName := fmt.Sprintf(settings.S3_DATA_FILE_TEMPLATE, idFromCertStr, version)
+		var encoding string
+		if svc.encoded != nil && svc.encrypted == nil {
+			// https://www.rfc-editor.org/rfc/rfc9110#section-12.5.5
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding = compression.Negotiate(r.Header.Get("Accept-Encoding"), settings.ContentEncodings)
+		}
+
+		// Files of the resolver first, then the fallback levels.
+		levels := res.Levels(r.TLS.VerifiedChains[0][0])
+
+		// Long-poll: if the client has the current file, it is held until the file changes, see API_WAIT_MAX_S.
+		var deadline time.Time
+		var waiter *watch.Waiter
+		// Each pass of the long-poll replaces the waiter, the last one is stopped here.
+		defer func() {
+			if waiter != nil {
+				waiter.Stop()
+			}
+		}()
+		if svc.waiting != nil && len(generation) == 0 && pinnedAt.IsZero() && len(r.Header.Get("If-None-Match")) > 0 {
+			if wait, ok := watch.PreferredWait(r.Header.Get("Prefer")); ok && svc.waiting.Acquire() {
+				defer svc.waiting.Release()
+				if maxWait := time.Duration(settings.API_WAIT_MAX_S) * time.Second; wait > maxWait {
+					wait = maxWait
+				}
+				deadline = time.Now().Add(wait)
+				w.Header().Set("Preference-Applied", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+			}
+		}
 
-			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
-			defer cancel()
+		if settings.API_USE_S3 {
+			var ctx context.Context
+			var cancel context.CancelFunc
 			opts := minio.GetObjectOptions{}
 			// https://tools.ietf.org/html/rfc7232#section-3.2
-			etag := r.Header.Get("If-None-Match")
-			if etag != "" {
+			// Variants share the generation, S3 knows only the ETag of the original.
+			// A pinned generation is served whatever the current object is.
+			etag := compression.BaseETag(r.Header.Get("If-None-Match"))
+			if etag != "" && len(generation) == 0 && pinnedAt.IsZero() {
 				//opts.SetMatchETagExcept(etag) <-- this is buggy, it sets ""etag"" and get 403 from proper S3 server. Passes with MINIO backend though.
 				opts.Set("If-None-Match", etag)
 			}
 
+			s3 := s3For(settings, s3main, s3cloud, clientIDFromCert)
+			var objectName string
 			var object *minio.Object
-			var getErr error
-			cloudCustomer := settings.CLOUD_S3_CUSTOMER_ID == clientIDFromCert
-			if settings.UseCloudS3() && cloudCustomer {
-				object, getErr = s3cloud.GetObjectWithContext(ctx, objectName, opts)
-			} else {
-				object, getErr = s3main.GetObjectWithContext(ctx, objectName, opts)
-			}
-
-			if getErr != nil {
-				log.Printf(config.RSL00012, objectName, err.Error())
-				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+			var objectInfo minio.ObjectInfo
+			var level config.Level
+			var embargo time.Time
+			var err error
+			// Waiters are woken up when objects of any level change, see objectsVersion.
+			var keys []string
+			for _, level := range levels {
+				keys = append(keys, s3WatchKey(settings, clientIDFromCert, fmt.Sprintf(res.S3_DATA_FILE_TEMPLATE, level.Key, version)))
 			}
-			defer object.Close()
-			objectInfo, err := object.Stat()
-			if err != nil {
-				errResp := minio.ToErrorResponse(err)
-				if errResp.StatusCode == 404 {
-					log.Printf(config.RSL00010, objectName, idFromCert, r.TLS.VerifiedChains[0][0].Subject.String())
-					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00010)
-					w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
-					return
-				} else if errResp.StatusCode == 304 {
-					w.WriteHeader(http.StatusNotModified)
+			// Objects of levels and passes not served are released right away, the served one once it is sent.
+			release := func() {
+				if object != nil {
+					object.Close()
+					object = nil
+				}
+				if cancel != nil {
+					cancel()
+					cancel = nil
+				}
+			}
+			defer release()
+		poll:
+			for {
+				if !deadline.IsZero() {
+					if waiter != nil {
+						waiter.Stop()
+					}
+					waiter = svc.changes.Watch(keys...)
+				}
+				release()
+				timeout, stop := context.WithTimeout(context.Background(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+				ctx, cancel = timeout, stop
+				for _, level = range levels {
+					objectName = fmt.Sprintf(res.S3_DATA_FILE_TEMPLATE, level.Key, version)
+					if object != nil {
+						object.Close()
+					}
+					var getErr error
+					object, getErr = s3.GetObjectWithContext(ctx, objectName, opts)
+					if getErr != nil {
+						logging.Error(r.Context(), config.RSL00012, objectName, getErr.Error())
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					objectInfo, err = object.Stat()
+					if statusCode := minio.ToErrorResponse(err).StatusCode; err == nil || statusCode == 304 {
+						var win window.Window
+						var winErr error
+						if err == nil {
+							if win, winErr = objectWindow(objectInfo); winErr == nil {
+								svc.windows.Put(objectName+archivedETag(objectInfo.ETag), win)
+							}
+						} else {
+							// Not Modified carries no user metadata, the window of the generation is read once.
+							var statErr error
+							win, winErr = svc.windows.Get(objectName+archivedETag(etag), func() (window.Window, error) {
+								info, err := s3.StatObject(r.Context(), objectName)
+								if err != nil {
+									statErr = err
+									return window.Window{}, err
+								}
+								return objectWindow(info)
+							})
+							if statErr != nil {
+								err = statErr
+								if minio.ToErrorResponse(err).StatusCode == 404 {
+									continue
+								}
+								break
+							}
+						}
+						if checkWindow(r.Context(), win, winErr, objectName, &embargo) == nil {
+							break
+						}
+						// Objects outside their window are missing.
+						err = minio.ErrorResponse{StatusCode: 404}
+					} else if statusCode != 404 {
+						break
+					}
+				}
+				notifyAt(svc, keys, deadline, embargo)
+				if len(res.FALLBACK) > 0 {
+					w.Header().Set(settings.API_RSP_LEVEL_HEADER, level.Name)
+				}
+				if err != nil {
+					errResp := minio.ToErrorResponse(err)
+					if errResp.StatusCode == 404 {
+						logging.Warn(r.Context(), config.RSL00010, objectName, idFromCert, r.TLS.VerifiedChains[0][0].Subject.String())
+						setRetryAfter(w, embargo)
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00010)
+						w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+						return
+					} else if errResp.StatusCode == 304 {
+						if !deadline.IsZero() && watch.Wait(r.Context(), waiter.Changed(), deadline) {
+							continue poll
+						}
+						setCacheControl(w, res)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					} else if errResp.StatusCode == 0 {
+						logging.Error(r.Context(), config.RSL00013)
+						logging.Error(r.Context(), "%v", err)
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					} else {
+						logging.Error(r.Context(), config.RSL00011, objectName, idFromCert, errResp.Code, errResp.Message)
+						logging.Error(r.Context(), "%v", err)
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+				}
+				break
+			}
+			extendWriteDeadline(w, r, settings, deadline, idFromCert)
+			logging.Annotate(r.Context(), slog.String("object", objectName))
+			if !pinnedAt.IsZero() {
+				if generation, ok = pinnedGeneration(w, r, settings, svc, objectName, objectInfo.ETag,
+					objectInfo.LastModified, pinnedAt, idFromCert); !ok {
 					return
-				} else if errResp.StatusCode == 0 {
-					log.Printf(config.RSL00013)
-					log.Printf("%v", err)
+				}
+			}
+			// Pinned clients do not ask S3 for If-None-Match, the current object may be their generation anyway.
+			if len(generation) > 0 && !rollsBack(generation, objectInfo.ETag) &&
+				archivedETag(objectInfo.ETag) == archivedETag(compression.BaseETag(r.Header.Get("If-None-Match"))) {
+				w.Header().Set("ETag", compression.VariantETag(objectInfo.ETag, encoding))
+				setCacheControl(w, res)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// https://tools.ietf.org/html/rfc7232#section-2.3
+			w.Header().Set("ETag", compression.VariantETag(objectInfo.ETag, encoding))
+			setCacheControl(w, res)
+			if svc.signer != nil {
+				signature := objectInfo.Metadata.Get("X-Amz-Meta-" + settings.API_SIGNATURE_HEADER)
+				if len(signature) == 0 && svc.signer.CanSign() {
+					signature, err = svc.signer.Sign(objectName, objectInfo.ETag, object)
+					if err == nil {
+						_, err = object.Seek(0, io.SeekStart)
+					}
+					if err != nil {
+						logging.Error(r.Context(), config.RSL00020, objectName, idFromCert, err.Error())
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00012)
+						w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+						return
+					}
+				}
+				if len(signature) > 0 {
+					w.Header().Set(settings.API_SIGNATURE_HEADER, signature)
+				}
+			}
+			generationKey := res.GenerationKey(idFromCertStr + version)
+			if svc.generations != nil && !svc.generations.Has(generationKey, objectInfo.ETag) {
+				if err := svc.generations.Remember(generationKey, objectInfo.ETag, object); err != nil {
+					logging.Error(r.Context(), config.RSL00017, objectInfo.ETag, objectName, idFromCert, err.Error())
+				}
+				if _, err := object.Seek(0, io.SeekStart); err != nil {
+					logging.Error(r.Context(), config.RSL00012, objectName, err.Error())
 					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
-				} else {
-					log.Printf(config.RSL00011, objectName, idFromCert, errResp.Code, errResp.Message)
-					log.Printf("%v", err)
+				}
+			}
+			if svc.archive != nil && !svc.archive.Has(objectName, archivedETag(objectInfo.ETag)) {
+				if err := svc.archive.RememberAt(objectName, archivedETag(objectInfo.ETag), object, objectInfo.LastModified); err != nil {
+					logging.Error(r.Context(), config.RSL00039, objectInfo.ETag, objectName, err.Error())
+				}
+				if _, err := object.Seek(0, io.SeekStart); err != nil {
+					logging.Error(r.Context(), config.RSL00012, objectName, err.Error())
 					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
 			}
-			// https://tools.ietf.org/html/rfc7232#section-2.3
-			w.Header().Set("ETag", objectInfo.ETag)
 			// time.Time{} -- disables Modified since. We use ETag instead.
 			var timestamp int64
 			if settings.AUDIT_LOG_DOWNLOADS {
 				timestamp = time.Now().UnixNano()
-				log.Printf(config.RSL00015, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], objectName)
+				logging.Info(r.Context(), config.RSL00015, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], objectName)
+			}
+			sibling := func(ext string) (io.ReadSeekCloser, string) {
+				siblingObject, err := s3.GetObjectWithContext(ctx, objectName+ext, minio.GetObjectOptions{})
+				if err != nil {
+					return nil, ""
+				}
+				siblingInfo, err := siblingObject.Stat()
+				if err != nil || siblingInfo.LastModified.Before(objectInfo.LastModified) {
+					siblingObject.Close()
+					return nil, ""
+				}
+				return siblingObject, objectName + ext + siblingInfo.ETag
+			}
+			original := func() (io.ReadCloser, error) {
+				_, err := object.Seek(0, io.SeekStart)
+				return io.NopCloser(object), err
+			}
+			transferCtx, transfer := tracing.Start(r.Context(), "transfer", attribute.String("object", objectName))
+			r = r.WithContext(transferCtx)
+			if !servePinned(w, r, settings, svc, res, generation, objectInfo.ETag, objectName, idFromCert) &&
+				!serveEncrypted(w, r, settings, svc, objectInfo.ETag, objectName, idFromCert, original) &&
+				!serveDelta(w, r, settings, svc, generationKey, objectInfo.ETag, objectName, idFromCert) &&
+				!serveEncoded(w, r, svc, res, encoding, objectInfo.ETag, objectName, idFromCert, sibling, original) {
+				w.Header().Set("ETag", objectInfo.ETag)
+				setContentType(w, res)
+				published := objectInfo.Metadata.Get("X-Amz-Meta-Repr-Digest")
+				if len(published) == 0 && settings.API_STORE_DIGESTS {
+					published = objectDigests(r.Context(), settings, svc.digests, s3, objectName, objectInfo, object)
+				}
+				if err := setReprDigest(w, r, svc.digests, objectName+objectInfo.ETag, published, object); err != nil {
+					logging.Error(r.Context(), config.RSL00022, objectName, idFromCert, err.Error())
+				}
+				http.ServeContent(w, r, objectName, time.Time{}, object)
 			}
-			http.ServeContent(w, r, objectName, time.Time{}, object)
+			transfer.End()
 			if settings.AUDIT_LOG_DOWNLOADS {
-				log.Printf(config.RSL00016, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], objectName)
+				logging.Info(r.Context(), config.RSL00016, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], objectName)
 			}
 		} else {
-			pathToDataFile := fmt.Sprintf(
-				settings.API_DATA_FILE_TEMPLATE,
-				settings.API_FILE_DIR,
-				idFromCertStr,
-				version,
-			)
-			// We do not read the file in memory, just metadata to check it exists.
-			_, err = os.Stat(pathToDataFile)
-			if err != nil {
-				log.Printf(config.RSL00008, pathToDataFile, idFromCert, r.TLS.VerifiedChains[0][0].Subject.String())
-				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00008)
-				w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
-				return
+			var pathToDataFile string
+			var dataInfo os.FileInfo
+			var level config.Level
+			var embargo time.Time
+			var err error
+			var etag string
+			// Waiters are woken up when the data, hash or window file of any level changes.
+			var keys []string
+			for _, level := range levels {
+				path := fmt.Sprintf(res.DATA_FILE_TEMPLATE, settings.API_FILE_DIR, level.Key, version)
+				keys = append(keys, filepath.Clean(path), filepath.Clean(path+versionHashSuffix),
+					filepath.Clean(fmt.Sprintf(res.HASH_FILE_TEMPLATE, settings.API_FILE_DIR, level.Key)),
+					filepath.Clean(fmt.Sprintf(settings.API_WINDOW_FILE_TEMPLATE, path)))
 			}
-			pathToHashFile := fmt.Sprintf(
-				settings.API_HASH_FILE_TEMPLATE,
-				settings.API_FILE_DIR,
-				idFromCertStr,
-			)
-			// We do read the hash file at once, just 32 bytes...
-			hash, err := os.ReadFile(pathToHashFile)
-			if err != nil {
-				log.Printf(config.RSL00009, pathToHashFile, idFromCert, pathToDataFile)
-				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00009)
-				w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
-				return
+			for {
+				if !deadline.IsZero() {
+					if waiter != nil {
+						waiter.Stop()
+					}
+					waiter = svc.changes.Watch(keys...)
+				}
+				for _, level = range levels {
+					pathToDataFile = fmt.Sprintf(
+						res.DATA_FILE_TEMPLATE,
+						settings.API_FILE_DIR,
+						level.Key,
+						version,
+					)
+					// We do not read the file in memory, just metadata to check it exists.
+					_, stat := tracing.Start(r.Context(), "file.stat", attribute.String("file", pathToDataFile))
+					dataInfo, err = os.Stat(pathToDataFile)
+					stat.End()
+					if err == nil {
+						win, winErr := window.ReadFile(fmt.Sprintf(settings.API_WINDOW_FILE_TEMPLATE, pathToDataFile))
+						if err = checkWindow(r.Context(), win, winErr, pathToDataFile, &embargo); err == nil {
+							break
+						}
+					}
+				}
+				notifyAt(svc, keys, deadline, embargo)
+				if err != nil {
+					logging.Warn(r.Context(), config.RSL00008, pathToDataFile, idFromCert, r.TLS.VerifiedChains[0][0].Subject.String())
+					setRetryAfter(w, embargo)
+					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00008)
+					w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+					return
+				}
+				if len(res.FALLBACK) > 0 {
+					w.Header().Set(settings.API_RSP_LEVEL_HEADER, level.Name)
+				}
+				pathToHashFile := hashFilePath(settings, res, level.Key, version, pathToDataFile)
+				// We do read the hash file at once, just 32 bytes...
+				hash, err := os.ReadFile(pathToHashFile)
+				if err != nil {
+					logging.Warn(r.Context(), config.RSL00009, pathToHashFile, idFromCert, pathToDataFile)
+					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00009)
+					w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+					return
+				}
+				etag = "\"" + string(hash) + "\"" // Well, we know the size of byte[], do we really need all those extra allocs?
+				if deadline.IsZero() || etag != compression.BaseETag(r.Header.Get("If-None-Match")) ||
+					!watch.Wait(r.Context(), waiter.Changed(), deadline) {
+					break
+				}
+			}
+			extendWriteDeadline(w, r, settings, deadline, idFromCert)
+			logging.Annotate(r.Context(), slog.String("object", pathToDataFile))
+			if !pinnedAt.IsZero() {
+				if generation, ok = pinnedGeneration(w, r, settings, svc, pathToDataFile, etag, dataInfo.ModTime(), pinnedAt, idFromCert); !ok {
+					return
+				}
 			}
-			etag := "\"" + string(hash) + "\"" // Well, we know the size of byte[], do we really need all those extra allocs?
 			// https://tools.ietf.org/html/rfc7232#section-2.3
-			w.Header().Set("ETag", etag)
+			w.Header().Set("ETag", compression.VariantETag(etag, encoding))
+			setCacheControl(w, res)
 			// https://tools.ietf.org/html/rfc7232#section-3.2
-			if etag == r.Header.Get("If-None-Match") {
+			if etag == compression.BaseETag(r.Header.Get("If-None-Match")) && !rollsBack(generation, etag) {
 				w.WriteHeader(http.StatusNotModified)
 				return
 			}
+			if svc.signer != nil {
+				signature, err := fileSignature(svc.signer, settings, pathToDataFile, etag)
+				if err != nil {
+					logging.Error(r.Context(), config.RSL00020, pathToDataFile, idFromCert, err.Error())
+					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00012)
+					w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+					return
+				}
+				if len(signature) > 0 {
+					w.Header().Set(settings.API_SIGNATURE_HEADER, signature)
+				}
+			}
+			generationKey := res.GenerationKey(idFromCertStr + version)
+			if svc.generations != nil && !svc.generations.Has(generationKey, etag) {
+				if err := rememberFile(svc.generations, generationKey, etag, pathToDataFile); err != nil {
+					logging.Error(r.Context(), config.RSL00017, etag, pathToDataFile, idFromCert, err.Error())
+				}
+			}
+			if svc.archive != nil && !svc.archive.Has(pathToDataFile, archivedETag(etag)) {
+				if err := rememberFile(svc.archive, pathToDataFile, archivedETag(etag), pathToDataFile); err != nil {
+					logging.Error(r.Context(), config.RSL00039, etag, pathToDataFile, err.Error())
+				}
+			}
 			var timestamp int64
 			if settings.AUDIT_LOG_DOWNLOADS {
 				timestamp = time.Now().UnixNano()
-				log.Printf(config.RSL00015, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], pathToDataFile)
+				logging.Info(r.Context(), config.RSL00015, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], pathToDataFile)
+			}
+			sibling := func(ext string) (io.ReadSeekCloser, string) {
+				return freshSibling(pathToDataFile, ext)
+			}
+			original := func() (io.ReadCloser, error) {
+				return os.Open(pathToDataFile)
+			}
+			transferCtx, transfer := tracing.Start(r.Context(), "transfer", attribute.String("object", pathToDataFile))
+			r = r.WithContext(transferCtx)
+			if !servePinned(w, r, settings, svc, res, generation, etag, pathToDataFile, idFromCert) &&
+				!serveEncrypted(w, r, settings, svc, etag, pathToDataFile, idFromCert, original) &&
+				!serveDelta(w, r, settings, svc, generationKey, etag, pathToDataFile, idFromCert) &&
+				!serveEncoded(w, r, svc, res, encoding, etag, pathToDataFile, idFromCert, sibling, original) {
+				w.Header().Set("ETag", etag)
+				setContentType(w, res)
+				if err := setFileReprDigest(w, r, settings, svc.digests, pathToDataFile, etag); err != nil {
+					logging.Error(r.Context(), config.RSL00022, pathToDataFile, idFromCert, err.Error())
+				}
+				http.ServeFile(w, r, pathToDataFile)
 			}
-			http.ServeFile(w, r, pathToDataFile)
+			transfer.End()
 			if settings.AUDIT_LOG_DOWNLOADS {
-				log.Printf(config.RSL00016, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], pathToDataFile)
+				logging.Info(r.Context(), config.RSL00016, timestamp, idFromCert, r.TLS.VerifiedChains[0][0].Subject.Organization[0], pathToDataFile)
 			}
 		}
 		return
-	})
-	tlsCfg := &tls.Config{
+	}
+	download := polled("download", handler)
+	mux.HandleFunc(settings.API_URL, download)
+	if len(settings.Resources) > 1 && !strings.HasSuffix(settings.API_URL, "/") {
+		mux.HandleFunc(settings.API_URL+"/", download)
+	}
+	clientCAs, routes := settings.CACertPool, http.Handler(mux)
+	if settings.ProducerCACert != nil {
+		clientCAs = settings.CACertPool.Clone()
+		clientCAs.AddCert(settings.ProducerCACert)
+		routes = publishOnly(settings, mux)
+	}
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", settings.BIND_HOST, settings.BIND_PORT),
+		Handler:           tracing.Requests(logging.Requests(problem.Errors(settings, routes), settings.LOG_REQUEST_ID_HEADER), mux),
+		TLSConfig:         tlsConfig(clientCAs, svc.certs),
+		ReadTimeout:       time.Duration(settings.READ_TIMEOUT_S) * time.Second,
+		ReadHeaderTimeout: time.Duration(settings.READ_HEADER_TIMEOUT_S) * time.Second,
+		WriteTimeout:      time.Duration(settings.WRITE_TIMEOUT_S) * time.Second,
+		IdleTimeout:       time.Duration(settings.IDLE_TIMEOUT_S) * time.Second,
+		MaxHeaderBytes:    settings.MAX_HEADER_BYTES,
+		ConnState:         svc.metrics.ConnState,
+		ErrorLog:          svc.metrics.ErrorLog(),
+	}
+	return srv
+}
+
+// tlsConfig requires client certificates issued by one of the CAs. The server certificate is taken from the store.
+func tlsConfig(clientCAs *x509.CertPool, certs *certstore.Store) *tls.Config {
+	return &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
@@ -225,33 +612,620 @@ func createServer(settings *config.Settings, s3main, s3cloud s3client.S3Client)
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    settings.CACertPool,
-		Certificates: []tls.Certificate{settings.ServerKeyPair},
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      clientCAs,
+		GetCertificate: certs.GetCertificate,
 	}
-	srv := &http.Server{
-		Addr:              fmt.Sprintf("%s:%d", settings.BIND_HOST, settings.BIND_PORT),
-		Handler:           mux,
-		TLSConfig:         tlsCfg,
-		ReadTimeout:       time.Duration(settings.READ_TIMEOUT_S) * time.Second,
-		ReadHeaderTimeout: time.Duration(settings.READ_HEADER_TIMEOUT_S) * time.Second,
-		WriteTimeout:      time.Duration(settings.WRITE_TIMEOUT_S) * time.Second,
-		IdleTimeout:       time.Duration(settings.IDLE_TIMEOUT_S) * time.Second,
-		MaxHeaderBytes:    settings.MAX_HEADER_BYTES,
+}
+
+// authenticate checks the client certificate and that the ID header matches its CommonName.
+// If the client is sent away, the response is written already.
+func authenticate(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services) (int64, bool) {
+	ctx, span := tracing.Start(r.Context(), "identity")
+	defer span.End()
+	if r.TLS == nil {
+		logging.Error(r.Context(), config.RSL00001)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00001)
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+	idFromCertStr := string(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	var idFromCert int64
+	idFromCert, err := strconv.ParseInt(idFromCertStr, 10, 64)
+	if err != nil {
+		logging.Warn(r.Context(), config.RSL00006)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00006)
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+	if crl := svc.certs.CRL(); crl != nil && revokedCRL(ctx, r.TLS.VerifiedChains[0][0], crl, svc.metrics) {
+		logging.Warn(r.Context(), config.RSL00002, idFromCertStr)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00002)
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+	if !validOCSP(ctx, w, r, settings, svc, settings.CACert, idFromCertStr) {
+		return 0, false
+	}
+	var idFromHeader int64
+	idFromHeader, err = strconv.ParseInt(
+		strings.Trim(r.Header.Get(settings.API_ID_REQ_HEADER), " "), 10, 64)
+	if err != nil {
+		logging.Warn(r.Context(), config.RSL00005, idFromCertStr, settings.API_ID_REQ_HEADER)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER,
+			fmt.Sprintf(config.RSP00005, settings.API_ID_REQ_HEADER))
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	if idFromCert != idFromHeader {
+		logging.Warn(r.Context(), config.RSL00007, idFromCert, idFromHeader, settings.API_ID_REQ_HEADER)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER,
+			fmt.Sprintf(config.RSP00007, idFromCert, idFromHeader, settings.API_ID_REQ_HEADER))
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+	return idFromCert, true
+}
+
+// validOCSP checks the client certificate with OCSP_URL, if set. If the client is sent away, the response is written already.
+func validOCSP(ctx context.Context, w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services,
+	issuer *x509.Certificate, name string) bool {
+	if len(settings.OCSP_URL) == 0 {
+		return true
+	}
+	_, ocsp := tracing.Start(ctx, "ocsp", attribute.String("ocsp.url", settings.OCSP_URL))
+	start := time.Now()
+	revoked, ok := validation.CertIsRevokedOCSP(r.Context(), r.TLS.VerifiedChains[0][0], issuer, settings.OCSP_URL)
+	svc.metrics.ObserveRevocation("ocsp", revoked, ok, time.Since(start))
+	ocsp.SetAttributes(attribute.Bool("revoked", revoked))
+	if !ok {
+		tracing.End(ocsp, errOCSP)
+	} else {
+		ocsp.End()
+	}
+	if !ok {
+		logging.Error(r.Context(), config.RSL00003, name, settings.OCSP_URL)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00003)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return false
+	} else if revoked {
+		logging.Warn(r.Context(), config.RSL00004, name, settings.OCSP_URL)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00004)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// errOCSP marks OCSP spans of certificates that could not be checked.
+var errOCSP = errors.New("certificate cannot be validated with OCSP")
+
+func revokedCRL(ctx context.Context, cert *x509.Certificate, crl *x509.RevocationList, m *metrics.Metrics) bool {
+	_, span := tracing.Start(ctx, "crl")
+	defer span.End()
+	start := time.Now()
+	revoked := validation.CertIsRevokedCRL(cert, crl)
+	m.ObserveRevocation("crl", revoked, true, time.Since(start))
+	span.SetAttributes(attribute.Bool("revoked", revoked))
+	return revoked
+}
+
+// versionHashSuffix is appended to the path of a versioned data file that has its own hash file.
+const versionHashSuffix = ".md5"
+
+// hashFilePath tells where the ETag of a data file is kept. Versions share the hash file
+// of the current file unless they have their own, as written by the publish API.
+func hashFilePath(settings *config.Settings, res *config.Resource, key, version, pathToDataFile string) string {
+	if len(version) > 0 {
+		if _, err := os.Stat(pathToDataFile + versionHashSuffix); err == nil {
+			return pathToDataFile + versionHashSuffix
+		}
+	}
+	return fmt.Sprintf(res.HASH_FILE_TEMPLATE, settings.API_FILE_DIR, key)
+}
+
+// errUnpublished marks files outside their publication window, they are treated as missing.
+var errUnpublished = errors.New("file is outside its publication window")
+
+// checkWindow tells whether the file is published now. Files with an invalid window are not.
+// For embargoed files, embargo is moved to the earliest time one of them gets published.
+func checkWindow(ctx context.Context, win window.Window, err error, name string, embargo *time.Time) error {
+	if err != nil {
+		logging.Error(ctx, config.RSL00040, name, err.Error())
+		return errUnpublished
+	}
+	now := time.Now()
+	if win.Contains(now) {
+		return nil
+	}
+	if win.Embargoed(now) && (embargo.IsZero() || win.NotBefore.Before(*embargo)) {
+		*embargo = win.NotBefore
+	}
+	return errUnpublished
+}
+
+// setRetryAfter points clients to the embargo time, if any.
+// https://www.rfc-editor.org/rfc/rfc9110#section-10.2.3
+func setRetryAfter(w http.ResponseWriter, embargo time.Time) {
+	if !embargo.IsZero() {
+		w.Header().Set("Retry-After", embargo.UTC().Format(http.TimeFormat))
+	}
+}
+
+// fileSignature prefers the signature provided by the publisher in a sidecar file.
+// A sidecar older than the file belongs to a file replaced since, it is not served.
+func fileSignature(signer *signing.Signer, settings *config.Settings, path, etag string) (string, error) {
+	sidecarPath := fmt.Sprintf(settings.API_SIGNATURE_FILE_TEMPLATE, path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if sidecarInfo, err := os.Stat(sidecarPath); err == nil && !sidecarInfo.ModTime().Before(info.ModTime()) {
+		if signature, err := os.ReadFile(sidecarPath); err == nil {
+			return strings.TrimSpace(string(signature)), nil
+		}
+	}
+	if !signer.CanSign() {
+		return "", nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return signer.Sign(path, etag, file)
+}
+
+// rememberFile keeps the generation dated by the file modification time, i.e. when it was published.
+func rememberFile(generations *delta.Store, key, etag, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return generations.RememberAt(key, etag, file, info.ModTime())
+}
+
+// archivedETag strips quotes, FS ETags are quoted and S3 ETags are not, pins may use either.
+func archivedETag(etag string) string {
+	return strings.Trim(etag, "\"")
+}
+
+// rollsBack tells whether the client is pinned to a generation other than the current one.
+func rollsBack(generation, etag string) bool {
+	return len(generation) > 0 && archivedETag(generation) != archivedETag(etag)
+}
+
+// pinnedGeneration tells the generation of the file published at the time of an as_of pin: the current one
+// if it was published before, otherwise one of those kept in API_PIN_GENERATIONS_DIR. If none of them is old enough,
+// the client gets RSP00024 and false.
+func pinnedGeneration(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services,
+	name, etag string, modified, asOf time.Time, clientID int64) (string, bool) {
+	if !modified.After(asOf) {
+		return etag, true
+	}
+	generation, err := svc.archive.At(name, asOf)
+	if err != nil {
+		logging.Warn(r.Context(), config.RSL00038, "as of "+asOf.Format(time.RFC3339), name, clientID)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00024)
+		w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+		return "", false
+	}
+	return generation, true
+}
+
+// servePinned sends the generation the client is pinned to, if it is not the current one,
+// from the generations kept in API_PIN_GENERATIONS_DIR. It tells whether the response is written.
+func servePinned(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services, res *config.Resource,
+	generation, etag, name string, clientID int64) bool {
+	if !rollsBack(generation, etag) {
+		return false
+	}
+	file, err := svc.archive.Open(name, archivedETag(generation))
+	if err != nil {
+		logging.Warn(r.Context(), config.RSL00038, generation, name, clientID)
+		w.Header().Del("ETag")
+		w.Header().Del(settings.API_SIGNATURE_HEADER)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00024)
+		w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+		return true
+	}
+	defer file.Close()
+	// Keep the ETag in the form of the backend.
+	pinnedETag := archivedETag(generation)
+	if strings.HasPrefix(etag, "\"") {
+		pinnedETag = "\"" + pinnedETag + "\""
+	}
+	w.Header().Set("ETag", pinnedETag)
+	w.Header().Del(settings.API_SIGNATURE_HEADER)
+	setCacheControl(w, res)
+	if pinnedETag == compression.BaseETag(r.Header.Get("If-None-Match")) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	if svc.signer != nil && svc.signer.CanSign() {
+		signature, err := svc.signer.Sign(name, pinnedETag, file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00020, name, clientID, err.Error())
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00012)
+			w.WriteHeader(settings.API_RSP_TRY_LATER_HTTP_CODE)
+			return true
+		}
+		w.Header().Set(settings.API_SIGNATURE_HEADER, signature)
+	}
+	// A pinned generation is sent the same way as the current file.
+	original := func() (io.ReadCloser, error) {
+		_, err := file.Seek(0, io.SeekStart)
+		return io.NopCloser(file), err
+	}
+	if serveEncrypted(w, r, settings, svc, pinnedETag, name, clientID, original) {
+		return true
+	}
+	setContentType(w, res)
+	if err := setReprDigest(w, r, svc.digests, name+pinnedETag, "", file); err != nil {
+		logging.Error(r.Context(), config.RSL00022, name, clientID, err.Error())
+	}
+	http.ServeContent(w, r, name, time.Time{}, file)
+	return true
+}
+
+// serveDelta sends a patch from the generation the client already has to the current one
+// if the client asked for it and the generation is still kept. Otherwise, it leaves
+// the response untouched and the caller serves the full file.
+func serveDelta(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services,
+	key, etag, name string, clientID int64) bool {
+	if svc.generations == nil {
+		return false
+	}
+	w.Header().Add("Vary", "Accept")
+	previous := r.Header.Get("If-None-Match")
+	if previous == "" || !negotiate.Accepts(r.Header.Get("Accept"), settings.API_DELTA_MEDIA_TYPE) {
+		return false
+	}
+	patchPath, err := svc.generations.Patch(key, compression.BaseETag(previous), etag)
+	if err != nil {
+		if !errors.Is(err, delta.ErrUnknownGeneration) {
+			logging.Error(r.Context(), config.RSL00018, previous, etag, name, clientID, err.Error())
+		}
+		return false
+	}
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		logging.Error(r.Context(), config.RSL00018, previous, etag, name, clientID, err.Error())
+		return false
+	}
+	defer patch.Close()
+	if err = setReprDigest(w, r, svc.digests, patchPath, "", patch); err != nil {
+		logging.Error(r.Context(), config.RSL00022, patchPath, clientID, err.Error())
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", settings.API_DELTA_MEDIA_TYPE)
+	w.Header().Set("Delta-Base", previous)
+	http.ServeContent(w, r, "", time.Time{}, patch)
+	return true
+}
+
+// serveEncrypted sends the file as a JWE encrypted to the key of the client certificate.
+// Once encryption is enabled, the plaintext must never be sent, so errors are handled here too.
+func serveEncrypted(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services,
+	etag, name string, clientID int64, original func() (io.ReadCloser, error)) bool {
+	if svc.encrypted == nil {
+		return false
+	}
+	path, err := svc.encrypted.Get(etag, r.TLS.VerifiedChains[0][0].PublicKey, original)
+	var jwe *os.File
+	if err == nil {
+		jwe, err = os.Open(path)
+	}
+	if err != nil {
+		logging.Error(r.Context(), config.RSL00021, name, clientID, err.Error())
+		if errors.Is(err, envelope.ErrUnsupportedKey) {
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00013)
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return true
+	}
+	defer jwe.Close()
+	if err = setReprDigest(w, r, svc.digests, path, "", jwe); err != nil {
+		logging.Error(r.Context(), config.RSL00022, path, clientID, err.Error())
+	}
+	w.Header().Set("Content-Type", envelope.MediaType)
+	http.ServeContent(w, r, "", time.Time{}, jwe)
+	return true
+}
+
+// serveEncoded sends the file in the negotiated content encoding, preferring a precompressed
+// sibling over the cache of files compressed on the fly. Range requests apply to the encoded bytes
+// and the ETag header is expected to carry the variant ETag already.
+func serveEncoded(w http.ResponseWriter, r *http.Request, svc services, res *config.Resource, encoding, etag, name string,
+	clientID int64, sibling func(ext string) (io.ReadSeekCloser, string), original func() (io.ReadCloser, error)) bool {
+	if svc.encoded == nil || len(encoding) == 0 {
+		return false
+	}
+	content, digestKey := sibling(compression.Extension(encoding))
+	if content == nil {
+		path, err := svc.encoded.Get(name, etag, encoding, original)
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00019, name, encoding, clientID, err.Error())
+			return false
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00019, name, encoding, clientID, err.Error())
+			return false
+		}
+		content, digestKey = file, path
+	}
+	defer content.Close()
+	if err := setReprDigest(w, r, svc.digests, digestKey, "", content); err != nil {
+		logging.Error(r.Context(), config.RSL00022, digestKey, clientID, err.Error())
+	}
+	w.Header().Set("Content-Type", resourceContentType(res, name))
+	w.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(w, r, "", time.Time{}, content)
+	return true
+}
+
+// resourceContentType of the resource, the identity one if the file is sent encoded.
+func resourceContentType(res *config.Resource, name string) string {
+	if len(res.CONTENT_TYPE) > 0 {
+		return res.CONTENT_TYPE
+	}
+	if byExtension := mime.TypeByExtension(filepath.Ext(name)); len(byExtension) > 0 {
+		return byExtension
+	}
+	return "application/octet-stream"
+}
+
+// setContentType overrides the Content-Type http.ServeContent would otherwise derive from the file.
+func setContentType(w http.ResponseWriter, res *config.Resource) {
+	if len(res.CONTENT_TYPE) > 0 {
+		w.Header().Set("Content-Type", res.CONTENT_TYPE)
+	}
+}
+
+func setCacheControl(w http.ResponseWriter, res *config.Resource) {
+	if len(res.CACHE_CONTROL) > 0 {
+		w.Header().Set("Cache-Control", res.CACHE_CONTROL)
+	}
+}
+
+// freshSibling opens a precompressed sibling of the file unless it is older than the file itself.
+// The sibling's path and modification time identify its content for the digest cache.
+func freshSibling(path, ext string) (io.ReadSeekCloser, string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ""
+	}
+	siblingInfo, err := os.Stat(path + ext)
+	if err != nil || siblingInfo.ModTime().Before(info.ModTime()) {
+		return nil, ""
+	}
+	sibling, err := os.Open(path + ext)
+	if err != nil {
+		return nil, ""
+	}
+	return sibling, fmt.Sprintf("%s%s@%d", path, ext, siblingInfo.ModTime().UnixNano())
+}
+
+// setReprDigest sets Repr-Digest of the whole selected representation, so it is the same for range requests.
+// Digests are taken from the publisher if possible, otherwise computed once per key and the content is rewound.
+// https://www.rfc-editor.org/rfc/rfc9530#section-3
+func setReprDigest(w http.ResponseWriter, r *http.Request, digests *digest.Cache, key, published string,
+	content io.ReadSeeker) error {
+	var d digest.Digests
+	var err error
+	if len(published) > 0 {
+		d, err = digest.Parse(published)
+		if err != nil {
+			return err
+		}
+	} else {
+		d, err = digests.Get(key, func() (io.ReadCloser, error) {
+			return io.NopCloser(content), nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if field := d.Select(r.Header.Get("Want-Repr-Digest")); len(field) > 0 {
+		w.Header().Set("Repr-Digest", field)
+	}
+	return nil
+}
+
+// setFileReprDigest sets Repr-Digest of a data file, see fileDigests.
+func setFileReprDigest(w http.ResponseWriter, r *http.Request, settings *config.Settings, digests *digest.Cache,
+	path, etag string) error {
+	d, err := fileDigests(r.Context(), settings, digests, path, etag)
+	if err != nil {
+		return err
+	}
+	if field := d.Select(r.Header.Get("Want-Repr-Digest")); len(field) > 0 {
+		w.Header().Set("Repr-Digest", field)
+	}
+	return nil
+}
+
+// fileDigests prefers digests stored in a sidecar file not older than the data file.
+// Computed digests may be stored in the sidecar for other instances and restarts.
+func fileDigests(ctx context.Context, settings *config.Settings, digests *digest.Cache, path, etag string) (digest.Digests, error) {
+	sidecarPath := fmt.Sprintf(settings.API_DIGEST_FILE_TEMPLATE, path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if sidecarInfo, err := os.Stat(sidecarPath); err == nil && !sidecarInfo.ModTime().Before(info.ModTime()) {
+		if published, err := os.ReadFile(sidecarPath); err == nil {
+			return digest.Parse(strings.TrimSpace(string(published)))
+		}
+	}
+	computed := false
+	d, err := digests.Get(path+etag, func() (io.ReadCloser, error) {
+		computed = true
+		return os.Open(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if computed && settings.API_STORE_DIGESTS {
+		if err := os.WriteFile(sidecarPath, []byte(d.Field()+"\n"), 0o644); err != nil {
+			logging.Error(ctx, config.RSL00023, path, sidecarPath, err.Error())
+		}
+	}
+	return d, nil
+}
+
+// objectDigests computes digests of an S3 object and, if they were not known yet, stores them in the Repr-Digest
+// user metadata for other instances and restarts. The copy is made only if the object was not replaced meanwhile.
+// It runs in background, the response does not wait for it. Empty if the digests cannot be computed.
+func objectDigests(ctx context.Context, settings *config.Settings, digests *digest.Cache, s3 s3client.S3Client,
+	objectName string, objectInfo minio.ObjectInfo, content io.ReadSeeker) string {
+	computed := false
+	d, err := digests.Get(objectName+objectInfo.ETag, func() (io.ReadCloser, error) {
+		computed = true
+		return io.NopCloser(content), nil
+	})
+	if _, seekErr := content.Seek(0, io.SeekStart); err != nil || seekErr != nil {
+		return ""
+	}
+	if computed {
+		metadata := map[string]string{"Content-Type": objectInfo.ContentType, "X-Amz-Meta-Repr-Digest": d.Field()}
+		for name, values := range objectInfo.Metadata {
+			if strings.HasPrefix(name, "X-Amz-Meta-") && name != "X-Amz-Meta-Repr-Digest" && len(values) > 0 {
+				metadata[name] = values[0]
+			}
+		}
+		storeCtx := context.WithoutCancel(ctx)
+		go func() {
+			if err := s3.ReplaceMetadata(storeCtx, objectName, objectInfo.ETag, metadata); err != nil {
+				logging.Error(storeCtx, config.RSL00023, objectName, "S3 metadata", err.Error())
+			}
+		}()
+	}
+	return d.Field()
+}
+
+// s3For picks the S3 storage of the customer.
+func s3For(settings *config.Settings, s3main, s3cloud s3client.S3Client, customerID string) s3client.S3Client {
+	if settings.UseCloudS3() && settings.CLOUD_S3_CUSTOMER_ID == customerID {
+		return s3cloud
+	}
+	return s3main
+}
+
+// notifyAt wakes up the long-poll when an embargoed file of a level before the one served gets published.
+func notifyAt(svc services, keys []string, deadline, embargo time.Time) {
+	if deadline.IsZero() || embargo.IsZero() {
+		return
+	}
+	for _, key := range keys {
+		svc.changes.NotifyAt(key, embargo)
+	}
+}
+
+// objectWindow reads the publication window from S3 user metadata.
+func objectWindow(info minio.ObjectInfo) (window.Window, error) {
+	return window.Parse(info.Metadata.Get("X-Amz-Meta-"+window.NotBefore), info.Metadata.Get("X-Amz-Meta-"+window.NotAfter))
+}
+
+// extendWriteDeadline gives the transfer after a long-poll the whole WRITE_TIMEOUT_S, the wait used up part of it.
+func extendWriteDeadline(w http.ResponseWriter, r *http.Request, settings *config.Settings, deadline time.Time, idFromCert int64) {
+	if deadline.IsZero() {
+		return
+	}
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Duration(settings.WRITE_TIMEOUT_S) * time.Second))
+	if err != nil {
+		logging.Warn(r.Context(), config.RSL00051, idFromCert, err.Error())
+	}
+}
+
+// s3WatchKey names S3 objects with the prefix for watch.Changes, see objectsVersion.
+func s3WatchKey(settings *config.Settings, customerID, prefix string) string {
+	if settings.UseCloudS3() && settings.CLOUD_S3_CUSTOMER_ID == customerID {
+		return "cloud\x00" + prefix
+	}
+	return "main\x00" + prefix
+}
+
+// objectsVersion lists S3 objects of a key made by s3WatchKey. The version changes whenever an object
+// with the prefix is added, removed or replaced, including metadata replaced with a copy.
+func objectsVersion(settings *config.Settings, s3main, s3cloud s3client.S3Client) func(string) (string, error) {
+	return func(key string) (string, error) {
+		bucket, prefix, _ := strings.Cut(key, "\x00")
+		s3 := s3main
+		if bucket == "cloud" {
+			s3 = s3cloud
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+		defer cancel()
+		objects, err := s3.ListObjects(ctx, prefix)
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		for _, object := range objects {
+			fmt.Fprintf(h, "%s %s %d\n", object.Key, object.ETag, object.LastModified.UnixNano())
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
 	}
-	return srv
 }
 
 func main() {
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	settings := config.LoadSettings()
+	ctx := context.Background()
 
-	if settings.ENABLE_PROFILE {
-		go func() {
-			log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-		}()
+	var m *metrics.Metrics
+	if settings.METRICS_BIND_PORT > 0 {
+		m = metrics.New(&settings)
+	}
+
+	if len(settings.TRACING_OTLP_ENDPOINT) > 0 {
+		shutdown, err := tracing.Setup(ctx, settings.TRACING_OTLP_ENDPOINT, settings.TRACING_OTLP_INSECURE,
+			settings.TRACING_SAMPLE_RATIO, settings.TRACING_SERVICE_NAME, app.Version)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00137, settings.TRACING_OTLP_ENDPOINT, err.Error())
+		}
+		defer shutdown(ctx)
+	}
+
+	var auditLog *audit.Log
+	if len(settings.AUDIT_LOG_SINK) > 0 {
+		sink, err := audit.Open(settings.AUDIT_LOG_SINK, audit.Options{
+			File:       settings.AUDIT_LOG_FILE,
+			MaxSize:    int64(settings.AUDIT_LOG_MAX_SIZE_MB) << 20,
+			MaxAge:     time.Duration(settings.AUDIT_LOG_MAX_AGE_H) * time.Hour,
+			MaxBackups: settings.AUDIT_LOG_MAX_BACKUPS,
+			SyslogTag:  settings.AUDIT_LOG_SYSLOG_TAG,
+		})
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00129, settings.AUDIT_LOG_SINK, err.Error())
+		}
+		if settings.AUDIT_LOG_CHAIN {
+			auditLog = chainedAudit(ctx, &settings, sink)
+		} else {
+			auditLog = audit.New(sink, settings.API_RSP_ERROR_HEADER)
+		}
+		defer auditLog.Close()
 	}
 
 	// init s3 clients
@@ -266,43 +1240,231 @@ func main() {
 			settings.S3_SECRET_KEY, settings.S3_BUCKET_NAME, settings.S3_DATA_FILE_TEMPLATE,
 			settings.S3_UNSECURE_CONNECTION, &settings)
 		if err != nil {
-			log.Fatalf("can't initialize main s3 client: %s", err.Error())
+			logging.Fatal(ctx, "can't initialize main s3 client: %s", err.Error())
 		}
 		if settings.UseCloudS3() {
 			cloudS3Client, err = s3client.New(settings.CLOUD_S3_ENDPOINT, settings.CLOUD_S3_ACCESS_KEY,
 				settings.CLOUD_S3_SECRET_KEY, settings.CLOUD_S3_BUCKET_NAME, settings.CLOUD_S3_DATA_FILE_TEMPLATE,
 				settings.S3_UNSECURE_CONNECTION, &settings)
 			if err != nil {
-				log.Fatalf("can't initialize cloud s3 client: %s", err.Error())
+				logging.Fatal(ctx, "can't initialize cloud s3 client: %s", err.Error())
+			}
+		}
+		if m != nil {
+			mainS3Client = s3client.Observed(mainS3Client, m.S3Observer("main"))
+			if cloudS3Client != nil {
+				cloudS3Client = s3client.Observed(cloudS3Client, m.S3Observer("cloud"))
+			}
+		}
+		if len(settings.TRACING_OTLP_ENDPOINT) > 0 {
+			mainS3Client = s3client.Traced(mainS3Client)
+			if cloudS3Client != nil {
+				cloudS3Client = s3client.Traced(cloudS3Client)
+			}
+		}
+	}
+
+	certs := certstore.New(settings.ServerKeyPair, settings.CRL)
+	var probes *health.Health
+	if settings.HEALTH_BIND_PORT > 0 {
+		probes = healthChecks(&settings, mainS3Client, cloudS3Client, certs)
+	}
+	// Metrics and probes are served over plain HTTP, on one listener if they share the address.
+	internal := make(map[string]*http.ServeMux)
+	internalMux := func(host string, port uint16) *http.ServeMux {
+		addr := fmt.Sprintf("%s:%d", host, port)
+		if _, exists := internal[addr]; !exists {
+			internal[addr] = http.NewServeMux()
+		}
+		return internal[addr]
+	}
+	if m != nil {
+		internalMux(settings.METRICS_BIND_HOST, settings.METRICS_BIND_PORT).Handle(settings.METRICS_URL, m.Handler())
+	}
+	if probes != nil {
+		probesMux := internalMux(settings.HEALTH_BIND_HOST, settings.HEALTH_BIND_PORT)
+		probesMux.HandleFunc(settings.HEALTH_LIVE_URL, probes.Live())
+		probesMux.HandleFunc(settings.HEALTH_READY_URL, probes.Ready())
+		probesMux.HandleFunc(settings.HEALTH_STARTUP_URL, probes.Startup())
+	}
+	for addr, mux := range internal {
+		internalSrv := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: time.Duration(settings.READ_HEADER_TIMEOUT_S) * time.Second,
+		}
+		go func() {
+			if err := internalSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logging.Error(ctx, config.MSG00120, addr, err.Error())
+			}
+		}()
+		defer internalSrv.Close()
+	}
+
+	var generations *delta.Store
+	if settings.API_DELTA_GENERATIONS > 0 {
+		var err error
+		generations, err = delta.New(settings.API_DELTA_DIR, settings.API_DELTA_GENERATIONS)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00060, settings.API_DELTA_DIR, err.Error())
+		}
+	}
+
+	var encoded *compression.Cache
+	if len(settings.ContentEncodings) > 0 {
+		var err error
+		encoded, err = compression.NewCache(settings.API_COMPRESSION_CACHE_DIR, settings.API_COMPRESSION_CACHE_MAX_ENTRIES)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00065, settings.API_COMPRESSION_CACHE_DIR, err.Error())
+		}
+	}
+
+	var signer *signing.Signer
+	if settings.SigningKey != nil || len(settings.SigningPublicKeys) > 0 {
+		var err error
+		signer, err = signing.New(settings.SigningKey, settings.SigningPublicKeys)
+		if err != nil {
+			logging.Error(ctx, "%v", err)
+			logging.Fatal(ctx, config.MSG00071)
+		}
+	}
+
+	var encrypted *envelope.Cache
+	if settings.API_ENCRYPT_FILES {
+		var err error
+		encrypted, err = envelope.NewCache(settings.API_ENCRYPTION_CACHE_DIR, settings.API_ENCRYPTION_CACHE_MAX_ENTRIES)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00079, settings.API_ENCRYPTION_CACHE_DIR, err.Error())
+		}
+	}
+
+	var changes *watch.Changes
+	var waiting, streams watch.Slots
+	if settings.API_WAIT_MAX_S > 0 || settings.API_EVENTS_MAX_CONNECTIONS > 0 {
+		changes = watch.New()
+		if settings.API_USE_S3 {
+			changes.Poll(time.Duration(settings.API_WAIT_S3_POLL_S)*time.Second, objectsVersion(&settings, mainS3Client, cloudS3Client))
+		} else if err := changes.WatchDir(settings.API_FILE_DIR); err != nil {
+			logging.Fatal(ctx, config.MSG00102, settings.API_FILE_DIR, err.Error())
+		}
+		defer changes.Close()
+	}
+	if settings.API_WAIT_MAX_S > 0 {
+		waiting = watch.NewSlots(settings.API_WAIT_MAX_CONNECTIONS)
+	}
+	if settings.API_EVENTS_MAX_CONNECTIONS > 0 {
+		streams = watch.NewSlots(settings.API_EVENTS_MAX_CONNECTIONS)
+	}
+
+	var rollouts *rollout.File
+	if len(settings.API_ROLLOUT_FILE) > 0 {
+		var err error
+		rollouts, err = rollout.NewFile(settings.API_ROLLOUT_FILE)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00107, settings.API_ROLLOUT_FILE, err.Error())
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			ticker := time.NewTicker(time.Duration(settings.API_ROLLOUT_RELOAD_S) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if reloaded, err := rollouts.Reload(); err != nil {
+						logging.Error(ctx, config.MSG00108, settings.API_ROLLOUT_FILE, err.Error())
+					} else if reloaded {
+						logging.Info(ctx, config.MSG00109, settings.API_ROLLOUT_FILE)
+					}
+				case <-stop:
+					return
+				}
 			}
+		}()
+	}
+
+	var pins *pin.Table
+	var archive *delta.Store
+	if len(settings.API_PINS_FILE) > 0 {
+		var err error
+		pins, err = pin.Open(settings.API_PINS_FILE)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00113, settings.API_PINS_FILE, err.Error())
+		}
+		archive, err = delta.New(settings.API_PIN_GENERATIONS_DIR, settings.API_PIN_GENERATIONS)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00114, settings.API_PIN_GENERATIONS_DIR, err.Error())
 		}
 	}
 
-	srv := createServer(&settings, mainS3Client, cloudS3Client)
+	var seen *lastseen.Tracker
+	if len(settings.LAST_SEEN_FILE) > 0 {
+		var err error
+		seen, err = lastseen.Open(settings.LAST_SEEN_FILE, time.Duration(settings.LAST_SEEN_FLUSH_S)*time.Second)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00154, settings.LAST_SEEN_FILE, err.Error())
+		}
+		defer seen.Close()
+	}
+
+	svc := services{
+		generations: generations,
+		encoded:     encoded,
+		signer:      signer,
+		encrypted:   encrypted,
+		digests:     digest.NewCache(settings.API_DIGEST_CACHE_MAX_ENTRIES),
+		windows:     window.NewCache(settings.API_WINDOW_CACHE_MAX_ENTRIES),
+		changes:     changes,
+		waiting:     waiting,
+		streams:     streams,
+		rollouts:    rollouts,
+		pins:        pins,
+		archive:     archive,
+		metrics:     m,
+		audit:       auditLog,
+		certs:       certs,
+		seen:        seen,
+	}
+	srv := createServer(&settings, mainS3Client, cloudS3Client, svc)
+	if settings.ADMIN_BIND_PORT > 0 {
+		adminSrv := createAdminServer(&settings, mainS3Client, cloudS3Client, svc)
+		adminListener, err := net.Listen("tcp", adminSrv.Addr)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00151, adminSrv.Addr, err.Error())
+		}
+		go func() {
+			if err := adminSrv.Serve(tls.NewListener(adminListener, adminSrv.TLSConfig)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logging.Error(ctx, config.MSG00151, adminSrv.Addr, err.Error())
+			}
+		}()
+		defer adminSrv.Close()
+	}
 	l, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "%v", err)
 	}
 	tlsListener := tls.NewListener(l, srv.TLSConfig)
+	probes.Started()
 	go func(s *http.Server) {
 		if err := srv.Serve(tlsListener); err != nil {
-			log.Println(err)
+			logging.Error(ctx, "%v", err)
 		}
 	}(srv)
 	go func(s *http.Server) {
 		sig := <-sigs
-		log.Println(sig)
+		logging.Info(ctx, "%v", sig)
+		probes.Stopping()
 		if srv != nil {
 			if err := srv.Close(); err != nil {
-				log.Fatalf("Close error: %s", err.Error())
+				logging.Fatal(ctx, "Close error: %s", err.Error())
 			}
 			if err := srv.Shutdown(nil); err != nil {
-				log.Fatalf("Shutdown error: %s", err.Error())
+				logging.Fatal(ctx, "Shutdown error: %s", err.Error())
 			}
 		}
 		done <- true
 	}(srv)
-	log.Printf("Running version %s (%s). Ctrl+C to stop.", app.Version, app.GitCommit)
+	logging.Info(ctx, "Running version %s (%s). Ctrl+C to stop.", app.Version, app.GitCommit)
 	<-done
-	log.Printf("Stopped.")
+	logging.Info(ctx, "Stopped.")
 }
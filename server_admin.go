@@ -0,0 +1,391 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"whalebone.io/serve-file/certstore"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/filecache"
+	"whalebone.io/serve-file/lastseen"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/manifest"
+	"whalebone.io/serve-file/pin"
+	"whalebone.io/serve-file/problem"
+	"whalebone.io/serve-file/s3client"
+	"whalebone.io/serve-file/tracing"
+)
+
+// pinsHandler manages pins: GET lists them, POST adds one and DELETE /pins/{id} removes one.
+// Every change is logged with the admin CommonName, the pins themselves record who created them and when.
+func pinsHandler(settings *config.Settings, svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(settings.ADMIN_URL, "/")+"/pins"), "/")
+		switch {
+		case r.Method == http.MethodGet && len(id) == 0:
+			writeJSON(w, http.StatusOK, svc.pins.List())
+		case r.Method == http.MethodPost && len(id) == 0:
+			var p pin.Pin
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&p)
+			if err == nil {
+				if _, exists := settings.Resources[p.Resource]; !exists {
+					err = fmt.Errorf("unknown resource %s", p.Resource)
+				}
+			}
+			if err == nil {
+				err = p.Validate()
+			}
+			if err == nil {
+				p.CreatedBy = admin
+				p.CreatedAt = time.Now().UTC()
+				p, err = svc.pins.Add(p)
+				if err != nil {
+					logging.Error(r.Context(), config.RSL00037, admin, err.Error())
+					w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+			if err != nil {
+				logging.Warn(r.Context(), config.RSL00034, admin, err.Error())
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00022)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			added, _ := json.Marshal(p)
+			logging.Info(r.Context(), config.RSL00035, admin, added)
+			writeJSON(w, http.StatusCreated, p)
+		case r.Method == http.MethodDelete && len(id) > 0:
+			p, exists, err := svc.pins.Remove(id)
+			if err != nil {
+				logging.Error(r.Context(), config.RSL00037, admin, err.Error())
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00023)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			removed, _ := json.Marshal(p)
+			logging.Info(r.Context(), config.RSL00036, admin, removed)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// createAdminServer serves the admin API on its own TLS listener. Clients of the CAs trusted on the main
+// listener and of the admin CA may connect, only admins get past authorizeAdmin. Every request is audited.
+func createAdminServer(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) *http.Server {
+	mux := http.NewServeMux()
+	prefix := strings.TrimSuffix(settings.ADMIN_URL, "/")
+	// An empty method leaves checking it to the handler.
+	route := func(path, method, endpoint string, next func(w http.ResponseWriter, r *http.Request, admin string)) {
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			admin, ok := authorizeAdmin(w, r, settings, svc)
+			if !ok {
+				return
+			}
+			if len(method) > 0 && r.Method != method {
+				w.Header().Set("Allow", method)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			next(w, r, admin)
+		}
+		mux.HandleFunc(prefix+path, svc.audit.Audit(endpoint, svc.metrics.Instrument(endpoint, handler)))
+	}
+	route("/reload", http.MethodPost, "admin.reload", reloadHandler(settings, svc))
+	route("/config", http.MethodGet, "admin.config", func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, settings.Effective())
+	})
+	route("/clients/", http.MethodGet, "admin.clients", clientHandler(settings, s3main, s3cloud, svc))
+	route("/caches", http.MethodGet, "admin.caches", func(w http.ResponseWriter, r *http.Request, admin string) {
+		writeJSON(w, http.StatusOK, cacheUsage(svc))
+	})
+	route("/caches/", http.MethodDelete, "admin.purge", purgeHandler(settings, svc))
+	route("/revocation", http.MethodGet, "admin.revocation", revocationHandler(settings, svc))
+	if svc.pins != nil {
+		pins := pinsHandler(settings, svc)
+		route("/pins", "", "admin.pins", pins)
+		route("/pins/", "", "admin.pins", pins)
+	}
+	if svc.seen != nil {
+		route("/reports/stale", http.MethodGet, "admin.stale", staleHandler(settings, svc))
+		route("/reports/outdated", http.MethodGet, "admin.outdated", outdatedHandler(settings, s3main, s3cloud, svc))
+	}
+	p := newProfiling(settings.ENABLE_PROFILE)
+	route("/debug/profiling", "", "admin.profiling", profilingHandler(p))
+	route("/debug/pprof/", "", "admin.pprof", pprofHandler(settings, p, prefix))
+	route("/debug/vars", http.MethodGet, "admin.vars", varsHandler())
+
+	clientCAs := settings.CACertPool.Clone()
+	if settings.AdminCACert != nil {
+		clientCAs.AddCert(settings.AdminCACert)
+	}
+	// No WriteTimeout, CPU profiles and traces take as long as asked.
+	return &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", settings.ADMIN_BIND_HOST, settings.ADMIN_BIND_PORT),
+		Handler:           tracing.Requests(logging.Requests(problem.Errors(settings, mux), settings.LOG_REQUEST_ID_HEADER), mux),
+		TLSConfig:         tlsConfig(clientCAs, svc.certs),
+		ReadTimeout:       time.Duration(settings.READ_TIMEOUT_S) * time.Second,
+		ReadHeaderTimeout: time.Duration(settings.READ_HEADER_TIMEOUT_S) * time.Second,
+		IdleTimeout:       time.Duration(settings.IDLE_TIMEOUT_S) * time.Second,
+		MaxHeaderBytes:    settings.MAX_HEADER_BYTES,
+	}
+}
+
+// reloadHandler reads the server key pair and the CRL again. If either cannot be read, the previous ones are kept.
+func reloadHandler(settings *config.Settings, svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		logging.Annotate(r.Context(), slog.String("object", "certificates"))
+		keyPair, crl, err := settings.LoadCertificates()
+		// An emptied CRL file would turn revocation off without a word.
+		if err == nil && crl == nil && svc.certs.CRL() != nil {
+			err = errors.New("no CRL loaded, revocation checks would be turned off")
+		}
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00044, admin, err.Error())
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00025)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		svc.certs.Replace(keyPair, crl)
+		cert := svc.certs.Certificate()
+		logging.Info(r.Context(), config.RSL00043, admin, cert.Subject.String(), cert.NotAfter.UTC().Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, svc.certs.Status())
+	}
+}
+
+// clientLookup tells what a client gets, as if it connected with the CommonName, customer and organization.
+type clientLookup struct {
+	ClientID     string           `json:"client_id"`
+	Customer     string           `json:"customer"`
+	Organization string           `json:"organization,omitempty"`
+	Resources    []clientResource `json:"resources"`
+	Files        []manifest.Entry `json:"files"`
+	// Only if clients are tracked and the client was seen.
+	LastSeen *lastseen.Client `json:"last_seen,omitempty"`
+}
+
+type clientResource struct {
+	Resource string   `json:"resource"`
+	Allowed  bool     `json:"allowed"`
+	Rollout  string   `json:"rollout,omitempty"`
+	Pin      *pin.Pin `json:"pin,omitempty"`
+}
+
+// clientHandler looks up ADMIN_URL/clients/{CommonName}?customer={customer}[&organization={organization}].
+// Client certificates always carry the customer, so it is required.
+func clientHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client,
+	svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(settings.ADMIN_URL, "/")+"/clients"), "/")
+		customer, organization := r.URL.Query().Get("customer"), r.URL.Query().Get("organization")
+		if !publishKey.MatchString(id) || !publishKey.MatchString(customer) ||
+			(len(organization) > 0 && !publishKey.MatchString(organization)) {
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00028)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logging.Annotate(r.Context(), slog.String("object", "client/"+id))
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: id, Locality: []string{customer}}}
+		if len(organization) > 0 {
+			cert.Subject.Organization = []string{organization}
+		}
+		lookup := clientLookup{ClientID: id, Customer: customer, Organization: organization, Resources: []clientResource{}}
+		for name, res := range settings.Resources {
+			resource := clientResource{Resource: name, Allowed: res.Allows(cert)}
+			if svc.rollouts != nil {
+				resource.Rollout = svc.rollouts.Policy().Version(name, id, customer, time.Now())
+			}
+			if svc.pins != nil {
+				if p, pinned := svc.pins.Find(name, id, customer); pinned {
+					resource.Pin = &p
+				}
+			}
+			lookup.Resources = append(lookup.Resources, resource)
+		}
+		sort.Slice(lookup.Resources, func(i, j int) bool { return lookup.Resources[i].Resource < lookup.Resources[j].Resource })
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+		defer cancel()
+		var err error
+		lookup.Files, err = clientEntries(ctx, settings, s3main, s3cloud, svc, cert)
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00047, admin, id, err.Error())
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if svc.seen != nil {
+			if c, seen := svc.seen.Get(id); seen {
+				lookup.LastSeen = &c
+			}
+		}
+		writeJSON(w, http.StatusOK, lookup)
+	}
+}
+
+// cacheUsage lists the caches enabled in settings.
+func cacheUsage(svc services) map[string]interface{} {
+	usage := map[string]interface{}{
+		"digest": struct {
+			Entries int `json:"entries"`
+		}{svc.digests.Len()},
+	}
+	for name, cache := range fileCaches(svc) {
+		u, err := cache.Usage()
+		if err != nil {
+			usage[name] = struct {
+				Error string `json:"error"`
+			}{err.Error()}
+			continue
+		}
+		usage[name] = u
+	}
+	return usage
+}
+
+type fileCache interface {
+	Usage() (filecache.Usage, error)
+	Purge() error
+}
+
+func fileCaches(svc services) map[string]fileCache {
+	caches := make(map[string]fileCache)
+	if svc.encoded != nil {
+		caches["compression"] = svc.encoded
+	}
+	if svc.encrypted != nil {
+		caches["encryption"] = svc.encrypted
+	}
+	return caches
+}
+
+// purgeHandler empties a cache, DELETE ADMIN_URL/caches/{name}. Files are cached again on demand.
+func purgeHandler(settings *config.Settings, svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		logging.Annotate(r.Context(), slog.String("object", "cache/"+name))
+		if name == "digest" {
+			svc.digests.Purge()
+		} else if cache, exists := fileCaches(svc)[name]; exists {
+			if err := cache.Purge(); err != nil {
+				logging.Error(r.Context(), config.RSL00046, admin, name, err.Error())
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		} else {
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00026)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logging.Info(r.Context(), config.RSL00045, admin, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revocation describes the revocation mechanisms in use and, if asked with ?serial={hex}, the certificate's status in CRL.
+type revocation struct {
+	CRL       *certstore.CRL `json:"crl,omitempty"`
+	OCSPURL   string         `json:"ocsp_url,omitempty"`
+	Serial    string         `json:"serial,omitempty"`
+	Revoked   bool           `json:"revoked"`
+	RevokedAt *time.Time     `json:"revoked_at,omitempty"`
+}
+
+func revocationHandler(settings *config.Settings, svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		status := revocation{CRL: svc.certs.Status().CRL, OCSPURL: settings.OCSP_URL}
+		if serial := r.URL.Query().Get("serial"); len(serial) > 0 {
+			number, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(serial), "0x"), 16)
+			if !ok {
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00027)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			status.Serial = number.Text(16)
+			if revokedAt := svc.certs.Revoked(number); !revokedAt.IsZero() {
+				status.Revoked, status.RevokedAt = true, &revokedAt
+			}
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// authorizeAdmin checks the client certificate has API_ADMIN_OU or is issued by the admin CA.
+// Admins are identified by CommonName. If the client is sent away, the response is written already.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services) (string, bool) {
+	cert, ok := verifiedCert(w, r, settings, svc)
+	if !ok {
+		return "", false
+	}
+	if !isAdmin(settings, r.TLS.VerifiedChains) {
+		logging.Warn(r.Context(), config.RSL00033, cert.Subject.CommonName, cert.Subject.String())
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00021)
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	return cert.Subject.CommonName, true
+}
+
+// isAdmin tells whether the certificate has API_ADMIN_OU or is issued by the admin CA. The admin CA
+// is trusted on the admin listener only, so its certificates are not seen elsewhere.
+func isAdmin(settings *config.Settings, chains [][]*x509.Certificate) bool {
+	if len(settings.API_ADMIN_OU) > 0 {
+		for _, ou := range chains[0][0].Subject.OrganizationalUnit {
+			if ou == settings.API_ADMIN_OU {
+				return true
+			}
+		}
+	}
+	if settings.AdminCACert != nil {
+		for _, chain := range chains {
+			for _, cert := range chain[1:] {
+				if cert.Equal(settings.AdminCACert) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, document interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(document)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"whalebone.io/serve-file/audit"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/signing"
+)
+
+// chainedAudit audits to the sink in a hash chain, continuing the chain of the file sink if there is one.
+func chainedAudit(ctx context.Context, settings *config.Settings, sink audit.Sink) *audit.Log {
+	signer, err := signing.New(settings.SigningKey, nil)
+	if err != nil {
+		logging.Error(ctx, "%v", err)
+		logging.Fatal(ctx, config.MSG00068)
+	}
+	opts := audit.ChainOptions{
+		Every:    settings.AUDIT_LOG_CHECKPOINT_RECORDS,
+		Interval: time.Duration(settings.AUDIT_LOG_CHECKPOINT_INTERVAL_S) * time.Second,
+	}
+	if settings.AUDIT_LOG_SINK == "file" {
+		opts.Seq, opts.Prev, err = audit.Resume(settings.AUDIT_LOG_FILE)
+		if err != nil {
+			logging.Fatal(ctx, config.MSG00133, settings.AUDIT_LOG_FILE, err.Error())
+		}
+	}
+	return audit.NewChained(sink, settings.API_RSP_ERROR_HEADER, signer, opts)
+}
+
+// auditCommand runs `serve-file audit verify -keys public.pem audit.log.1 audit.log`, which checks the chain
+// and checkpoint signatures of audit log files given oldest first. Chains starting anew and records after
+// the last checkpoint fail the verification unless allowed with flags. It returns the exit code.
+func auditCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(stderr, "usage: serve-file audit verify -keys public.pem [-anchor-seq N -anchor-prev hash] file...")
+		return 2
+	}
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keysFile := flags.String("keys", "", "PEM public keys checkpoints are signed with")
+	anchorSeq := flags.Uint64("anchor-seq", 0, "sequence number of the line before the first file, if it does not start the chain")
+	anchorPrev := flags.String("anchor-prev", "", "hash of the line before the first file, if it does not start the chain")
+	allowRestarts := flags.Bool("allow-restarts", false, "accept chains starting anew, e.g. after restarts of a stdout sink")
+	allowUnsigned := flags.Bool("allow-unsigned", false, "accept records after the last checkpoint, e.g. of a log being written")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if len(*keysFile) == 0 || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	pemBytes, err := os.ReadFile(*keysFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	keys, err := signing.ParsePublicKeys(pemBytes)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	verifier, err := audit.NewVerifier(keys, audit.VerifyOptions{Seq: *anchorSeq, Prev: *anchorPrev, AllowRestarts: *allowRestarts})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		err = verifier.Verify(name, file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "FAILED %s\n", err)
+			return 1
+		}
+	}
+	report := verifier.Report()
+	if report.Unsigned > 0 && !*allowUnsigned {
+		fmt.Fprintf(stderr, "FAILED %d records are not signed by a checkpoint.\n", report.Unsigned)
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK %d records, %d checkpoints, last line %d with hash %s.\n",
+		report.Records, report.Checkpoints, report.Seq, report.Head)
+	if report.Unsigned > 0 {
+		fmt.Fprintf(stdout, "WARNING %d records are not signed by a checkpoint.\n", report.Unsigned)
+	}
+	if report.Starts > 1 {
+		fmt.Fprintf(stdout, "WARNING the chain starts anew %d times.\n", report.Starts-1)
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+// profiling tells whether pprof profiles and execution traces are served on the admin listener.
+// Block and mutex profiles are sampled only while it is on.
+type profiling struct {
+	enabled atomic.Bool
+}
+
+func newProfiling(enabled bool) *profiling {
+	p := &profiling{}
+	p.set(enabled)
+	return p
+}
+
+func (p *profiling) set(enabled bool) {
+	p.enabled.Store(enabled)
+	if enabled {
+		runtime.SetBlockProfileRate(int(time.Millisecond))
+		runtime.SetMutexProfileFraction(100)
+	} else {
+		runtime.SetBlockProfileRate(0)
+		runtime.SetMutexProfileFraction(0)
+	}
+}
+
+// pprofHandler serves ADMIN_URL/debug/pprof/ as net/http/pprof does /debug/pprof/, trace included.
+func pprofHandler(settings *config.Settings, p *profiling, prefix string) func(w http.ResponseWriter, r *http.Request, admin string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	profiles := http.StripPrefix(prefix, mux)
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		if !p.enabled.Load() {
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00029)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		profiles.ServeHTTP(w, r)
+	}
+}
+
+// varsHandler serves runtime stats, memstats and cmdline, as expvar does /debug/vars.
+func varsHandler() func(w http.ResponseWriter, r *http.Request, admin string) {
+	vars := expvar.Handler()
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		w.Header().Set("Cache-Control", "no-store")
+		vars.ServeHTTP(w, r)
+	}
+}
+
+// profilingHandler tells whether profiling is on, PUT switches it on and DELETE off.
+func profilingHandler(p *profiling) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodDelete:
+			enabled := r.Method == http.MethodPut
+			logging.Annotate(r.Context(), slog.String("object", "profiling"))
+			p.set(enabled)
+			state := "off"
+			if enabled {
+				state = "on"
+			}
+			logging.Info(r.Context(), config.RSL00048, admin, state)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Enabled bool `json:"enabled"`
+		}{p.enabled.Load()})
+	}
+}
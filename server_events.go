@@ -0,0 +1,262 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/manifest"
+	"whalebone.io/serve-file/s3client"
+)
+
+// eventsHandler streams a publish event whenever a file the client may download changes,
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+// Event IDs are modification times of the files in nanoseconds, so a client resuming with Last-Event-ID
+// gets events of all files modified since, whichever server instance it reconnects to.
+func eventsHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) http.HandlerFunc {
+	feeds := newPublisher(settings, s3main, s3cloud, svc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		idFromCert, ok := authenticate(w, r, settings, svc)
+		if !ok {
+			return
+		}
+		if !svc.streams.Acquire() {
+			logging.Warn(r.Context(), config.RSL00031, idFromCert, settings.API_EVENTS_MAX_CONNECTIONS)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00020)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer svc.streams.Release()
+		var since time.Time
+		if lastEventID, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("Last-Event-ID")), 10, 64); err == nil {
+			since = time.Unix(0, lastEventID)
+		}
+
+		// The stream outlives WRITE_TIMEOUT_S.
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			logging.Info(r.Context(), config.RSL00032, idFromCert, err.Error())
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			logging.Info(r.Context(), config.RSL00032, idFromCert, err.Error())
+			return
+		}
+
+		f := feeds.subscribe(r.TLS.VerifiedChains[0][0])
+		defer feeds.unsubscribe(f)
+		heartbeat := time.NewTicker(time.Duration(settings.API_EVENTS_HEARTBEAT_S) * time.Second)
+		defer heartbeat.Stop()
+		var seen map[string]string
+		for {
+			entries, updated, listed, err := f.current()
+			if listed && err == nil {
+				var events []manifest.Entry
+				events, seen = publishEvents(entries, seen, since)
+				err = writeEvents(w, events)
+				if err == nil {
+					err = rc.Flush()
+				}
+			}
+			if err != nil {
+				if r.Context().Err() == nil {
+					logging.Info(r.Context(), config.RSL00032, idFromCert, err.Error())
+				}
+				return
+			}
+		wait:
+			for {
+				select {
+				case <-updated:
+					break wait
+				case <-heartbeat.C:
+					if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+						return
+					}
+					if err := rc.Flush(); err != nil {
+						return
+					}
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// publisher lists files of clients with event streams once per change and fans the listing out
+// to all streams of the client, however many there are.
+type publisher struct {
+	settings *config.Settings
+	s3main   s3client.S3Client
+	s3cloud  s3client.S3Client
+	svc      services
+	mu       sync.Mutex
+	feeds    map[string]*feed
+}
+
+// feed keeps the latest listing of a client's files, see publisher.
+type feed struct {
+	id          string
+	keys        []string
+	cert        *x509.Certificate
+	subscribers int
+	stop        chan struct{}
+	mu          sync.Mutex
+	entries     []manifest.Entry
+	listed      bool
+	err         error
+	updated     chan struct{}
+}
+
+func newPublisher(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) *publisher {
+	return &publisher{settings: settings, s3main: s3main, s3cloud: s3cloud, svc: svc, feeds: map[string]*feed{}}
+}
+
+// subscribe returns the feed of the client's files. Streams of the same client share it.
+func (p *publisher) subscribe(cert *x509.Certificate) *feed {
+	keys := eventKeys(p.settings, cert)
+	id := feedID(cert)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.feeds[id]
+	if !ok {
+		f = &feed{id: id, keys: keys, cert: cert, stop: make(chan struct{}), updated: make(chan struct{})}
+		p.feeds[id] = f
+		go p.run(f)
+	}
+	f.subscribers++
+	return f
+}
+
+// unsubscribe stops listing files once the last stream of the feed is gone.
+func (p *publisher) unsubscribe(f *feed) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f.subscribers--
+	if f.subscribers == 0 {
+		close(f.stop)
+		delete(p.feeds, f.id)
+	}
+}
+
+// run lists the files whenever one of them changes, until the feed is stopped.
+func (p *publisher) run(f *feed) {
+	for {
+		waiter := p.svc.changes.Watch(f.keys...)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+		entries, err := clientEntries(ctx, p.settings, p.s3main, p.s3cloud, p.svc, f.cert)
+		cancel()
+		f.mu.Lock()
+		f.entries, f.listed, f.err = entries, true, err
+		close(f.updated)
+		f.updated = make(chan struct{})
+		f.mu.Unlock()
+		select {
+		case <-waiter.Changed():
+		case <-f.stop:
+			waiter.Stop()
+			return
+		}
+	}
+}
+
+// current returns the latest listing and a channel closed on the next one.
+func (f *feed) current() ([]manifest.Entry, <-chan struct{}, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.entries, f.updated, f.listed, f.err
+}
+
+// feedID identifies the client by everything its listing depends on, i.e. the resolver, customers and organizations.
+// Directories and prefixes are shared by many clients, so they must not be used for this.
+func feedID(cert *x509.Certificate) string {
+	return strings.Join([]string{cert.Subject.CommonName, strings.Join(cert.Subject.Locality, "\x00"),
+		strings.Join(cert.Subject.Organization, "\x00")}, "\n")
+}
+
+// eventKeys names what the client's files are listed from, i.e. directories of data, hash and window files,
+// or S3 prefixes of data objects, of all levels of resources the client may download.
+func eventKeys(settings *config.Settings, cert *x509.Certificate) []string {
+	var keys []string
+	for _, res := range settings.Resources {
+		if !res.Allows(cert) {
+			continue
+		}
+		for _, level := range res.Levels(cert) {
+			if settings.API_USE_S3 {
+				prefix, _ := manifest.SplitTemplate(res.S3_DATA_FILE_TEMPLATE, level.Key)
+				keys = append(keys, s3WatchKey(settings, cert.Subject.Locality[0], prefix))
+				continue
+			}
+			path := fmt.Sprintf(res.DATA_FILE_TEMPLATE, settings.API_FILE_DIR, level.Key, "")
+			keys = append(keys, filepath.Dir(path), filepath.Dir(fmt.Sprintf(res.HASH_FILE_TEMPLATE, settings.API_FILE_DIR, level.Key)),
+				filepath.Dir(fmt.Sprintf(settings.API_WINDOW_FILE_TEMPLATE, path)))
+		}
+	}
+	return keys
+}
+
+// publishEvents tells which of the listed files changed since the previous listing, i.e. since seen ETags.
+// Initially, files modified after since are reported, if since is set.
+func publishEvents(entries []manifest.Entry, seen map[string]string, since time.Time) ([]manifest.Entry, map[string]string) {
+	current := make(map[string]string, len(entries))
+	var events []manifest.Entry
+	for _, entry := range entries {
+		key := entry.URL + "\x00" + entry.Version
+		current[key] = entry.ETag
+		if seen == nil {
+			if !since.IsZero() && entry.Modified.After(since) {
+				events = append(events, entry)
+			}
+		} else if seen[key] != entry.ETag {
+			events = append(events, entry)
+		}
+	}
+	// Event IDs must not go back, see eventsHandler.
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Modified.Before(events[j].Modified) })
+	return events, current
+}
+
+func writeEvents(w io.Writer, events []manifest.Entry) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "id: %d\nevent: publish\ndata: %s\n\n", event.Modified.UnixNano(), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"whalebone.io/serve-file/certstore"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/health"
+	"whalebone.io/serve-file/s3client"
+)
+
+// healthChecks checks the subsystems that are enabled in settings.
+func healthChecks(settings *config.Settings, s3main, s3cloud s3client.S3Client, certs *certstore.Store) *health.Health {
+	timeout := time.Duration(settings.HEALTH_CHECK_TIMEOUT_S) * time.Second
+	ttl := time.Duration(settings.HEALTH_CHECK_CACHE_S) * time.Second
+	h := health.New(timeout)
+	if settings.API_USE_S3 {
+		h.Add("s3-main", health.Cached(pingS3(s3main), ttl, timeout))
+		if s3cloud != nil {
+			h.Add("s3-cloud", health.Cached(pingS3(s3cloud), ttl, timeout))
+		}
+	} else {
+		h.Add("file-dir", readableDir(settings.API_FILE_DIR))
+	}
+	if len(settings.OCSP_URL) > 0 {
+		h.Add("ocsp", health.Cached(reachable(settings.OCSP_URL), ttl, timeout))
+	}
+	if certs.CRL() != nil {
+		h.Add("crl", freshCRL(certs))
+	}
+	h.Add("server-certificate", validCertificate(certs))
+	return h
+}
+
+// pingS3 checks the bucket. minio-go cannot cancel a ping, health.Cached keeps probes from waiting for a hung one.
+func pingS3(s3 s3client.S3Client) health.Check {
+	return func(ctx context.Context) (string, error) {
+		return "", s3.Ping(ctx)
+	}
+}
+
+func readableDir(dir string) health.Check {
+	return func(ctx context.Context) (string, error) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := f.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return dir, nil
+	}
+}
+
+// reachable checks the OCSP responder answers. Responders answer a request without an OCSP request in it
+// with an OCSP error response, anything else, e.g. 404 Not Found of a wrong URL, is not a responder.
+func reachable(url string) health.Check {
+	return func(ctx context.Context) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") != "application/ocsp-response" {
+			return "", fmt.Errorf("%s answered %s %s, not an OCSP response", url, rsp.Status, rsp.Header.Get("Content-Type"))
+		}
+		return url, nil
+	}
+}
+
+// freshCRL checks the current CRL, it may have been reloaded since start.
+func freshCRL(certs *certstore.Store) health.Check {
+	return func(ctx context.Context) (string, error) {
+		crl := certs.CRL()
+		if crl == nil {
+			return "", errors.New("no CRL loaded")
+		}
+		if crl.NextUpdate.IsZero() {
+			return "no next update", nil
+		}
+		detail := "next update " + crl.NextUpdate.UTC().Format(time.RFC3339)
+		if time.Now().After(crl.NextUpdate) {
+			return detail, errors.New("CRL is stale")
+		}
+		return detail, nil
+	}
+}
+
+func validCertificate(certs *certstore.Store) health.Check {
+	return func(ctx context.Context) (string, error) {
+		cert := certs.Certificate()
+		if cert == nil {
+			return "", errors.New("server certificate cannot be parsed")
+		}
+		detail := fmt.Sprintf("valid from %s until %s", cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return detail, errors.New("certificate is not valid now")
+		}
+		return detail, nil
+	}
+}
@@ -0,0 +1,336 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/digest"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/manifest"
+	"whalebone.io/serve-file/negotiate"
+	"whalebone.io/serve-file/s3client"
+	"whalebone.io/serve-file/window"
+)
+
+// manifestHandler lists all resources and versions the client may download, so the client
+// can check one small document and fetch only the files that changed.
+func manifestHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		idFromCert, ok := authenticate(w, r, settings, svc)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+		defer cancel()
+		files, err := clientEntries(ctx, settings, s3main, s3cloud, svc, r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00026, idFromCert, err.Error())
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serveDocument(w, r, settings, idFromCert, manifest.Manifest{ClientID: idFromCert, Files: files})
+	}
+}
+
+// clientEntries lists visible files of all resources the client may download.
+func clientEntries(ctx context.Context, settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services,
+	cert *x509.Certificate) ([]manifest.Entry, error) {
+	files := []manifest.Entry{}
+	for name, res := range settings.Resources {
+		if !res.Allows(cert) {
+			continue
+		}
+		entries, err := listEntries(ctx, settings, s3For(settings, s3main, s3cloud, cert.Subject.Locality[0]), svc, cert, name, res)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, manifest.Visible(entries, settings.VersionsPattern, settings.API_VERSIONS_MAX)...)
+	}
+	manifest.Sort(files)
+	return files, nil
+}
+
+// versionsHandler lists versions of a resource visible to the client, i.e. values of the version request header.
+// The resource is addressed the same way as for downloads, API_VERSIONS_URL/{resource}.
+func versionsHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		idFromCert, ok := authenticate(w, r, settings, svc)
+		if !ok {
+			return
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		resourceName := strings.Trim(strings.TrimPrefix(r.URL.Path, settings.API_VERSIONS_URL), "/")
+		res, exists := settings.Resources[resourceName]
+		if !exists {
+			logging.Warn(r.Context(), config.RSL00024, idFromCert, resourceName)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00015)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !res.Allows(cert) {
+			logging.Warn(r.Context(), config.RSL00025, idFromCert, cert.Subject.Locality[0], resourceName)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00016)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+		defer cancel()
+		entries, err := listEntries(ctx, settings, s3For(settings, s3main, s3cloud, cert.Subject.Locality[0]), svc, cert, resourceName, res)
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00026, idFromCert, err.Error())
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serveDocument(w, r, settings, idFromCert, manifest.Versions{
+			ClientID: idFromCert,
+			Resource: resourceName,
+			URL:      resourceURL(settings, resourceName),
+			Versions: manifest.Visible(entries, settings.VersionsPattern, settings.API_VERSIONS_MAX),
+		})
+	}
+}
+
+// serveDocument sends a manifest document as JSON or CBOR, depending on Accept.
+func serveDocument(w http.ResponseWriter, r *http.Request, settings *config.Settings, idFromCert int64, document interface{}) {
+	mediaType := manifest.MediaTypeJSON
+	if negotiate.Accepts(r.Header.Get("Accept"), manifest.MediaTypeCBOR) {
+		mediaType = manifest.MediaTypeCBOR
+	}
+	body, etag, err := manifest.Encode(document, mediaType)
+	if err != nil {
+		logging.Error(r.Context(), config.RSL00026, idFromCert, err.Error())
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// listEntries describes all versions of the resource kept for the client, i.e. of the first
+// fallback level with any files, as served for downloads. Event streams are woken up when files
+// of a level get published or expire, see eventKeys.
+func listEntries(ctx context.Context, settings *config.Settings, s3 s3client.S3Client, svc services,
+	cert *x509.Certificate, name string, res *config.Resource) ([]manifest.Entry, error) {
+	for _, level := range res.Levels(cert) {
+		entries, err := levelEntries(ctx, settings, s3, svc, cert.Subject.Locality[0], level.Key, name, res)
+		if err != nil || len(entries) > 0 {
+			if len(res.FALLBACK) > 0 {
+				for i := range entries {
+					entries[i].Level = level.Name
+				}
+			}
+			return entries, err
+		}
+	}
+	return nil, nil
+}
+
+// levelEntries describes all versions of the resource kept for a fallback level, see listEntries.
+func levelEntries(ctx context.Context, settings *config.Settings, s3 s3client.S3Client, svc services,
+	customerID, key, name string, res *config.Resource) ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+	var next time.Time
+	var changed string
+	var err error
+	if settings.API_USE_S3 {
+		entries, err = objectEntries(ctx, settings, s3, svc, key, name, res, &next)
+		prefix, _ := manifest.SplitTemplate(res.S3_DATA_FILE_TEMPLATE, key)
+		changed = s3WatchKey(settings, customerID, prefix)
+	} else {
+		entries, err = fileEntries(ctx, settings, svc, key, name, res, &next)
+		changed = filepath.Dir(fmt.Sprintf(res.DATA_FILE_TEMPLATE, settings.API_FILE_DIR, key, ""))
+	}
+	if !next.IsZero() && svc.changes != nil {
+		svc.changes.NotifyAt(changed, next)
+	}
+	return entries, err
+}
+
+// fileEntries describes data files in API_FILE_DIR the same way they are served,
+// i.e. with the ETag from the hash file. The key is the client ID or a fallback level key.
+// Next is moved to the earliest time one of the files gets published or expires.
+func fileEntries(ctx context.Context, settings *config.Settings, svc services, key, name string, res *config.Resource,
+	next *time.Time) ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+	prefix, suffix := manifest.SplitTemplate(res.DATA_FILE_TEMPLATE, settings.API_FILE_DIR, key)
+	dir, namePrefix := filepath.Split(prefix)
+	files, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		version, ok := manifest.VersionOf(file.Name(), namePrefix, suffix)
+		if !ok || file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := dir + file.Name()
+		suffixed := version
+		if len(version) > 0 {
+			suffixed = "_" + version
+		}
+		// Files without a hash are not served either, see RSL00009.
+		hash, err := os.ReadFile(hashFilePath(settings, res, key, suffixed, path))
+		if err != nil {
+			continue
+		}
+		// Nor files outside their publication window.
+		win, err := window.ReadFile(fmt.Sprintf(settings.API_WINDOW_FILE_TEMPLATE, path))
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		earliest(next, win.Next(now))
+		if !win.Contains(now) {
+			continue
+		}
+		etag := "\"" + string(hash) + "\""
+		entry := manifest.Entry{
+			Resource: name,
+			URL:      resourceURL(settings, name),
+			Version:  version,
+			Current:  len(version) == 0,
+			Size:     info.Size(),
+			ETag:     etag,
+			Modified: info.ModTime().UTC(),
+		}
+		d, err := fileDigests(ctx, settings, svc.digests, path, etag)
+		if err != nil {
+			return nil, err
+		}
+		entry.Digest = d.Select(digest.SHA256 + "=1")
+		if svc.signer != nil {
+			if entry.Signature, err = fileSignature(svc.signer, settings, path, etag); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// objectEntries describes S3 objects of the client or a fallback level. Digests and signatures are taken
+// from user metadata if present, otherwise they are computed once per object generation.
+// Next is moved to the earliest time one of the objects gets published or expires.
+func objectEntries(ctx context.Context, settings *config.Settings, s3 s3client.S3Client, svc services,
+	key, name string, res *config.Resource, next *time.Time) ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+	prefix, suffix := manifest.SplitTemplate(res.S3_DATA_FILE_TEMPLATE, key)
+	objects, err := s3.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		version, ok := manifest.VersionOf(object.Key, prefix, suffix)
+		if !ok {
+			continue
+		}
+		info, err := s3.StatObject(ctx, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		// Objects outside their publication window are not served.
+		win, err := objectWindow(info)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		earliest(next, win.Next(now))
+		if !win.Contains(now) {
+			continue
+		}
+		open := func() (io.ReadCloser, error) {
+			return s3.GetObjectWithContext(ctx, object.Key, minio.GetObjectOptions{})
+		}
+		entry := manifest.Entry{
+			Resource: name,
+			URL:      resourceURL(settings, name),
+			Version:  version,
+			Current:  len(version) == 0,
+			Size:     info.Size,
+			ETag:     info.ETag,
+			Modified: info.LastModified.UTC(),
+		}
+		var d digest.Digests
+		if published := info.Metadata.Get("X-Amz-Meta-Repr-Digest"); len(published) > 0 {
+			d, err = digest.Parse(published)
+		} else {
+			d, err = svc.digests.Get(object.Key+info.ETag, open)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Digest = d.Select(digest.SHA256 + "=1")
+		if svc.signer != nil {
+			entry.Signature = info.Metadata.Get("X-Amz-Meta-" + settings.API_SIGNATURE_HEADER)
+			if len(entry.Signature) == 0 && svc.signer.CanSign() {
+				content, err := open()
+				if err != nil {
+					return nil, err
+				}
+				entry.Signature, err = svc.signer.Sign(object.Key, info.ETag, content)
+				content.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// earliest moves next to the time if it is sooner. Zero times are never.
+func earliest(next *time.Time, t time.Time) {
+	if !t.IsZero() && (next.IsZero() || t.Before(*next)) {
+		*next = t
+	}
+}
+
+func resourceURL(settings *config.Settings, name string) string {
+	if len(name) == 0 {
+		return settings.API_URL
+	}
+	return strings.TrimSuffix(settings.API_URL, "/") + "/" + name
+}
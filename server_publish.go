@@ -0,0 +1,280 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/digest"
+	"whalebone.io/serve-file/filecache"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/s3client"
+)
+
+// publishKey restricts client IDs, fallback level keys and versions in publish requests,
+// so that they cannot escape API_FILE_DIR or the object name template.
+var publishKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var writeSidecar = filecache.WriteAtomically
+
+// publishHandler stores a data file uploaded by a producer, PUT or POST API_PUBLISH_URL/{client ID}[/{resource}].
+// The hash, digests and signature are stored with the file, so it is served right away. The new ETag is sent back.
+func publishHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client, svc services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "PUT, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		producer, ok := authorizeProducer(w, r, settings, svc)
+		if !ok {
+			return
+		}
+		key, resourceName, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, settings.API_PUBLISH_URL), "/"), "/")
+		res, exists := settings.Resources[resourceName]
+		version := strings.Trim(r.Header.Get(settings.API_VERSION_REQ_HEADER), " ")
+		if !exists || !publishKey.MatchString(key) || (len(version) > 0 && !publishKey.MatchString(version)) {
+			logging.Warn(r.Context(), config.RSL00028, producer, r.URL.Path)
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00018)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(version) > 0 {
+			version = fmt.Sprintf("_%s", version)
+		}
+		content := http.MaxBytesReader(w, r.Body, settings.API_PUBLISH_MAX_BYTES)
+		var signature string
+		if len(settings.API_SIGNATURE_HEADER) > 0 {
+			signature = strings.TrimSpace(r.Header.Get(settings.API_SIGNATURE_HEADER))
+		}
+
+		var name, etag string
+		var err error
+		if settings.API_USE_S3 {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+			defer cancel()
+			name = fmt.Sprintf(res.S3_DATA_FILE_TEMPLATE, key, version)
+			s3 := s3For(settings, s3main, s3cloud, strings.TrimSpace(r.Header.Get(settings.API_CUSTOMER_REQ_HEADER)))
+			etag, err = publishObject(ctx, settings, s3, name, content, signature)
+		} else {
+			name = fmt.Sprintf(res.DATA_FILE_TEMPLATE, settings.API_FILE_DIR, key, version)
+			etag, err = publishFile(settings, res, key, version, name, content, signature)
+		}
+		if err != nil {
+			logging.Error(r.Context(), config.RSL00029, name, producer, err.Error())
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00019)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logging.Info(r.Context(), config.RSL00030, producer, name, etag)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// authorizeProducer checks the client certificate belongs to a producer, see isProducer.
+// Producers are identified by CommonName. If the producer is sent away, the response is written already.
+func authorizeProducer(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services) (string, bool) {
+	cert, ok := verifiedCert(w, r, settings, svc)
+	if !ok {
+		return "", false
+	}
+	if !isProducer(settings, r.TLS.VerifiedChains) {
+		logging.Warn(r.Context(), config.RSL00027, cert.Subject.CommonName, cert.Subject.String())
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00017)
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	return cert.Subject.CommonName, true
+}
+
+// verifiedCert checks the client certificate is not revoked in CRL nor OCSP. Unlike authenticate, it does not
+// expect a numeric CommonName, so it serves producers and admins. Their certificates may come from other CAs,
+// so OCSP is asked about the issuer in the chain.
+func verifiedCert(w http.ResponseWriter, r *http.Request, settings *config.Settings, svc services) (*x509.Certificate, bool) {
+	if r.TLS == nil {
+		logging.Error(r.Context(), config.RSL00001)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00001)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if crl := svc.certs.CRL(); crl != nil && revokedCRL(r.Context(), cert, crl, svc.metrics) {
+		logging.Warn(r.Context(), config.RSL00002, cert.Subject.CommonName)
+		w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00002)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	if chain := r.TLS.VerifiedChains[0]; len(chain) > 1 && !validOCSP(r.Context(), w, r, settings, svc, chain[1], cert.Subject.CommonName) {
+		return nil, false
+	}
+	return cert, true
+}
+
+// publishOnly lets certificates issued by the producer CA reach API_PUBLISH_URL only. The producer CA is trusted
+// on the listener for publishing, its certificates must not download files even with a numeric CommonName.
+func publishOnly(settings *config.Settings, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && issuedByProducerCA(settings, r.TLS.VerifiedChains) {
+			if _, pattern := mux.Handler(r); pattern != settings.API_PUBLISH_URL {
+				cert := r.TLS.VerifiedChains[0][0]
+				logging.Warn(r.Context(), config.RSL00050, cert.Subject.CommonName, cert.Subject.String())
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00001)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// issuedByProducerCA tells whether the certificate is trusted only thanks to the producer CA.
+func issuedByProducerCA(settings *config.Settings, chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		viaProducerCA := false
+		for _, cert := range chain[1:] {
+			viaProducerCA = viaProducerCA || cert.Equal(settings.ProducerCACert)
+		}
+		if !viaProducerCA {
+			return false
+		}
+	}
+	return true
+}
+
+// isProducer tells whether the certificate has API_PRODUCER_OU or is issued by the producer CA.
+func isProducer(settings *config.Settings, chains [][]*x509.Certificate) bool {
+	if len(settings.API_PRODUCER_OU) > 0 {
+		for _, ou := range chains[0][0].Subject.OrganizationalUnit {
+			if ou == settings.API_PRODUCER_OU {
+				return true
+			}
+		}
+	}
+	if settings.ProducerCACert != nil {
+		for _, chain := range chains {
+			for _, cert := range chain[1:] {
+				if cert.Equal(settings.ProducerCACert) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// publishFile moves the data file into place first, then writes its digest and signature sidecars and its hash
+// last, each of them atomically. Sidecars are thus never older than the data file they describe, and the ETag changes
+// only once all of them are written. The current file keeps its hash in HASH_FILE_TEMPLATE, versions get their own
+// next to the data file.
+func publishFile(settings *config.Settings, res *config.Resource, key, version, path string, content io.Reader,
+	signature string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	hash := md5.New()
+	digests := digest.NewWriter()
+	staged, err := filecache.Stage(path, func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, hash, digests), content)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer staged.Discard()
+	sum := hex.EncodeToString(hash.Sum(nil))
+	pathToHashFile := fmt.Sprintf(res.HASH_FILE_TEMPLATE, settings.API_FILE_DIR, key)
+	if len(version) > 0 {
+		pathToHashFile = path + versionHashSuffix
+	}
+	// The data file goes first. Until the sidecars follow, digest and signature sidecars are older than the file
+	// and are not served, while the old ETag only makes clients download the new file once more.
+	if err = staged.Commit(); err != nil {
+		return "", err
+	}
+	sidecars := []struct{ path, content string }{
+		{fmt.Sprintf(settings.API_DIGEST_FILE_TEMPLATE, path), digests.Digests().Field() + "\n"},
+	}
+	if len(signature) > 0 {
+		sidecars = append(sidecars, struct{ path, content string }{fmt.Sprintf(settings.API_SIGNATURE_FILE_TEMPLATE, path), signature + "\n"})
+	}
+	sidecars = append(sidecars, struct{ path, content string }{pathToHashFile, sum})
+	for _, sidecar := range sidecars {
+		err := writeSidecar(sidecar.path, func(w io.Writer) error {
+			_, err := io.WriteString(w, sidecar.content)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return "\"" + sum + "\"", nil
+}
+
+// publishObject spools the content to a temporary file to compute its digests first, so that they can be
+// stored in user metadata with the object. S3 replaces the object atomically.
+func publishObject(ctx context.Context, settings *config.Settings, s3 s3client.S3Client, objectName string,
+	content io.Reader, signature string) (string, error) {
+	spool, err := os.CreateTemp("", "serve-file-publish-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	digests := digest.NewWriter()
+	size, err := io.Copy(io.MultiWriter(spool, digests), content)
+	if err != nil {
+		return "", err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	metadata := map[string]string{"Repr-Digest": digests.Digests().Field()}
+	if len(signature) > 0 {
+		metadata[settings.API_SIGNATURE_HEADER] = signature
+	}
+	_, err = s3.PutObjectWithContext(ctx, objectName, spool, size, minio.PutObjectOptions{UserMetadata: metadata})
+	if err != nil {
+		return "", err
+	}
+	info, err := s3.StatObject(ctx, objectName)
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"whalebone.io/serve-file/compression"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/lastseen"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/manifest"
+	"whalebone.io/serve-file/s3client"
+)
+
+// staleHandler lists clients not seen for LAST_SEEN_STALE_H hours, or ?hours={hours}, the longest silent first.
+func staleHandler(settings *config.Settings, svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		hours := settings.LAST_SEEN_STALE_H
+		if h := r.URL.Query().Get("hours"); len(h) > 0 {
+			var err error
+			if hours, err = strconv.Atoi(h); err != nil || hours <= 0 {
+				w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00030)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		logging.Annotate(r.Context(), slog.String("object", "reports/stale"))
+		stale := svc.seen.NotSeenSince(time.Now().Add(-time.Duration(hours) * time.Hour))
+		if stale == nil {
+			stale = []lastseen.Client{}
+		}
+		writeJSON(w, http.StatusOK, stale)
+	}
+}
+
+// outdated is a resource the client was last served other than what it would be served now.
+type outdated struct {
+	ClientID     string    `json:"client_id"`
+	Customer     string    `json:"customer"`
+	Organization string    `json:"organization,omitempty"`
+	Resource     string    `json:"resource"`
+	LastSeen     time.Time `json:"last_seen"`
+	Served       string    `json:"served_etag"`
+	Presented    string    `json:"presented_etag,omitempty"`
+	Expected     string    `json:"expected_etag"`
+	Version      string    `json:"version,omitempty"`
+}
+
+// outdatedHandler lists clients whose last download of a resource is not the generation they would get now,
+// i.e. the current file or the version rolled out to them. Pinned clients are left out, they are held back on purpose.
+// Every level of a resource is listed once per bucket, so clients share the levels of their customer and everyone.
+// Each listing gets S3_GET_OBJECT_TIMEOUT_S of its own.
+func outdatedHandler(settings *config.Settings, s3main, s3cloud s3client.S3Client,
+	svc services) func(w http.ResponseWriter, r *http.Request, admin string) {
+	return func(w http.ResponseWriter, r *http.Request, admin string) {
+		logging.Annotate(r.Context(), slog.String("object", "reports/outdated"))
+		listings := map[string][]manifest.Entry{}
+		list := func(customer, key, name string, res *config.Resource) ([]manifest.Entry, error) {
+			listing := s3WatchKey(settings, customer, name+"\x00"+key)
+			if entries, listed := listings[listing]; listed {
+				return entries, nil
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), time.Duration(settings.S3_GET_OBJECT_TIMEOUT_S)*time.Second)
+			defer cancel()
+			entries, err := levelEntries(ctx, settings, s3For(settings, s3main, s3cloud, customer), svc, customer, key, name, res)
+			if err != nil {
+				return nil, err
+			}
+			listings[listing] = entries
+			return entries, nil
+		}
+		report := []outdated{}
+		for _, c := range svc.seen.Clients() {
+			if len(c.Customer) == 0 {
+				continue
+			}
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: c.ID, Locality: []string{c.Customer}}}
+			if len(c.Organization) > 0 {
+				cert.Subject.Organization = []string{c.Organization}
+			}
+			for name, poll := range c.Resources {
+				res, exists := settings.Resources[name]
+				if !exists || len(poll.Served) == 0 || !res.Allows(cert) {
+					continue
+				}
+				if svc.pins != nil {
+					if _, pinned := svc.pins.Find(name, c.ID, c.Customer); pinned {
+						continue
+					}
+				}
+				// The version asked for by the client wins over the rollout policy, as when serving.
+				version := poll.Requested
+				if len(version) == 0 && svc.rollouts != nil {
+					version = svc.rollouts.Policy().Version(name, c.ID, c.Customer, time.Now())
+				}
+				// The first level with any files is served, see listEntries.
+				var expected *manifest.Entry
+				for _, level := range res.Levels(cert) {
+					entries, err := list(c.Customer, level.Key, name, res)
+					if err != nil {
+						logging.Error(r.Context(), config.RSL00049, admin, err.Error())
+						w.Header().Set(settings.API_RSP_ERROR_HEADER, config.RSP00011)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					if len(entries) == 0 {
+						continue
+					}
+					for i := range entries {
+						if entries[i].Version == version {
+							expected = &entries[i]
+							break
+						}
+					}
+					break
+				}
+				if expected != nil && archivedETag(compression.BaseETag(poll.Served)) != archivedETag(expected.ETag) {
+					report = append(report, outdated{
+						ClientID:     c.ID,
+						Customer:     c.Customer,
+						Organization: c.Organization,
+						Resource:     name,
+						LastSeen:     poll.Time,
+						Served:       poll.Served,
+						Presented:    poll.Presented,
+						Expected:     expected.ETag,
+						Version:      version,
+					})
+				}
+			}
+		}
+		sort.Slice(report, func(i, j int) bool {
+			if report[i].ClientID != report[j].ClientID {
+				return report[i].ClientID < report[j].ClientID
+			}
+			return report[i].Resource < report[j].Resource
+		})
+		writeJSON(w, http.StatusOK, report)
+	}
+}
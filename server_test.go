@@ -17,11 +17,28 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strings"
@@ -30,10 +47,19 @@ import (
 	"testing"
 	"time"
 
+	minio "github.com/minio/minio-go"
 	"github.com/stretchr/testify/assert"
+	"whalebone.io/serve-file/certstore"
 	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/digest"
+	"whalebone.io/serve-file/filecache"
+	"whalebone.io/serve-file/lastseen"
+	"whalebone.io/serve-file/logging"
+	"whalebone.io/serve-file/s3client"
+	"whalebone.io/serve-file/signing"
 	"whalebone.io/serve-file/testutil"
 	"whalebone.io/serve-file/validation"
+	"whalebone.io/serve-file/watch"
 )
 
 const (
@@ -108,7 +134,7 @@ func waitForOCSP(timeout time.Duration, ocspURL string, caCertFile string, clien
 	}
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		_, ok := validation.CertIsRevokedOCSP(clientCert, caCert, ocspURL)
+		_, ok := validation.CertIsRevokedOCSP(context.Background(), clientCert, caCert, ocspURL)
 		if ok {
 			break
 		} else {
@@ -155,34 +181,53 @@ func startOCSPResponder(ocspURL string, ocspCertName string, caChainCertName str
 }
 
 func interaction(t *testing.T, clientName string, headers []string, expectedHTTPCodes []string, expectedContent string, props [][]string) {
+	resourceInteraction(t, "", clientName, headers, expectedHTTPCodes, expectedContent, props)
+}
+
+// resourceInteraction requests the named resource on API_URL/{resource}.
+func resourceInteraction(t *testing.T, resource string, clientName string, headers []string, expectedHTTPCodes []string,
+	expectedContent string, props [][]string) {
+	urlInteraction(t, func(env map[string]string) (string, string) {
+		return fmt.Sprintf("%s:%s", env["SRV_BIND_HOST"], env["SRV_BIND_PORT"]), env["SRV_API_URL"] + resource
+	}, clientName, headers, expectedHTTPCodes, expectedContent, props)
+}
+
+// adminInteraction requests path on the admin listener, SRV_ADMIN_BIND_PORT, at ADMIN_URL/{path}.
+func adminInteraction(t *testing.T, path string, clientName string, headers []string, expectedHTTPCodes []string,
+	expectedContent string, props [][]string) {
+	urlInteraction(t, func(env map[string]string) (string, string) {
+		return fmt.Sprintf("%s:%s", env["SRV_BIND_HOST"], env["SRV_ADMIN_BIND_PORT"]), "/admin/" + path
+	}, clientName, headers, expectedHTTPCodes, expectedContent, props)
+}
+
+// urlInteraction starts the server with props and requests the address and path target tells from them.
+func urlInteraction(t *testing.T, target func(env map[string]string) (string, string), clientName string, headers []string,
+	expectedHTTPCodes []string, expectedContent string, props [][]string) {
 	testMutex.Lock()
 	defer testMutex.Unlock()
-	var bindHost string
-	var bindPort string
-	var apiURL string
+	env := map[string]string{}
 	for _, prop := range props {
 		os.Setenv(prop[0], prop[1])
-		if prop[0] == "SRV_BIND_PORT" {
-			bindPort = prop[1]
-		}
-		if prop[0] == "SRV_BIND_HOST" {
-			bindHost = prop[1]
-		}
-		if prop[0] == "SRV_API_URL" {
-			apiURL = prop[1]
-		}
+		env[prop[0]] = prop[1]
 	}
 	defer func() {
 		for _, prop := range props {
 			os.Setenv(prop[0], "")
 		}
 	}()
-	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	mainAddress := fmt.Sprintf("%s:%s", env["SRV_BIND_HOST"], env["SRV_BIND_PORT"])
+	address, path := target(env)
+	waitForTCP(30*time.Second, mainAddress, true)
+	// The admin listener of the previous run closes after the main one.
+	if len(env["SRV_ADMIN_BIND_PORT"]) > 0 {
+		waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", env["SRV_BIND_HOST"], env["SRV_ADMIN_BIND_PORT"]), true)
+	}
 	go main()
 	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), false)
+	waitForTCP(30*time.Second, mainAddress, false)
+	waitForTCP(30*time.Second, address, false)
 	curl := []string{
-		fmt.Sprintf("https://%s:%s%s", bindHost, bindPort, apiURL),
+		fmt.Sprintf("https://%s%s", address, path),
 		"--cert",
 		fmt.Sprintf("certs/client/certs/%s.cert.pem", clientName),
 		"--key",
@@ -332,6 +377,20 @@ func TestCorrectClientNoDataFile(t *testing.T) {
 		config.RSP00008, props)
 }
 
+func TestCorrectClientNoDataFileProblem(t *testing.T) {
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+	}
+	headers := []string{"-Hx-resolver-id: 777", "-HAccept: application/problem+json"}
+	interaction(t, "client-777", headers, []string{"HTTP/1.1 466"},
+		`"code":"RSP00008","retryable":true,"retry_after":60,"request_id":"`, props)
+}
+
 func TestCorrectClientNoHashFile(t *testing.T) {
 	props := [][]string{
 		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
@@ -427,6 +486,26 @@ func TestOCSPRevokedClient(t *testing.T) {
 	interaction(t, "client-888", []string{}, []string{"HTTP/1.1 403"}, "certificate is revoked in OCSP", props)
 }
 
+func TestOCSPRevokedProducer(t *testing.T) {
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_PUBLISH_URL", "/sinkit/rest/protostream/resolvercache/publish/"},
+		{"SRV_API_PRODUCER_OU", "Testing"},
+		{"SRV_API_FILE_DIR", t.TempDir()},
+		{"SRV_OCSP_URL", "http://localhost:" + ocspPort},
+	}
+	ocspCMD := startOCSPResponder(ocspPort, "ocsp", "ca-chain")
+	defer stopOCSPResponder(ocspCMD)
+	waitForOCSP(5*time.Second, "http://localhost:"+ocspPort, caCertFile, clientCertFile)
+	resourceInteraction(t, "publish/666", "client-888", []string{"-XPUT", "--data-binary", "published cache"},
+		[]string{"HTTP/1.1 403"}, config.RSP00004, props)
+}
+
 func TestWrongOCSP(t *testing.T) {
 	props := [][]string{
 		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
@@ -442,3 +521,1496 @@ func TestWrongOCSP(t *testing.T) {
 	waitForOCSP(5*time.Second, "http://localhost:"+ocspPort, unknownCaCertFile, unknownClientCertFile)
 	interaction(t, "client-888", []string{}, []string{"HTTP/1.1 503"}, "certificate cannot be validated with OCSP", props)
 }
+
+func TestCorrectClientDelta(t *testing.T) {
+	dataDir := t.TempDir()
+	publish := func(content string) string {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+		assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte(content), 0o600))
+		assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte(hash), 0o600))
+		return hash
+	}
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_DELTA_GENERATIONS", "2"},
+		{"SRV_API_DELTA_DIR", t.TempDir()},
+	}
+	defer os.Unsetenv("SRV_API_DELTA_GENERATIONS")
+	previous := publish(strings.Repeat("first generation of the resolver cache ", 100))
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"Vary: Accept", props)
+	current := publish(strings.Repeat("first generation of the resolver cache ", 100) + "and a bit more")
+	headers := []string{
+		"-Hx-resolver-id: 666",
+		fmt.Sprintf("-HIf-None-Match: \"%s\"", previous),
+		"-HAccept: application/vnd.whalebone.zstd-patch",
+	}
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"},
+		"Content-Type: application/vnd.whalebone.zstd-patch", props)
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Delta-Base: \"%s\"", previous), props)
+	// Clients not asking for a patch get the full file.
+	interaction(t, "client-666", headers[:2], []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Etag: \"%s\"", current), props)
+}
+
+func TestCorrectClientContentEncoding(t *testing.T) {
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+		{"SRV_API_CONTENT_ENCODINGS", "zstd,gzip"},
+		{"SRV_API_COMPRESSION_CACHE_DIR", t.TempDir()},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-HAccept-Encoding: gzip"}, []string{"HTTP/1.1 200"},
+		"Content-Encoding: gzip", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-HAccept-Encoding: gzip"}, []string{"HTTP/1.1 200"},
+		"Etag: \"136884bffc2743524c8c084c34f1d472-gzip\"", props)
+	headers := []string{
+		"-Hx-resolver-id: 666",
+		"-HAccept-Encoding: gzip",
+		"-HIf-None-Match: \"136884bffc2743524c8c084c34f1d472-gzip\"",
+	}
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 304"}, "Vary: Accept-Encoding", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"Content-Length: 9000", props)
+}
+
+func TestCorrectClientSigned(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyID, _ := signing.KeyID(key.Public())
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+		{"SRV_SIGNING_KEY_PEM_BASE64", base64.StdEncoding.EncodeToString(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Content-Signature: keyid=\"%s\", alg=\"ed25519\"", keyID), props)
+}
+
+func TestCorrectClientStaleSignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyID, _ := signing.KeyID(key.Public())
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	// Left behind by the file replaced since.
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.sig", []byte(`keyid="stale", alg="ed25519", sig="c3RhbGU="`), 0o600))
+	modified := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(dataDir+"/777_resolver_cache.bin.sig", modified, modified))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_SIGNING_KEY_PEM_BASE64", base64.StdEncoding.EncodeToString(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+	}
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Content-Signature: keyid=\"%s\"", keyID), props)
+}
+
+func TestCorrectClientEncrypted(t *testing.T) {
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+		{"SRV_API_CONTENT_ENCODINGS", "gzip"},
+		{"SRV_API_ENCRYPT_FILES", "true"},
+		{"SRV_API_ENCRYPTION_CACHE_DIR", t.TempDir()},
+	}
+	defer os.Setenv("SRV_API_ENCRYPT_FILES", "false")
+	headers := []string{"-Hx-resolver-id: 666", "-HAccept-Encoding: gzip"}
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"}, "Content-Type: application/jose", props)
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"},
+		"Etag: \"136884bffc2743524c8c084c34f1d472\"", props)
+}
+
+func TestCorrectClientReprDigest(t *testing.T) {
+	content, err := os.ReadFile("test-data/666_resolver_cache.bin")
+	assert.NoError(t, err)
+	sha256Digest := sha256.Sum256(content)
+	sha512Digest := sha512.Sum512(content)
+	sha256Field := "sha-256=:" + base64.StdEncoding.EncodeToString(sha256Digest[:]) + ":"
+	sha512Field := "sha-512=:" + base64.StdEncoding.EncodeToString(sha512Digest[:]) + ":"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"Repr-Digest: "+sha256Field+", "+sha512Field, props)
+	// Digest of the whole representation is sent with a part of it too.
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-HRange: bytes=0-99"}, []string{"HTTP/1.1 206"},
+		"Repr-Digest: "+sha256Field+", "+sha512Field, props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-HWant-Repr-Digest: sha-256=1, sha-512=5"},
+		[]string{"HTTP/1.1 200"}, "Repr-Digest: "+sha512Field+"\r\n", props)
+}
+
+func TestCorrectClientNamedResources(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("resolver-cache-hash"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_geoip.mmdb", []byte("geoip database"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_geoip.mmdb.md5", []byte("geoip-hash"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_config.bin", []byte("config bundle"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_config.bin.md5", []byte("config-hash"), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_RESOURCES", "geoip,config"},
+		{"SRV_API_RESOURCE_GEOIP_DATA_FILE_TEMPLATE", "%s/%s_geoip%s.mmdb"},
+		{"SRV_API_RESOURCE_GEOIP_HASH_FILE_TEMPLATE", "%s/%s_geoip.mmdb.md5"},
+		{"SRV_API_RESOURCE_GEOIP_CONTENT_TYPE", "application/vnd.maxmind.mmdb"},
+		{"SRV_API_RESOURCE_GEOIP_CACHE_CONTROL", "max-age=3600"},
+		{"SRV_API_RESOURCE_GEOIP_ALLOWED_CUSTOMERS", "999,1000"},
+		{"SRV_API_RESOURCE_CONFIG_ALLOWED_CUSTOMERS", "1000"},
+	}
+	headers := []string{"-Hx-resolver-id: 666"}
+	resourceInteraction(t, "geoip", "client-666", headers, []string{"HTTP/1.1 200"}, "geoip database", props)
+	resourceInteraction(t, "geoip", "client-666", headers, []string{"HTTP/1.1 200"},
+		"Content-Type: application/vnd.maxmind.mmdb", props)
+	resourceInteraction(t, "geoip", "client-666", headers, []string{"HTTP/1.1 200"}, "Cache-Control: max-age=3600", props)
+	resourceInteraction(t, "config", "client-666", headers, []string{"HTTP/1.1 403"}, config.RSP00016, props)
+	resourceInteraction(t, "blocklist", "client-666", headers, []string{"HTTP/1.1 404"}, config.RSP00015, props)
+	// The ID checks apply to all resources.
+	resourceInteraction(t, "geoip", "client-666", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 403"},
+		"Your id from CommonName 666 does not match id 777", props)
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"}, "resolver cache", props)
+}
+
+func TestCorrectClientManifest(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache_v3.bin", []byte("resolver cache v3"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("resolver-cache-hash"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_geoip.bin", []byte("geoip database"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_geoip.bin.md5", []byte("geoip-hash"), 0o600))
+	geoipDigest := sha256.Sum256([]byte("geoip database"))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_MANIFEST_URL", "/sinkit/rest/protostream/resolvercache/manifest"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_RESOURCES", "geoip,config"},
+		{"SRV_API_RESOURCE_CONFIG_ALLOWED_CUSTOMERS", "1000"},
+	}
+	headers := []string{"-Hx-resolver-id: 666"}
+	resourceInteraction(t, "manifest", "client-666", headers, []string{"HTTP/1.1 200"}, "Content-Type: application/json", props)
+	resourceInteraction(t, "manifest", "client-666", headers, []string{"HTTP/1.1 200"},
+		`{"url":"/sinkit/rest/protostream/resolvercache/","version":"v3","size":17,"etag":"\"resolver-cache-hash\""`, props)
+	resourceInteraction(t, "manifest", "client-666", headers, []string{"HTTP/1.1 200"},
+		fmt.Sprintf(`{"resource":"geoip","url":"/sinkit/rest/protostream/resolvercache/geoip","size":14,"etag":"\"geoip-hash\"","digest":"sha-256=:%s:"`,
+			base64.StdEncoding.EncodeToString(geoipDigest[:])), props)
+	resourceInteraction(t, "manifest", "client-666", append(headers, "-HAccept: application/cbor"), []string{"HTTP/1.1 200"},
+		"Content-Type: application/cbor", props)
+	resourceInteraction(t, "manifest", "client-666", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 403"},
+		"Your id from CommonName 666 does not match id 777", props)
+}
+
+func TestCorrectClientVersions(t *testing.T) {
+	dataDir := t.TempDir()
+	for i, version := range []string{"", "_v1", "_v2", "_beta"} {
+		path := fmt.Sprintf("%s/666_resolver_cache%s.bin", dataDir, version)
+		assert.NoError(t, os.WriteFile(path, []byte("resolver cache"+version), 0o600))
+		modified := time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC)
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("resolver-cache-hash"), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_VERSIONS_URL", "/sinkit/rest/protostream/resolvercache/versions"},
+		{"SRV_API_VERSIONS_PATTERN", `^v\d+$`},
+		{"SRV_API_VERSIONS_MAX", "1"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	defer os.Unsetenv("SRV_API_VERSIONS_MAX")
+	headers := []string{"-Hx-resolver-id: 666"}
+	resourceInteraction(t, "versions", "client-666", headers, []string{"HTTP/1.1 200"},
+		`{"client_id":666,"url":"/sinkit/rest/protostream/resolvercache/","versions":[`+
+			`{"url":"/sinkit/rest/protostream/resolvercache/","size":14,"etag":"\"resolver-cache-hash\"",`, props)
+	resourceInteraction(t, "versions", "client-666", headers, []string{"HTTP/1.1 200"}, `"current":true}`, props)
+	resourceInteraction(t, "versions", "client-666", headers, []string{"HTTP/1.1 200"},
+		`"version":"v2","size":17,"etag":"\"resolver-cache-hash\"","digest":"sha-256=:`, props)
+	resourceInteraction(t, "versions/geoip", "client-666", headers, []string{"HTTP/1.1 404"}, config.RSP00015, props)
+}
+
+func TestCorrectClientFallback(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/999_resolver_cache.bin", []byte("customer resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/999_resolver_cache.bin.md5", []byte("customer-hash"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/default_resolver_cache.bin", []byte("default resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/default_resolver_cache.bin.md5", []byte("default-hash"), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_FALLBACK", "customer,default"},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"X-File-Level: customer", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"Etag: \"customer-hash\"", props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"},
+		"default resolver cache", props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"},
+		"X-File-Level: default", props)
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("own resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("own-hash"), 0o600))
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		"X-File-Level: resolver", props)
+}
+
+func TestProducerPublish(t *testing.T) {
+	dataDir := t.TempDir()
+	published := md5.Sum([]byte("published cache"))
+	publishedV2 := md5.Sum([]byte("published cache v2"))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_PUBLISH_URL", "/sinkit/rest/protostream/resolvercache/publish/"},
+		{"SRV_API_PRODUCER_OU", "Testing"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	resourceInteraction(t, "publish/666", "client-777", []string{"-XPUT", "--data-binary", "published cache"},
+		[]string{"HTTP/1.1 204"}, fmt.Sprintf("Etag: \"%x\"", published), props)
+	resourceInteraction(t, "publish/666", "client-777", []string{"-XPUT", "--data-binary", "published cache v2", "-Hx-version: v2"},
+		[]string{"HTTP/1.1 204"}, fmt.Sprintf("Etag: \"%x\"", publishedV2), props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Etag: \"%x\"", published), props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-Hx-version: v2"}, []string{"HTTP/1.1 200"},
+		"published cache v2", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-Hx-version: v2"}, []string{"HTTP/1.1 200"},
+		fmt.Sprintf("Etag: \"%x\"", publishedV2), props)
+	resourceInteraction(t, "publish/666/geoip", "client-777", []string{"-XPUT", "--data-binary", "geoip"},
+		[]string{"HTTP/1.1 400"}, config.RSP00018, props)
+	resourceInteraction(t, "publish/666", "client-777", []string{"-XPUT", "--data-binary", "not a producer"},
+		[]string{"HTTP/1.1 403"}, config.RSP00017, append(props, []string{"SRV_API_PRODUCER_OU", "Producers"}))
+}
+
+func TestProducerPublishInterleaved(t *testing.T) {
+	dataDir := t.TempDir()
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_PUBLISH_URL", "/sinkit/rest/protostream/resolvercache/publish/"},
+		{"SRV_API_PRODUCER_OU", "Testing"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	resourceInteraction(t, "publish/666", "client-777", []string{"-XPUT", "--data-binary", "published cache"},
+		[]string{"HTTP/1.1 204"}, "", props)
+
+	cert, err := tls.LoadX509KeyPair("certs/client/certs/client-666.cert.pem", "certs/client/private/client-666.key.nopass.pem")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      trustedCACertPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+	// Each sidecar write is preceded by a download, it must get the new file described by its own digest.
+	downloads := 0
+	writeSidecar = func(path string, write func(w io.Writer) error) error {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%s/sinkit/rest/protostream/resolvercache/", bindPort), nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-resolver-id", "666")
+		req.Header.Set("Want-Repr-Digest", "sha-256=1")
+		rsp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			body, err := io.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			assert.NoError(t, err)
+			sum := sha256.Sum256(body)
+			assert.Equal(t, http.StatusOK, rsp.StatusCode)
+			assert.Equal(t, "published cache v2", string(body))
+			assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", rsp.Header.Get("Repr-Digest"))
+			downloads++
+		}
+		return filecache.WriteAtomically(path, write)
+	}
+	defer func() { writeSidecar = filecache.WriteAtomically }()
+	resourceInteraction(t, "publish/666", "client-777", []string{"-XPUT", "--data-binary", "published cache v2"},
+		[]string{"HTTP/1.1 204"}, fmt.Sprintf("Etag: \"%x\"", md5.Sum([]byte("published cache v2"))), props)
+	assert.Equal(t, 2, downloads)
+}
+
+func TestProducerCA(t *testing.T) {
+	dataDir := t.TempDir()
+	published := md5.Sum([]byte("published cache"))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_PUBLISH_URL", "/sinkit/rest/protostream/resolvercache/publish/"},
+		{"SRV_PRODUCER_CA_CERT_PEM_FILE", unknownCaCertFile},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	resourceInteraction(t, "publish/111", "unknown-client", []string{"-XPUT", "--data-binary", "published cache"},
+		[]string{"HTTP/1.1 204"}, fmt.Sprintf("Etag: \"%x\"", published), props)
+	// The producer certificate has a numeric CommonName, yet it is no client.
+	interaction(t, "unknown-client", []string{"-Hx-resolver-id: 111"}, []string{"HTTP/1.1 403"}, config.RSP00001, props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 466"}, config.RSP00008, props)
+}
+
+func TestCorrectClientLongPoll(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("old-hash"), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_WAIT_MAX_S", "10"},
+	}
+	defer os.Unsetenv("SRV_API_WAIT_MAX_S")
+	headers := []string{"-Hx-resolver-id: 666", "-HIf-None-Match: \"old-hash\"", "-HPrefer: wait=1"}
+	start := time.Now()
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 304"}, "Preference-Applied: wait=1", props)
+	assert.True(t, time.Since(start) >= time.Second)
+	go func() {
+		time.Sleep(time.Second)
+		os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("urgent resolver cache"), 0o600)
+		os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("new-hash"), 0o600)
+	}()
+	headers[2] = "-HPrefer: wait=60"
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"}, "urgent resolver cache", props)
+}
+
+func TestCorrectClientLongPollEmbargo(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/default_resolver_cache.bin", []byte("default cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/default_resolver_cache.bin.md5", []byte("hash-default"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache 666"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("hash-666"), 0o600))
+	embargo := time.Now().Add(3 * time.Second).UTC().Truncate(time.Second)
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.window", []byte("Not-Before: "+embargo.Format(time.RFC3339)), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_FALLBACK", "default"},
+		{"SRV_API_WAIT_MAX_S", "10"},
+	}
+	defer os.Unsetenv("SRV_API_WAIT_MAX_S")
+	// Nothing changes on disk when the embargo ends, the waiting client is woken up all the same.
+	headers := []string{"-Hx-resolver-id: 666", "-HIf-None-Match: \"hash-default\"", "-HPrefer: wait=10"}
+	interaction(t, "client-666", headers, []string{"HTTP/1.1 200"}, "resolver cache 666", props)
+	assert.False(t, time.Now().Before(embargo))
+	assert.True(t, time.Since(embargo) < 5*time.Second)
+}
+
+func TestCorrectClientEvents(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("old-hash"), 0o600))
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(dataDir+"/666_resolver_cache.bin", modified, modified))
+	apiURL := "/sinkit/rest/protostream/resolvercache/"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", apiURL},
+		{"SRV_API_EVENTS_URL", apiURL + "events"},
+		{"SRV_API_EVENTS_MAX_CONNECTIONS", "1"},
+		{"SRV_API_EVENTS_HEARTBEAT_S", "1"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), false)
+
+	cert, err := tls.LoadX509KeyPair(clientCertFile, "certs/client/private/client-777.key.nopass.pem")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      trustedCACertPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+	stream := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s:%s%sevents", bindHost, bindPort, apiURL), nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-resolver-id", "777")
+		if len(lastEventID) > 0 {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		rsp, err := client.Do(req)
+		assert.NoError(t, err)
+		return rsp, bufio.NewReader(rsp.Body)
+	}
+	// Reads the stream until the next event, heartbeats included.
+	next := func(r *bufio.Reader) string {
+		var event strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			if line == "\n" && event.Len() > 0 {
+				return event.String()
+			}
+			event.WriteString(line)
+			if err != nil {
+				return event.String()
+			}
+		}
+	}
+
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("old-hash"), 0o600))
+	rsp, events := stream("")
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+	busy, _ := stream("")
+	assert.Equal(t, http.StatusServiceUnavailable, busy.StatusCode)
+	busy.Body.Close()
+	assert.Equal(t, ": heartbeat\n", next(events))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("urgent resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("new-hash"), 0o600))
+	event := next(events)
+	for strings.HasPrefix(event, ": heartbeat") {
+		event = next(events)
+	}
+	assert.Contains(t, event, "event: publish\n")
+	assert.Contains(t, event, `"size":21,"etag":"\"new-hash\""`)
+	rsp.Body.Close()
+
+	// Resuming from before the change.
+	modified = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(dataDir+"/777_resolver_cache.bin", modified, modified))
+	rsp, events = stream(fmt.Sprintf("%d", modified.Add(-time.Second).UnixNano()))
+	// The closed stream may still hold the only slot for a moment.
+	for i := 0; rsp.StatusCode == http.StatusServiceUnavailable && i < 50; i++ {
+		rsp.Body.Close()
+		time.Sleep(100 * time.Millisecond)
+		rsp, events = stream(fmt.Sprintf("%d", modified.Add(-time.Second).UnixNano()))
+	}
+	event = next(events)
+	assert.Contains(t, event, fmt.Sprintf("id: %d\n", modified.UnixNano()))
+	assert.Contains(t, event, `"etag":"\"new-hash\""`)
+	rsp.Body.Close()
+}
+
+func TestCorrectClientEventsSharedDir(t *testing.T) {
+	dataDir := t.TempDir()
+	apiURL := "/sinkit/rest/protostream/resolvercache/"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", apiURL},
+		{"SRV_API_EVENTS_URL", apiURL + "events"},
+		{"SRV_API_EVENTS_MAX_CONNECTIONS", "2"},
+		{"SRV_API_EVENTS_HEARTBEAT_S", "1"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), false)
+
+	stream := func(id string) (*http.Response, *bufio.Reader) {
+		cert, err := tls.LoadX509KeyPair(fmt.Sprintf("certs/client/certs/client-%s.cert.pem", id),
+			fmt.Sprintf("certs/client/private/client-%s.key.nopass.pem", id))
+		assert.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      trustedCACertPool(),
+			Certificates: []tls.Certificate{cert},
+		}}}
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s:%s%sevents", bindHost, bindPort, apiURL), nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-resolver-id", id)
+		rsp, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		return rsp, bufio.NewReader(rsp.Body)
+	}
+	// Reads the stream until the next event other than a heartbeat.
+	next := func(r *bufio.Reader) string {
+		var event strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			if line == "\n" && event.Len() > 0 {
+				if !strings.HasPrefix(event.String(), ": heartbeat") {
+					return event.String()
+				}
+				event.Reset()
+				continue
+			}
+			event.WriteString(line)
+			if err != nil {
+				return event.String()
+			}
+		}
+	}
+
+	for _, id := range []string{"666", "777"} {
+		assert.NoError(t, os.WriteFile(dataDir+"/"+id+"_resolver_cache.bin", []byte("resolver cache"), 0o600))
+		assert.NoError(t, os.WriteFile(dataDir+"/"+id+"_resolver_cache.bin.md5", []byte("old-hash-"+id), 0o600))
+	}
+	rsp666, events666 := stream("666")
+	defer rsp666.Body.Close()
+	rsp777, events777 := stream("777")
+	defer rsp777.Body.Close()
+	// Both streams have listed the files once the first heartbeat arrives.
+	for _, r := range []*bufio.Reader{events666, events777} {
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, ": heartbeat\n", line)
+	}
+	for _, id := range []string{"666", "777"} {
+		assert.NoError(t, os.WriteFile(dataDir+"/"+id+"_resolver_cache.bin.md5", []byte("new-hash-"+id), 0o600))
+	}
+	event := next(events666)
+	assert.Contains(t, event, `"etag":"\"new-hash-666\""`)
+	assert.NotContains(t, event, "hash-777")
+	event = next(events777)
+	assert.Contains(t, event, `"etag":"\"new-hash-777\""`)
+	assert.NotContains(t, event, "hash-666")
+}
+
+func TestPublisherSharesFeeds(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("old-hash"), 0o600))
+	settings := &config.Settings{
+		API_URL:                  "/sinkit/rest/protostream/resolvercache/",
+		API_FILE_DIR:             dataDir,
+		API_WINDOW_FILE_TEMPLATE: "%s.window",
+		API_DIGEST_FILE_TEMPLATE: "%s.digest",
+		S3_GET_OBJECT_TIMEOUT_S:  5,
+		Resources: map[string]*config.Resource{"": {
+			DATA_FILE_TEMPLATE: "%s/%s_resolver_cache%s.bin",
+			HASH_FILE_TEMPLATE: "%s/%s_resolver_cache.bin.md5",
+		}},
+	}
+	changes := watch.New()
+	assert.NoError(t, changes.WatchDir(dataDir))
+	defer changes.Close()
+	feeds := newPublisher(settings, nil, nil, services{changes: changes, digests: digest.NewCache(10)})
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "777", Locality: []string{"999"}}}
+	first, second := feeds.subscribe(cert), feeds.subscribe(cert)
+	assert.Same(t, first, second)
+	// Another client listing files of the same directory has a feed of its own.
+	other := feeds.subscribe(&x509.Certificate{Subject: pkix.Name{CommonName: "666", Locality: []string{"999"}}})
+	assert.NotSame(t, first, other)
+	feeds.unsubscribe(other)
+	etag := func() string {
+		entries, _, listed, err := first.current()
+		if !listed || err != nil || len(entries) != 1 {
+			return ""
+		}
+		return entries[0].ETag
+	}
+	assert.Eventually(t, func() bool { return etag() == "\"old-hash\"" }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("new-hash"), 0o600))
+	assert.Eventually(t, func() bool { return etag() == "\"new-hash\"" }, 5*time.Second, 10*time.Millisecond)
+	feeds.unsubscribe(first)
+	assert.Len(t, feeds.feeds, 1)
+	feeds.unsubscribe(second)
+	assert.Empty(t, feeds.feeds)
+}
+
+func TestPublisherEmbargo(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	embargo := time.Now().Add(2 * time.Second).UTC().Truncate(time.Second)
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.window", []byte("Not-Before: "+embargo.Format(time.RFC3339)), 0o600))
+	settings := &config.Settings{
+		API_URL:                  "/sinkit/rest/protostream/resolvercache/",
+		API_FILE_DIR:             dataDir,
+		API_WINDOW_FILE_TEMPLATE: "%s.window",
+		API_DIGEST_FILE_TEMPLATE: "%s.digest",
+		S3_GET_OBJECT_TIMEOUT_S:  5,
+		Resources: map[string]*config.Resource{"": {
+			DATA_FILE_TEMPLATE: "%s/%s_resolver_cache%s.bin",
+			HASH_FILE_TEMPLATE: "%s/%s_resolver_cache.bin.md5",
+		}},
+	}
+	changes := watch.New()
+	assert.NoError(t, changes.WatchDir(dataDir))
+	defer changes.Close()
+	feeds := newPublisher(settings, nil, nil, services{changes: changes, digests: digest.NewCache(10)})
+	f := feeds.subscribe(&x509.Certificate{Subject: pkix.Name{CommonName: "777", Locality: []string{"999"}}})
+	defer feeds.unsubscribe(f)
+	// Nothing changes on disk when the embargo ends, the file is listed all the same.
+	assert.Eventually(t, func() bool {
+		entries, _, listed, err := f.current()
+		return listed && err == nil && len(entries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, time.Now().Before(embargo))
+}
+
+func TestCorrectClientRollout(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, version := range []string{"", "_v1", "_v2"} {
+		assert.NoError(t, os.WriteFile(fmt.Sprintf("%s/666_resolver_cache%s.bin", dataDir, version), []byte("resolver cache 666"+version), 0o600))
+		assert.NoError(t, os.WriteFile(fmt.Sprintf("%s/777_resolver_cache%s.bin", dataDir, version), []byte("resolver cache 777"+version), 0o600))
+	}
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("hash-666"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	rolloutFile := t.TempDir() + "/rollout.json"
+	assert.NoError(t, os.WriteFile(rolloutFile, []byte(`{"rollouts": [{"version": "v2", "resolvers": ["666"]}]}`), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_ROLLOUT_FILE", rolloutFile},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"}, "resolver cache 666_v2", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"}, "X-Version: v2", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-Hx-version: v1"}, []string{"HTTP/1.1 200"},
+		"resolver cache 666_v1", props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "Content-Length: 18", props)
+}
+
+func TestCorrectClientPins(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, version := range []string{"", "_v1", "_v2"} {
+		assert.NoError(t, os.WriteFile(fmt.Sprintf("%s/666_resolver_cache%s.bin", dataDir, version), []byte("resolver cache 666"+version), 0o600))
+	}
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache 777"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/10001_resolver_cache.bin", []byte("resolver cache 10001"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/10001_resolver_cache.bin.md5", []byte("hash-10001"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("hash-666"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	apiURL := "/sinkit/rest/protostream/resolvercache/"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", apiURL},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_PINS_FILE", t.TempDir() + "/pins.json"},
+		{"SRV_ADMIN_BIND_PORT", "2206"},
+		{"SRV_API_PIN_GENERATIONS_DIR", t.TempDir()},
+		{"SRV_API_ADMIN_OU", "Testing"},
+	}
+	defer os.Unsetenv("SRV_ADMIN_BIND_PORT")
+	// Pins are managed on the admin listener only.
+	resourceInteraction(t, "pins", "client-777", []string{"-Hx-resolver-id: 777", "-XPOST", "--data-binary", `{"resolvers": ["666"], "version": "v1"}`},
+		[]string{"HTTP/1.1 404"}, "", props)
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"resolvers": ["666"], "version": "v1"}`},
+		[]string{"HTTP/1.1 201"}, `"created_by":"777"`, props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-Hx-version: v2"}, []string{"HTTP/1.1 200"},
+		"resolver cache 666_v1", props)
+	// Client 777 is not pinned yet, its current generation is kept.
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "resolver cache 777", props)
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("broken cache 777"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-broken"), 0o600))
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"resolvers": ["777"], "generation": "hash-777"}`},
+		[]string{"HTTP/1.1 201"}, `"generation":"hash-777"`, props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "resolver cache 777", props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777", "-HIf-None-Match: \"hash-broken\""},
+		[]string{"HTTP/1.1 200"}, "Etag: \"hash-777\"", props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777", "-HIf-None-Match: \"hash-777\""},
+		[]string{"HTTP/1.1 304"}, "", props)
+	// A generation is a file of one resolver, others are pinned to the generation of their own file at a time.
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"all": true, "generation": "hash-777"}`},
+		[]string{"HTTP/1.1 400"}, "", props)
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(dataDir+"/10001_resolver_cache.bin", published, published))
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"}, "resolver cache 10001", props)
+	assert.NoError(t, os.WriteFile(dataDir+"/10001_resolver_cache.bin", []byte("broken cache 10001"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/10001_resolver_cache.bin.md5", []byte("hash-broken-10001"), 0o600))
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"all": true, "as_of": "2024-06-01T00:00:00Z"}`},
+		[]string{"HTTP/1.1 201"}, `"as_of":"2024-06-01T00:00:00Z"`, props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"}, "resolver cache 10001", props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"}, "Etag: \"hash-10001\"", props)
+	// The resolver pin of 777 wins over pins of everyone.
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "Etag: \"hash-777\"", props)
+	// Generations never served cannot be pinned to.
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"all": true, "as_of": "2023-01-01T00:00:00Z"}`},
+		[]string{"HTTP/1.1 201"}, "", props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 466"}, "Pinned generation is not available", props)
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"version": "v1"}`},
+		[]string{"HTTP/1.1 400"}, "", props)
+	adminInteraction(t, "pins/unknown", "client-777", []string{"-XDELETE"}, []string{"HTTP/1.1 404"}, "", props)
+	adminInteraction(t, "pins", "client-777", nil, []string{"HTTP/1.1 200"}, `"resolvers":["666"]`, props)
+	props[len(props)-1] = []string{"SRV_API_ADMIN_OU", "Admins"}
+	adminInteraction(t, "pins", "client-777", nil, []string{"HTTP/1.1 403"}, "", props)
+}
+
+func TestCorrectClientPinsEncrypted(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache 777"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	apiURL := "/sinkit/rest/protostream/resolvercache/"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", apiURL},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_PINS_FILE", t.TempDir() + "/pins.json"},
+		{"SRV_ADMIN_BIND_PORT", "2206"},
+		{"SRV_API_PIN_GENERATIONS_DIR", t.TempDir()},
+		{"SRV_API_ADMIN_OU", "Testing"},
+		{"SRV_API_ENCRYPT_FILES", "true"},
+		{"SRV_API_ENCRYPTION_CACHE_DIR", t.TempDir()},
+	}
+	defer os.Setenv("SRV_API_ENCRYPT_FILES", "false")
+	defer os.Unsetenv("SRV_ADMIN_BIND_PORT")
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "Content-Type: application/jose", props)
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("broken cache 777"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-broken"), 0o600))
+	adminInteraction(t, "pins", "client-777", []string{"-XPOST", "--data-binary", `{"resolvers": ["777"], "generation": "hash-777"}`},
+		[]string{"HTTP/1.1 201"}, `"generation":"hash-777"`, props)
+	// The pinned generation is encrypted too, the plaintext would show in the response.
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "Content-Type: application/jose", props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 200"}, "Etag: \"hash-777\"", props)
+}
+
+func TestCorrectClientWindow(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, id := range []string{"666", "777", "10001"} {
+		assert.NoError(t, os.WriteFile(fmt.Sprintf("%s/%s_resolver_cache.bin", dataDir, id), []byte("resolver cache "+id), 0o600))
+		assert.NoError(t, os.WriteFile(fmt.Sprintf("%s/%s_resolver_cache.bin.md5", dataDir, id), []byte("hash-"+id), 0o600))
+	}
+	embargo := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.window", []byte("Not-Before: "+embargo.Format(time.RFC3339)), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.window", []byte("Not-After: 2020-01-01T00:00:00Z"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/10001_resolver_cache.bin.window",
+		[]byte("Not-Before: 2020-01-01T00:00:00Z\nNot-After: "+embargo.Format(time.RFC3339)), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 466"},
+		"Retry-After: "+embargo.Format(http.TimeFormat), props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 466"}, "", props)
+	interaction(t, "client-777", []string{"-Hx-resolver-id: 777", "-HIf-None-Match: \"hash-777\""}, []string{"HTTP/1.1 466"}, "", props)
+	interaction(t, "client-10001", []string{"-Hx-resolver-id: 10001"}, []string{"HTTP/1.1 200"}, "resolver cache 10001", props)
+}
+
+func TestCorrectClientMetrics(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	apiURL := "/sinkit/rest/protostream/resolvercache/"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", apiURL},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_METRICS_BIND_PORT", "2205"},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), false)
+
+	cert, err := tls.LoadX509KeyPair(clientCertFile, "certs/client/private/client-777.key.nopass.pem")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      trustedCACertPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+	get := func(resource, etag string) int {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s:%s%s%s", bindHost, bindPort, apiURL, resource), nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-resolver-id", "777")
+		if len(etag) > 0 {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rsp, err := client.Do(req)
+		assert.NoError(t, err)
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get("", ""))
+	assert.Equal(t, http.StatusNotModified, get("", "\"hash-777\""))
+	assert.Equal(t, http.StatusNotFound, get("geoip", ""))
+	// No client certificate.
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: trustedCACertPool()}}}
+	if rsp, err := anonymous.Get(fmt.Sprintf("https://%s:%s%s", bindHost, bindPort, apiURL)); err == nil {
+		rsp.Body.Close()
+	}
+
+	expected := []string{
+		`serve_file_requests_total{code="200",endpoint="download",error=""} 1`,
+		`serve_file_requests_total{code="304",endpoint="download",error=""} 1`,
+		`serve_file_requests_total{code="404",endpoint="download",error="RSP00015"} 1`,
+		`serve_file_response_bytes_total{endpoint="download"} 14`,
+		`serve_file_tls_handshake_errors_total{reason="no_client_certificate"} 1`,
+		`serve_file_connections `,
+	}
+	assert.Eventually(t, func() bool {
+		rsp, err := http.Get(fmt.Sprintf("http://%s:2205/metrics", bindHost))
+		if err != nil {
+			return false
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		for _, line := range expected {
+			if !strings.Contains(string(body), line) {
+				t.Logf("%s not found yet", line)
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestCorrectClientAudit(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin", []byte("resolver cache 666"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/666_resolver_cache.bin.md5", []byte("hash-666"), 0o600))
+	auditFile := t.TempDir() + "/audit.log"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_AUDIT_LOG_SINK", "file"},
+		{"SRV_AUDIT_LOG_FILE", auditFile},
+	}
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666", "-HX-Request-Id: audit-1"}, []string{"HTTP/1.1 200"}, "resolver cache 666", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 403"}, "", props)
+
+	var records []map[string]interface{}
+	assert.Eventually(t, func() bool {
+		records = nil
+		file, err := os.Open(auditFile)
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+		lines := bufio.NewScanner(file)
+		for lines.Scan() {
+			rec := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(lines.Bytes(), &rec))
+			records = append(records, rec)
+		}
+		return len(records) == 2
+	}, 5*time.Second, 100*time.Millisecond)
+	if len(records) != 2 {
+		return
+	}
+	served, denied := records[0], records[1]
+	assert.Equal(t, "audit-1", served["request_id"])
+	assert.Equal(t, "download", served["endpoint"])
+	assert.Equal(t, "666", served["client_id"])
+	assert.Equal(t, "999", served["customer"])
+	assert.Equal(t, dataDir+"/666_resolver_cache.bin", served["object"])
+	assert.Equal(t, `"hash-666"`, served["etag"])
+	assert.Equal(t, float64(200), served["status"])
+	assert.Equal(t, float64(len("resolver cache 666")), served["bytes"])
+	assert.Equal(t, "success", served["outcome"])
+	assert.Equal(t, true, served["completed"])
+	assert.Contains(t, []interface{}{"127.0.0.1", "::1"}, served["remote_ip"])
+	assert.Equal(t, float64(403), denied["status"])
+	assert.Equal(t, "denied", denied["outcome"])
+	assert.Equal(t, "RSP00007", denied["error"])
+}
+
+func TestCorrectClientAuditChain(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	keysFile := t.TempDir() + "/public.pem"
+	assert.NoError(t, os.WriteFile(keysFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o600))
+	auditFile := t.TempDir() + "/audit.log"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+		{"SRV_SIGNING_KEY_PEM_BASE64", base64.StdEncoding.EncodeToString(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+		{"SRV_AUDIT_LOG_SINK", "file"},
+		{"SRV_AUDIT_LOG_FILE", auditFile},
+		{"SRV_AUDIT_LOG_CHAIN", "true"},
+		{"SRV_AUDIT_LOG_CHECKPOINT_RECORDS", "2"},
+	}
+	defer os.Setenv("SRV_AUDIT_LOG_CHAIN", "false")
+	defer os.Setenv("SRV_AUDIT_LOG_CHECKPOINT_RECORDS", "0")
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666"}, []string{"HTTP/1.1 200"}, "", props)
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 777"}, []string{"HTTP/1.1 403"}, "", props)
+	// Each run seals the chain with a checkpoint when it stops, the second run goes on with the chain.
+	var stdout, stderr strings.Builder
+	assert.Eventually(t, func() bool {
+		stdout.Reset()
+		stderr.Reset()
+		return auditCommand([]string{"verify", "-keys", keysFile, auditFile}, &stdout, &stderr) == 0 &&
+			strings.Contains(stdout.String(), "OK 2 records, 2 checkpoints, last line 4 with hash ")
+	}, 5*time.Second, 100*time.Millisecond, stdout.String()+stderr.String())
+	assert.NotContains(t, stdout.String(), "WARNING")
+
+	content, err := os.ReadFile(auditFile)
+	assert.NoError(t, err)
+	// A record after the last checkpoint is not signed.
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	head := sha256.Sum256([]byte(lines[len(lines)-1]))
+	unsigned := fmt.Sprintf("%s{\"seq\":5,\"prev\":\"%x\",\"status\":200}\n", content, head)
+	assert.NoError(t, os.WriteFile(auditFile, []byte(unsigned), 0o600))
+	stderr.Reset()
+	assert.Equal(t, 1, auditCommand([]string{"verify", "-keys", keysFile, auditFile}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "FAILED 1 records are not signed by a checkpoint.")
+	stdout.Reset()
+	assert.Equal(t, 0, auditCommand([]string{"verify", "-keys", keysFile, "-allow-unsigned", auditFile}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "WARNING 1 records are not signed by a checkpoint.")
+	assert.NoError(t, os.WriteFile(auditFile, []byte(strings.Replace(string(content), `"status":403`, `"status":200`, 1)), 0o600))
+	stderr.Reset()
+	assert.Equal(t, 1, auditCommand([]string{"verify", "-keys", keysFile, auditFile}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "FAILED "+auditFile+":4: previous line hash does not match")
+	assert.Equal(t, 2, auditCommand([]string{"verify", auditFile}, &stdout, &stderr))
+}
+
+func TestCorrectClientTraced(t *testing.T) {
+	var mutex sync.Mutex
+	var exported []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		if r.URL.Path == "/v1/traces" {
+			exported = append(exported, body...)
+		}
+		mutex.Unlock()
+	}))
+	defer collector.Close()
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", "localhost"},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", "test-data"},
+		{"SRV_TRACING_OTLP_ENDPOINT", strings.TrimPrefix(collector.URL, "http://")},
+		{"SRV_TRACING_OTLP_INSECURE", "true"},
+	}
+	defer os.Setenv("SRV_TRACING_OTLP_INSECURE", "false")
+	interaction(t, "client-666", []string{"-Hx-resolver-id: 666",
+		"-Htraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, []string{"HTTP/1.1 200"}, "", props)
+	// Spans are exported when the server stops at the latest.
+	traceID, _ := hex.DecodeString("4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, expected := range [][]byte{traceID, []byte("identity"), []byte("file.stat"), []byte("transfer"), []byte("serve-file")} {
+			if !bytes.Contains(exported, expected) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestHealthProbes(t *testing.T) {
+	dataDir := t.TempDir()
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_CRL_PEM_BASE64", crlBase64},
+		// Nothing listens there.
+		{"SRV_OCSP_URL", "http://localhost:2206"},
+		{"SRV_HEALTH_BIND_PORT", "2205"},
+		{"SRV_METRICS_BIND_PORT", "2205"},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), false)
+
+	get := func(path string) (int, map[string]interface{}) {
+		rsp, err := http.Get(fmt.Sprintf("http://%s:2205%s", bindHost, path))
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer rsp.Body.Close()
+		report := map[string]interface{}{}
+		json.NewDecoder(rsp.Body).Decode(&report)
+		return rsp.StatusCode, report
+	}
+	code, _ := get("/livez")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/startupz")
+	assert.Equal(t, http.StatusOK, code)
+	code, report := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "fail", report["status"])
+	statuses := map[string]string{}
+	if checks, ok := report["checks"].([]interface{}); assert.True(t, ok) {
+		for _, c := range checks {
+			check := c.(map[string]interface{})
+			statuses[check["name"].(string)] = check["status"].(string)
+		}
+	}
+	assert.Equal(t, map[string]string{"file-dir": "ok", "ocsp": "fail", "crl": "ok", "server-certificate": "ok"}, statuses)
+	// Metrics share the listener.
+	code, _ = get("/metrics")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReachable(t *testing.T) {
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		// malformedRequest
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write([]byte{0x30, 0x03, 0x0a, 0x01, 0x01})
+	}))
+	defer responder.Close()
+	detail, err := reachable(responder.URL + "/")(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, responder.URL+"/", detail)
+	_, err = reachable(responder.URL + "/wrong")(context.Background())
+	assert.ErrorContains(t, err, "404 Not Found")
+}
+
+func TestFreshCRL(t *testing.T) {
+	certs := certstore.New(tls.Certificate{}, &x509.RevocationList{NextUpdate: time.Now().Add(time.Hour)})
+	_, err := freshCRL(certs)(context.Background())
+	assert.NoError(t, err)
+	certs.Replace(tls.Certificate{}, &x509.RevocationList{NextUpdate: time.Now().Add(-time.Hour)})
+	_, err = freshCRL(certs)(context.Background())
+	assert.ErrorContains(t, err, "CRL is stale")
+	certs.Replace(tls.Certificate{}, nil)
+	_, err = freshCRL(certs)(context.Background())
+	assert.ErrorContains(t, err, "no CRL loaded")
+}
+
+// listingS3 keeps objects in memory and counts listings of every prefix.
+type listingS3 struct {
+	s3client.S3Client
+	mutex   sync.Mutex
+	objects map[string]minio.ObjectInfo
+	lists   map[string]int
+}
+
+func (s *listingS3) ListObjects(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lists[prefix]++
+	var objects []minio.ObjectInfo
+	for key, info := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, info)
+		}
+	}
+	return objects, nil
+}
+
+func (s *listingS3) StatObject(ctx context.Context, objectName string) (minio.ObjectInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info, exists := s.objects[objectName]
+	if !exists {
+		return info, minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound}
+	}
+	return info, nil
+}
+
+func TestOutdatedListsLevelsOnce(t *testing.T) {
+	object := func(key, etag string) minio.ObjectInfo {
+		return minio.ObjectInfo{Key: key, ETag: etag, LastModified: time.Now(),
+			Metadata: http.Header{"X-Amz-Meta-Repr-Digest": []string{"sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:"}}}
+	}
+	s3 := &listingS3{lists: map[string]int{}, objects: map[string]minio.ObjectInfo{
+		"666_resolver_cache.bin":     object("666_resolver_cache.bin", "hash-666"),
+		"default_resolver_cache.bin": object("default_resolver_cache.bin", "hash-new"),
+	}}
+	settings := &config.Settings{
+		API_URL:                 "/sinkit/rest/protostream/resolvercache/",
+		API_USE_S3:              true,
+		API_RSP_ERROR_HEADER:    "X-Error",
+		S3_GET_OBJECT_TIMEOUT_S: 5,
+		Resources: map[string]*config.Resource{"": {
+			S3_DATA_FILE_TEMPLATE: "%s_resolver_cache%s.bin",
+			FALLBACK:              []string{config.LevelCustomer, config.LevelDefault},
+		}},
+	}
+	seen, err := lastseen.Open(t.TempDir()+"/last_seen.db", time.Hour)
+	assert.NoError(t, err)
+	defer seen.Close()
+	for _, id := range []string{"666", "777", "888", "10001"} {
+		etag := `"hash-default"`
+		if id == "666" {
+			etag = `"hash-666"`
+		}
+		served := logging.Requests(seen.Track("download", func(w http.ResponseWriter, r *http.Request) {
+			logging.Annotate(r.Context(), slog.String("resource", ""))
+			w.Header().Set("ETag", etag)
+		}), "X-Request-Id")
+		r := httptest.NewRequest(http.MethodGet, settings.API_URL, nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: id, Locality: []string{"999"}}}}}}
+		served.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	rec := httptest.NewRecorder()
+	outdatedHandler(settings, s3, nil, services{seen: seen, digests: digest.NewCache(10)})(
+		rec, httptest.NewRequest(http.MethodGet, "/admin/reports/outdated", nil), "777")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var report []outdated
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	var ids []string
+	for _, o := range report {
+		ids = append(ids, o.ClientID)
+		assert.Equal(t, "hash-new", o.Expected)
+	}
+	assert.Equal(t, []string{"10001", "777", "888"}, ids)
+	// Levels of the customer and everyone are listed once for all of its clients.
+	assert.Equal(t, map[string]int{"666_resolver_cache": 1, "777_resolver_cache": 1, "888_resolver_cache": 1,
+		"10001_resolver_cache": 1, "999_resolver_cache": 1, "default_resolver_cache": 1}, s3.lists)
+}
+
+func TestAdminAPI(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	crlFile := t.TempDir() + "/crl.pem"
+	crl, err := os.ReadFile("certs/crl/certs/intermediate.crl.pem")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(crlFile, crl, 0o600))
+	auditFile := t.TempDir() + "/audit.log"
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_CRL_PEM_FILE", crlFile},
+		{"SRV_API_ADMIN_OU", "Testing"},
+		{"SRV_AUDIT_LOG_SINK", "file"},
+		{"SRV_AUDIT_LOG_FILE", auditFile},
+		{"SRV_ADMIN_BIND_PORT", "2206"},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+		os.Setenv("SRV_ADMIN_BIND_PORT", "0")
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:2206", bindHost), false)
+
+	cert, err := tls.LoadX509KeyPair(clientCertFile, "certs/client/private/client-777.key.nopass.pem")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      trustedCACertPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+	call := func(method, path string) (int, string) {
+		req, err := http.NewRequest(method, fmt.Sprintf("https://%s:2206/admin%s", bindHost, path), nil)
+		assert.NoError(t, err)
+		rsp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+
+	code, body := call(http.MethodGet, "/config")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"ADMIN_BIND_PORT":2206`)
+	assert.Contains(t, body, `"SERVER_KEY_PEM_BASE64":"REDACTED"`)
+	code, body = call(http.MethodGet, "/clients/777?customer=999")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"allowed":true`)
+	assert.Contains(t, body, `"etag":"\"hash-777\""`)
+	code, _ = call(http.MethodGet, "/clients/777")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = call(http.MethodGet, "/revocation?serial=109C")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"revoked":true`)
+	code, body = call(http.MethodGet, "/caches")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"digest":{"entries":1}`)
+	code, _ = call(http.MethodDelete, "/caches/digest")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = call(http.MethodDelete, "/caches/unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = call(http.MethodPost, "/reload")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"number":"4097"`)
+	// A broken CRL is not taken, the previous one is kept.
+	assert.NoError(t, os.WriteFile(crlFile, []byte("garbage"), 0o600))
+	code, _ = call(http.MethodPost, "/reload")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, body = call(http.MethodGet, "/revocation")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"number":"4097"`)
+	// Neither is an empty one, revocation stays on.
+	assert.NoError(t, os.WriteFile(crlFile, nil, 0o600))
+	code, _ = call(http.MethodPost, "/reload")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	code, body = call(http.MethodGet, "/revocation?serial=109C")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"revoked":true`)
+	code, _ = call(http.MethodGet, "/reload")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Profiling is off unless switched on.
+	code, _ = call(http.MethodGet, "/debug/pprof/")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = call(http.MethodPut, "/debug/profiling")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"enabled":true`)
+	code, body = call(http.MethodGet, "/debug/pprof/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "goroutine profile")
+	code, _ = call(http.MethodGet, "/debug/pprof/trace?seconds=1")
+	assert.Equal(t, http.StatusOK, code)
+	code, body = call(http.MethodGet, "/debug/vars")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"memstats"`)
+	code, body = call(http.MethodDelete, "/debug/profiling")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"enabled":false`)
+	code, _ = call(http.MethodGet, "/debug/pprof/heap")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	assert.Eventually(t, func() bool {
+		records, _ := os.ReadFile(auditFile)
+		return strings.Contains(string(records), `"endpoint":"admin.reload"`) &&
+			strings.Contains(string(records), `"object":"cache/digest"`) &&
+			strings.Contains(string(records), `"object":"profiling"`)
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestLastSeen(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin", []byte("resolver cache"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-777"), 0o600))
+	props := [][]string{
+		{"SRV_CA_CERT_PEM_BASE64", caCertBase64},
+		{"SRV_SERVER_CERT_PEM_BASE64", serverCertBase64},
+		{"SRV_SERVER_KEY_PEM_BASE64", serverKeyBase64},
+		{"SRV_BIND_PORT", bindPort},
+		{"SRV_BIND_HOST", bindHost},
+		{"SRV_API_URL", "/sinkit/rest/protostream/resolvercache/"},
+		{"SRV_API_FILE_DIR", dataDir},
+		{"SRV_API_ADMIN_OU", "Testing"},
+		{"SRV_ADMIN_BIND_PORT", "2206"},
+		{"SRV_LAST_SEEN_FILE", t.TempDir() + "/last_seen.db"},
+	}
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, prop := range props {
+		os.Setenv(prop[0], prop[1])
+	}
+	defer func() {
+		for _, prop := range props {
+			os.Unsetenv(prop[0])
+		}
+		os.Setenv("SRV_ADMIN_BIND_PORT", "0")
+	}()
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:%s", bindHost, bindPort), true)
+	go main()
+	defer syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	waitForTCP(30*time.Second, fmt.Sprintf("%s:2206", bindHost), false)
+
+	cert, err := tls.LoadX509KeyPair(clientCertFile, "certs/client/private/client-777.key.nopass.pem")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      trustedCACertPool(),
+		Certificates: []tls.Certificate{cert},
+	}}}
+	call := func(method, url string, headers ...string) (int, string) {
+		req, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-resolver-id", "777")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rsp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+	admin := fmt.Sprintf("https://%s:2206/admin", bindHost)
+
+	code, _ := call(http.MethodGet, fmt.Sprintf("https://%s:%s/sinkit/rest/protostream/resolvercache/", bindHost, bindPort))
+	assert.Equal(t, http.StatusOK, code)
+	code, body := call(http.MethodGet, admin+"/clients/777?customer=999")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"last_seen":{"id":"777","customer":"999"`)
+	assert.Contains(t, body, `"resources":{"":{`)
+	assert.Contains(t, body, `"served_etag":"\"hash-777\""`)
+	code, body = call(http.MethodGet, admin+"/reports/stale")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+	code, _ = call(http.MethodGet, admin+"/reports/stale?hours=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = call(http.MethodGet, admin+"/reports/outdated")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+
+	// A new generation is published, the client has not fetched it yet.
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache.bin.md5", []byte("hash-778"), 0o600))
+	code, body = call(http.MethodGet, admin+"/reports/outdated")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"client_id":"777"`)
+	assert.Contains(t, body, `"served_etag":"\"hash-777\"","expected_etag":"\"hash-778\""`)
+
+	// A client asking for a version is compared with that version, not with the current file.
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache_v2.bin", []byte("resolver cache v2"), 0o600))
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache_v2.bin.md5", []byte("hash-v2"), 0o600))
+	code, _ = call(http.MethodGet, fmt.Sprintf("https://%s:%s/sinkit/rest/protostream/resolvercache/", bindHost, bindPort), "x-version", "v2")
+	assert.Equal(t, http.StatusOK, code)
+	code, body = call(http.MethodGet, admin+"/clients/777?customer=999")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"requested_version":"v2"`)
+	code, body = call(http.MethodGet, admin+"/reports/outdated")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+	assert.NoError(t, os.WriteFile(dataDir+"/777_resolver_cache_v2.bin.md5", []byte("hash-v3"), 0o600))
+	code, body = call(http.MethodGet, admin+"/reports/outdated")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"served_etag":"\"hash-v2\"","expected_etag":"\"hash-v3\""`)
+	assert.Contains(t, body, `"version":"v2"`)
+}
@@ -0,0 +1,296 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Signature header value, e.g.
+//
+//	keyid="NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", alg="ed25519", sig="<base64>"
+//
+// The signature is computed over the SHA-256 digest of the file, i.e. the identity
+// representation. Clients verify it after decoding or applying a patch.
+const (
+	AlgEd25519     = "ed25519"
+	AlgECDSASHA256 = "ecdsa-sha256"
+)
+
+const maxCachedSignatures = 10000
+
+var ErrNoSigningKey = errors.New("no signing key configured")
+
+type Signer struct {
+	key   crypto.Signer
+	keyID string
+	alg   string
+	keys  []jwk
+
+	mutex sync.Mutex
+	cache map[string]string
+}
+
+// New creates a Signer. The key may be nil if only publishers sign files; publicKeys are
+// additional keys announced in the key set, e.g. retired keys or keys of publishers.
+func New(key crypto.Signer, publicKeys []crypto.PublicKey) (*Signer, error) {
+	s := &Signer{key: key, cache: make(map[string]string)}
+	if key != nil {
+		alg, err := algorithm(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		s.alg = alg
+		s.keyID, err = KeyID(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append([]crypto.PublicKey{key.Public()}, publicKeys...)
+	}
+	seen := make(map[string]bool)
+	for _, publicKey := range publicKeys {
+		k, err := toJWK(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if seen[k.Kid] {
+			continue
+		}
+		seen[k.Kid] = true
+		s.keys = append(s.keys, k)
+	}
+	return s, nil
+}
+
+func (s *Signer) CanSign() bool {
+	return s.key != nil
+}
+
+// Sign returns the signature header value for the content. Signatures are cached per file name and ETag,
+// so the content is read only once per file generation.
+func (s *Signer) Sign(name, etag string, content io.Reader) (string, error) {
+	if s.key == nil {
+		return "", ErrNoSigningKey
+	}
+	cacheKey := name + "\x00" + etag
+	s.mutex.Lock()
+	signature, ok := s.cache[cacheKey]
+	s.mutex.Unlock()
+	if ok {
+		return signature, nil
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(digest, content); err != nil {
+		return "", err
+	}
+	signature, err := s.SignDigest(digest.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	if len(s.cache) >= maxCachedSignatures {
+		s.cache = make(map[string]string)
+	}
+	s.cache[cacheKey] = signature
+	s.mutex.Unlock()
+	return signature, nil
+}
+
+// SignDigest returns the signature header value for a SHA-256 digest.
+func (s *Signer) SignDigest(digest []byte) (string, error) {
+	if s.key == nil {
+		return "", ErrNoSigningKey
+	}
+	var sig []byte
+	var err error
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, digest)
+	case *ecdsa.PrivateKey:
+		sig, err = ecdsa.SignASN1(rand.Reader, key, digest)
+	default:
+		err = fmt.Errorf("unsupported signing key %T", s.key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("keyid=%q, alg=%q, sig=%q", s.keyID, s.alg, base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// KeySet is a JSON Web Key Set (RFC 7517) of all keys signatures may be verified with.
+// The signing key comes first.
+func (s *Signer) KeySet() ([]byte, error) {
+	return json.Marshal(struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: s.keys})
+}
+
+// Verify checks the signature header value against the SHA-256 digest of a file.
+func Verify(header string, digest []byte, keys map[string]crypto.PublicKey) error {
+	params := parseParams(header)
+	key, ok := keys[params["keyid"]]
+	if !ok {
+		return fmt.Errorf("unknown key %s", params["keyid"])
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["sig"])
+	if err != nil {
+		return err
+	}
+	valid := false
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		valid = params["alg"] == AlgEd25519 && ed25519.Verify(k, digest, sig)
+	case *ecdsa.PublicKey:
+		valid = params["alg"] == AlgECDSASHA256 && ecdsa.VerifyASN1(k, digest, sig)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// ParsePrivateKey reads a PKCS #8 Ed25519 or ECDSA key, or a SEC 1 EC key.
+func ParsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported signing key %T, use Ed25519 or ECDSA", key)
+}
+
+// ParsePublicKeys reads all PKIX public keys from concatenated PEM blocks.
+func ParsePublicKeys(pemBytes []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = algorithm(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM data found")
+	}
+	return keys, nil
+}
+
+// KeyID is the JWK thumbprint of the key, https://www.rfc-editor.org/rfc/rfc7638
+func KeyID(key crypto.PublicKey) (string, error) {
+	k, err := toJWK(key)
+	if err != nil {
+		return "", err
+	}
+	return k.Kid, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use"`
+}
+
+func toJWK(key crypto.PublicKey) (jwk, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var k jwk
+	var thumbprintInput string
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		k = jwk{Kty: "OKP", Crv: "Ed25519", X: b64(pub), Alg: "EdDSA"}
+		thumbprintInput = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k = jwk{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64(pub.X.FillBytes(make([]byte, size))),
+			Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+		}
+		// JWA has no name for SHA-256 digests signed with larger curves, alg is optional in a JWK.
+		if pub.Curve == elliptic.P256() {
+			k.Alg = "ES256"
+		}
+		thumbprintInput = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	default:
+		return jwk{}, fmt.Errorf("unsupported public key %T, use Ed25519 or ECDSA", key)
+	}
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+	k.Kid = b64(thumbprint[:])
+	k.Use = "sig"
+	return k, nil
+}
+
+func algorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return AlgEd25519, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() || k.Curve == elliptic.P384() || k.Curve == elliptic.P521() {
+			return AlgECDSASHA256, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported public key %T, use Ed25519 or ECDSA", key)
+}
+
+func parseParams(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if found {
+			params[strings.ToLower(name)] = strings.Trim(value, "\"")
+		}
+	}
+	return params
+}
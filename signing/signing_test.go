@@ -0,0 +1,104 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	content := "resolver cache"
+	digest := sha256.Sum256([]byte(content))
+	for _, key := range []crypto.Signer{edKey, ecKey} {
+		signer, err := New(key, nil)
+		assert.NoError(t, err)
+		signature, err := signer.Sign("404_resolver_cache.bin", "\"abc\"", strings.NewReader(content))
+		assert.NoError(t, err)
+		keyID, err := KeyID(key.Public())
+		assert.NoError(t, err)
+		assert.Contains(t, signature, keyID)
+		keys := map[string]crypto.PublicKey{keyID: key.Public()}
+		assert.NoError(t, Verify(signature, digest[:], keys))
+		tampered := sha256.Sum256([]byte("tampered resolver cache"))
+		assert.Error(t, Verify(signature, tampered[:], keys))
+		// Cached by name and ETag, the content is not read again.
+		cached, err := signer.Sign("404_resolver_cache.bin", "\"abc\"", strings.NewReader("ignored"))
+		assert.NoError(t, err)
+		assert.Equal(t, signature, cached)
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	_, current, _ := ed25519.GenerateKey(rand.Reader)
+	previous, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(previous.Public())
+	publicKeys, err := ParsePublicKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	signer, err := New(current, publicKeys)
+	assert.NoError(t, err)
+	keySet, err := signer.KeySet()
+	assert.NoError(t, err)
+	var parsed struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(keySet, &parsed))
+	assert.Len(t, parsed.Keys, 2)
+	currentID, _ := KeyID(current.Public())
+	assert.Equal(t, currentID, parsed.Keys[0]["kid"])
+	assert.Equal(t, "Ed25519", parsed.Keys[0]["crv"])
+	assert.Equal(t, "EdDSA", parsed.Keys[0]["alg"])
+	assert.Equal(t, "P-384", parsed.Keys[1]["crv"])
+	assert.NotContains(t, parsed.Keys[1], "alg")
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	k, err := toJWK(p256.Public())
+	assert.NoError(t, err)
+	assert.Equal(t, "ES256", k.Alg)
+
+	verifyOnly, err := New(nil, publicKeys)
+	assert.NoError(t, err)
+	assert.False(t, verifyOnly.CanSign())
+	_, err = verifyOnly.Sign("404_resolver_cache.bin", "\"abc\"", strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	key, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.NoError(t, err)
+	assert.Equal(t, edKey.Public(), key.Public())
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalECPrivateKey(ecKey)
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	assert.NoError(t, err)
+	_, err = ParsePrivateKey([]byte("garbage"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"whalebone.io/serve-file/logging"
+)
+
+func TestRequests(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	defer slog.SetDefault(slog.Default())
+	out := &bytes.Buffer{}
+	assert.NoError(t, logging.Setup(out, "json", "info", nil))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "ocsp")
+		End(span, errors.New("responder is down"))
+		logging.Info(r.Context(), "Served.")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	handler := Requests(mux, mux)
+	req := httptest.NewRequest(http.MethodGet, "/data/geoip", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	assert.Len(t, ended, 2)
+	ocsp, server := ended[0], ended[1]
+	assert.Equal(t, "ocsp", ocsp.Name())
+	assert.Equal(t, codes.Error, ocsp.Status().Code)
+	assert.Equal(t, server.SpanContext().SpanID(), ocsp.Parent().SpanID())
+	// Named after the route, not the path.
+	assert.Equal(t, "GET /data/", server.Name())
+	assert.Contains(t, server.Attributes(), attribute.String("url.path", "/data/geoip"))
+	assert.Contains(t, server.Attributes(), attribute.String("http.route", "/data/"))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, codes.Error, server.Status().Code)
+
+	rec := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rec["trace_id"])
+	assert.Equal(t, server.SpanContext().SpanID().String(), rec["span_id"])
+
+	// Requests routed nowhere are named after the method only.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown/666", nil))
+	assert.Equal(t, "GET", spans.Ended()[2].Name())
+}
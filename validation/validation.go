@@ -18,14 +18,16 @@ package validation
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/x509"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 
 	"golang.org/x/crypto/ocsp"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
 )
 
 var ocspOpts = ocsp.RequestOptions{
@@ -42,15 +44,16 @@ func CertIsRevokedCRL(cert *x509.Certificate, crl *x509.RevocationList) bool {
 	return false
 }
 
-func CertIsRevokedOCSP(leaf *x509.Certificate, caCert *x509.Certificate, ocspURL string) (revoked, ok bool) {
+// CertIsRevokedOCSP asks ocspURL about the leaf certificate. Failures are logged with the request fields of ctx.
+func CertIsRevokedOCSP(ctx context.Context, leaf *x509.Certificate, caCert *x509.Certificate, ocspURL string) (revoked, ok bool) {
 	ocspRequest, err := ocsp.CreateRequest(leaf, caCert, &ocspOpts)
 	if err != nil {
-		log.Printf(err.Error())
+		logging.Error(ctx, config.RSL00052, leaf.Subject.CommonName, err.Error())
 		return
 	}
-	resp, err := SendOCSPRequest(ocspURL, ocspRequest, leaf, caCert)
+	resp, err := SendOCSPRequest(ctx, ocspURL, ocspRequest, leaf, caCert)
 	if err != nil {
-		log.Printf(err.Error())
+		logging.Warn(ctx, config.RSL00053, ocspURL, leaf.Subject.CommonName, err.Error())
 		return
 	}
 	ok = true
@@ -61,11 +64,13 @@ func CertIsRevokedOCSP(leaf *x509.Certificate, caCert *x509.Certificate, ocspURL
 }
 
 // TODO: Data race?
-func SendOCSPRequest(server string, req []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
-	var resp *http.Response
-	var err error
-	buf := bytes.NewBuffer(req)
-	resp, err = http.Post(server, "application/ocsp-request", buf)
+func SendOCSPRequest(ctx context.Context, server string, req []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewBuffer(req))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
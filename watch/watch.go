@@ -0,0 +1,299 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"whalebone.io/serve-file/config"
+	"whalebone.io/serve-file/logging"
+)
+
+// Changes wakes up requests waiting for files to change. Waiters name the keys they wait for:
+// paths of files and directories watched with WatchDir, or keys checked with Poll.
+// They are not told which key changed, they check their own files again and keep waiting if they are the same.
+type Changes struct {
+	mu      sync.Mutex
+	waiters map[string]map[*Waiter]struct{}
+	timers  map[string]*time.Timer
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+}
+
+// Waiter waits for one of its keys to change, see Changes.Watch.
+type Waiter struct {
+	changes *Changes
+	keys    []string
+	changed chan struct{}
+}
+
+// New tracks changes signalled with Notify, see also WatchDir and Poll.
+func New() *Changes {
+	return &Changes{waiters: map[string]map[*Waiter]struct{}{}, timers: map[string]*time.Timer{}}
+}
+
+// WatchDir notifies waiters of changes in the directory and its subdirectories, both of the changed
+// file and of its directory. Subdirectories created later are watched too.
+func (c *Changes) WatchDir(dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return watcher.Add(path)
+	})
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	c.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Create) {
+					// Not a directory or already gone, nothing to watch then.
+					_ = watcher.Add(event.Name)
+				}
+				c.Notify(filepath.Clean(event.Name))
+				c.Notify(filepath.Dir(event.Name))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been lost, let waiters check their files.
+				logging.Error(context.Background(), config.RSL00055, err.Error())
+				c.NotifyAll()
+			}
+		}
+	}()
+	return nil
+}
+
+// Poll checks versions of the watched keys every interval, e.g. for S3 that cannot be watched, and wakes up
+// waiters of keys whose version changed. Each key is checked once per interval, however many requests wait for it.
+// A key checked for the first time wakes up its waiters too, it might have changed before they registered.
+func (c *Changes) Poll(interval time.Duration, version func(key string) (string, error)) {
+	c.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		versions := map[string]string{}
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				return
+			}
+			keys := c.keys()
+			current := make(map[string]string, len(keys))
+			for _, key := range keys {
+				previous, known := versions[key]
+				v, err := version(key)
+				if err != nil {
+					logging.Error(context.Background(), config.RSL00056, key, err.Error())
+					if known {
+						current[key] = previous
+					}
+					continue
+				}
+				current[key] = v
+				if !known || previous != v {
+					c.Notify(key)
+				}
+			}
+			// Keys nobody waits for are forgotten.
+			versions = current
+		}
+	}()
+}
+
+// Close stops watching directories, polling and timers of NotifyAt.
+func (c *Changes) Close() error {
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.mu.Lock()
+	for _, timer := range c.timers {
+		timer.Stop()
+	}
+	c.mu.Unlock()
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.Close()
+}
+
+// Watch registers a waiter for the keys. Waiters must register before they check their files,
+// so that a change right after the check is not missed, and Stop once they are done.
+func (c *Changes) Watch(keys ...string) *Waiter {
+	w := &Waiter{changes: c, keys: keys, changed: make(chan struct{})}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if c.waiters[key] == nil {
+			c.waiters[key] = map[*Waiter]struct{}{}
+		}
+		c.waiters[key][w] = struct{}{}
+	}
+	return w
+}
+
+// Notify wakes up waiters of the key.
+func (c *Changes) Notify(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for w := range c.waiters[key] {
+		c.wake(w)
+	}
+}
+
+// NotifyAt wakes up waiters of the key at the time, e.g. when an embargoed file gets published.
+// Nothing changes on disk or in S3 then, so neither WatchDir nor Poll would notice.
+func (c *Changes) NotifyAt(key string, at time.Time) {
+	id := key + "\x00" + strconv.FormatInt(at.UnixNano(), 10)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, scheduled := c.timers[id]; scheduled {
+		return
+	}
+	c.timers[id] = time.AfterFunc(time.Until(at), func() {
+		c.mu.Lock()
+		delete(c.timers, id)
+		c.mu.Unlock()
+		c.Notify(key)
+	})
+}
+
+// NotifyAll wakes up all waiters.
+func (c *Changes) NotifyAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, waiters := range c.waiters {
+		for w := range waiters {
+			c.wake(w)
+		}
+	}
+}
+
+func (c *Changes) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.waiters))
+	for key := range c.waiters {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// wake closes the waiter's channel and unregisters it, c.mu must be held.
+func (c *Changes) wake(w *Waiter) {
+	close(w.changed)
+	c.remove(w)
+}
+
+func (c *Changes) remove(w *Waiter) {
+	for _, key := range w.keys {
+		delete(c.waiters[key], w)
+		if len(c.waiters[key]) == 0 {
+			delete(c.waiters, key)
+		}
+	}
+}
+
+// Changed is closed on the next change of one of the keys.
+func (w *Waiter) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// Stop unregisters the waiter if it has not been woken up yet.
+func (w *Waiter) Stop() {
+	w.changes.mu.Lock()
+	defer w.changes.mu.Unlock()
+	select {
+	case <-w.changed:
+	default:
+		w.changes.remove(w)
+	}
+}
+
+// Slots bound the number of requests held at once.
+type Slots chan struct{}
+
+func NewSlots(size int) Slots {
+	return make(Slots, size)
+}
+
+// Acquire takes a slot. If all slots are taken, the request is answered right away.
+func (s Slots) Acquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release returns the slot taken with Acquire.
+func (s Slots) Release() {
+	<-s
+}
+
+// Wait blocks until changed is closed. It returns false if the deadline passes
+// or the request is gone first.
+func Wait(ctx context.Context, changed <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// PreferredWait reads the wait preference, e.g. Prefer: wait=60, https://www.rfc-editor.org/rfc/rfc7240#section-4.3
+func PreferredWait(prefer string) (time.Duration, bool) {
+	for _, preference := range strings.Split(prefer, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(preference), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "wait") {
+			continue
+		}
+		value, _, _ = strings.Cut(value, ";")
+		seconds, err := strconv.ParseUint(strings.Trim(strings.TrimSpace(value), `"`), 10, 32)
+		if err != nil || seconds == 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
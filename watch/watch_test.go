@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package watch
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferredWait(t *testing.T) {
+	wait, ok := PreferredWait("wait=60")
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, wait)
+	wait, ok = PreferredWait("respond-async, Wait=\"10\"")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+	_, ok = PreferredWait("return=minimal")
+	assert.False(t, ok)
+	_, ok = PreferredWait("wait=-1")
+	assert.False(t, ok)
+}
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	changes := New()
+	assert.NoError(t, changes.WatchDir(dir))
+	defer changes.Close()
+	other := changes.Watch(dir + "/777_resolver_cache.bin.md5")
+	defer other.Stop()
+	waiter := changes.Watch(dir+"/666_resolver_cache.bin", dir+"/666_resolver_cache.bin.md5")
+	assert.NoError(t, os.WriteFile(dir+"/666_resolver_cache.bin.md5", []byte("new-hash"), 0o600))
+	assert.True(t, Wait(context.Background(), waiter.Changed(), time.Now().Add(5*time.Second)))
+	assert.False(t, Wait(context.Background(), other.Changed(), time.Now().Add(10*time.Millisecond)))
+	listing := changes.Watch(dir)
+	assert.NoError(t, os.WriteFile(dir+"/666_resolver_cache_v2.bin", []byte("new"), 0o600))
+	assert.True(t, Wait(context.Background(), listing.Changed(), time.Now().Add(5*time.Second)))
+}
+
+func TestPoll(t *testing.T) {
+	changes := New()
+	var mu sync.Mutex
+	versions := map[string]string{"a": "1", "b": "1"}
+	polled := map[string]int{}
+	changes.Poll(time.Millisecond, func(key string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		polled[key]++
+		return versions[key], nil
+	})
+	defer changes.Close()
+	// Keys seen for the first time wake up their waiters.
+	first := changes.Watch("a")
+	assert.True(t, Wait(context.Background(), first.Changed(), time.Now().Add(5*time.Second)))
+	a1, a2 := changes.Watch("a"), changes.Watch("a")
+	b := changes.Watch("b")
+	defer b.Stop()
+	assert.True(t, Wait(context.Background(), b.Changed(), time.Now().Add(5*time.Second)))
+	b = changes.Watch("b")
+	assert.False(t, Wait(context.Background(), a1.Changed(), time.Now().Add(20*time.Millisecond)))
+	mu.Lock()
+	versions["a"] = "2"
+	mu.Unlock()
+	assert.True(t, Wait(context.Background(), a1.Changed(), time.Now().Add(5*time.Second)))
+	assert.True(t, Wait(context.Background(), a2.Changed(), time.Now().Add(5*time.Second)))
+	assert.False(t, Wait(context.Background(), b.Changed(), time.Now().Add(20*time.Millisecond)))
+}
+
+func TestStop(t *testing.T) {
+	changes := New()
+	waiter := changes.Watch("a", "b")
+	waiter.Stop()
+	assert.Empty(t, changes.keys())
+	changes.Notify("a")
+	assert.False(t, Wait(context.Background(), waiter.Changed(), time.Now().Add(10*time.Millisecond)))
+	waiter = changes.Watch("a", "b")
+	changes.Notify("b")
+	assert.True(t, Wait(context.Background(), waiter.Changed(), time.Now().Add(10*time.Millisecond)))
+	assert.Empty(t, changes.keys())
+	waiter.Stop()
+}
+
+func TestNotifyAt(t *testing.T) {
+	changes := New()
+	defer changes.Close()
+	waiter := changes.Watch("a")
+	changes.NotifyAt("a", time.Now().Add(50*time.Millisecond))
+	changes.NotifyAt("a", time.Now().Add(time.Hour))
+	assert.False(t, Wait(context.Background(), waiter.Changed(), time.Now().Add(10*time.Millisecond)))
+	assert.True(t, Wait(context.Background(), waiter.Changed(), time.Now().Add(5*time.Second)))
+}
+
+func TestSlots(t *testing.T) {
+	slots := NewSlots(1)
+	assert.True(t, slots.Acquire())
+	assert.False(t, slots.Acquire())
+	slots.Release()
+	assert.True(t, slots.Acquire())
+}
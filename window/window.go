@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package window
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the bounds in S3 user metadata and in the sidecar file.
+const (
+	NotBefore = "Not-Before"
+	NotAfter  = "Not-After"
+)
+
+// Window is the time a file is published in. The file is embargoed before NotBefore and expired
+// from NotAfter on. Zero bounds are open.
+type Window struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Parse reads the bounds in RFC 3339, empty bounds are open.
+func Parse(notBefore, notAfter string) (Window, error) {
+	var w Window
+	var err error
+	if notBefore = strings.TrimSpace(notBefore); len(notBefore) > 0 {
+		if w.NotBefore, err = time.Parse(time.RFC3339, notBefore); err != nil {
+			return Window{}, fmt.Errorf("%s: %w", NotBefore, err)
+		}
+	}
+	if notAfter = strings.TrimSpace(notAfter); len(notAfter) > 0 {
+		if w.NotAfter, err = time.Parse(time.RFC3339, notAfter); err != nil {
+			return Window{}, fmt.Errorf("%s: %w", NotAfter, err)
+		}
+	}
+	if !w.NotBefore.IsZero() && !w.NotAfter.IsZero() && !w.NotBefore.Before(w.NotAfter) {
+		return Window{}, fmt.Errorf("%s %s is not before %s %s", NotBefore, notBefore, NotAfter, notAfter)
+	}
+	return w, nil
+}
+
+// ReadFile reads the bounds from a sidecar file with header-like lines, e.g.
+//
+//	Not-Before: 2024-06-01T00:00:00Z
+//	Not-After: 2024-07-01T00:00:00Z
+//
+// A missing file is an open window.
+func ReadFile(path string) (Window, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Window{}, nil
+		}
+		return Window{}, err
+	}
+	// The blank line ends the header block even if the file lacks it.
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(content, "\n\n"...)))).ReadMIMEHeader()
+	if err != nil {
+		return Window{}, err
+	}
+	return Parse(header.Get(NotBefore), header.Get(NotAfter))
+}
+
+// Contains tells whether the file is published at the time.
+func (w Window) Contains(now time.Time) bool {
+	return !w.Embargoed(now) && (w.NotAfter.IsZero() || now.Before(w.NotAfter))
+}
+
+// Embargoed tells whether the file is not published yet at the time.
+func (w Window) Embargoed(now time.Time) bool {
+	return !w.NotBefore.IsZero() && now.Before(w.NotBefore)
+}
+
+// Next tells when the file next gets published or expires after the time, zero if never.
+func (w Window) Next(now time.Time) time.Time {
+	if w.Embargoed(now) {
+		return w.NotBefore
+	}
+	if !w.NotAfter.IsZero() && now.Before(w.NotAfter) {
+		return w.NotAfter
+	}
+	return time.Time{}
+}
+
+// Cache keeps windows of immutable content, e.g. of an S3 object generation identified by its ETag,
+// so that they are not read again whenever the object is not modified.
+type Cache struct {
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]Window
+}
+
+func NewCache(maxEntries int) *Cache {
+	return &Cache{maxEntries: maxEntries, entries: make(map[string]Window)}
+}
+
+// Get returns the cached window for the key or loads it. Load errors are not cached.
+func (c *Cache) Get(key string, load func() (Window, error)) (Window, error) {
+	c.mutex.Lock()
+	w, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok {
+		return w, nil
+	}
+	w, err := load()
+	if err != nil {
+		return Window{}, err
+	}
+	c.Put(key, w)
+	return w, nil
+}
+
+// Put stores a window read elsewhere, e.g. along with the object.
+func (c *Cache) Put(key string, w Window) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.entries = make(map[string]Window)
+	}
+	c.entries[key] = w
+}
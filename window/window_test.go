@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2018  Michal Karm Babacek
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package window
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContains(t *testing.T) {
+	midnight := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	w, err := Parse("2024-06-01T00:00:00Z", "2024-06-02T00:00:00Z")
+	assert.NoError(t, err)
+	assert.True(t, w.Embargoed(midnight.Add(-time.Second)))
+	assert.False(t, w.Contains(midnight.Add(-time.Second)))
+	assert.True(t, w.Contains(midnight))
+	assert.False(t, w.Embargoed(midnight.Add(24*time.Hour)))
+	assert.False(t, w.Contains(midnight.Add(24*time.Hour)))
+
+	assert.Equal(t, midnight, w.Next(midnight.Add(-time.Second)))
+	assert.Equal(t, midnight.Add(24*time.Hour), w.Next(midnight))
+	assert.True(t, w.Next(midnight.Add(24*time.Hour)).IsZero())
+
+	open, err := Parse("", " ")
+	assert.NoError(t, err)
+	assert.True(t, open.Contains(midnight))
+	assert.True(t, open.Next(midnight).IsZero())
+
+	_, err = Parse("2024-06-02T00:00:00Z", "2024-06-01T00:00:00Z")
+	assert.Error(t, err)
+	_, err = Parse("tomorrow", "")
+	assert.Error(t, err)
+}
+
+func TestReadFile(t *testing.T) {
+	path := t.TempDir() + "/cache.bin.window"
+	w, err := ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Window{}, w)
+
+	assert.NoError(t, os.WriteFile(path, []byte("Not-Before: 2024-06-01T00:00:00Z\nnot-after: 2024-06-02T02:00:00+02:00"), 0o600))
+	w, err = ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, w.NotBefore.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, w.NotAfter.Equal(time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(1)
+	loads := 0
+	load := func() (Window, error) {
+		loads++
+		return Parse("2024-06-01T00:00:00Z", "")
+	}
+	w, err := cache.Get("object\"aaa\"", load)
+	assert.NoError(t, err)
+	assert.False(t, w.NotBefore.IsZero())
+	_, _ = cache.Get("object\"aaa\"", load)
+	assert.Equal(t, 1, loads)
+	_, err = cache.Get("object\"bbb\"", func() (Window, error) { return Parse("tomorrow", "") })
+	assert.Error(t, err)
+	cache.Put("object\"ccc\"", Window{})
+	_, _ = cache.Get("object\"aaa\"", load)
+	assert.Equal(t, 2, loads)
+}